@@ -0,0 +1,439 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+// Downloading everything we have about somebody, and forgetting them.
+
+func init() {
+	http.HandleFunc("/exportAccount", exportAccountHandler)
+	http.HandleFunc("/deleteAccount", deleteAccountHandler)
+}
+
+// One of somebody's items along with everything stored under it
+type ArchivedItem struct {
+	ID         int64
+	Item       TodoItem
+	Comments   []Comment
+	Activities []Activity
+	Revisions  []Revision
+}
+
+// One of somebody's lists along with who it's shared with
+type ArchivedList struct {
+	ID      int64
+	List    TodoList
+	Members []ListMember
+}
+
+// When one of somebody's reminders goes out, as long as the item isn't
+// done by then
+type ArchivedReminder struct {
+	ItemID    int64
+	Recipient string
+	SendAt    time.Time
+}
+
+// n.b. just when the tokens were made, not the tokens themselves: the
+// archive might end up somewhere less careful than here
+type AccountSettings struct {
+	CalendarFeedCreated time.Time
+	APITokenCreated     time.Time
+	ReminderLead        string // how long before the due date reminders go out
+}
+
+// Everything in the datastore that's about email: see accountArchive
+type AccountArchive struct {
+	Email       string
+	Exported    time.Time
+	Settings    AccountSettings
+	Items       []ArchivedItem
+	Lists       []ArchivedList
+	Memberships []ListMember       // lists other people shared with them
+	Comments    []Comment          // what they said about other people's items
+	Reminders   []ArchivedReminder // for their items that aren't done yet
+	ImportJobs  []ImportJob
+}
+
+func (a AccountArchive) isMaybeError() {}
+
+// Reads everything of email's: the items they made, with their comments,
+// activity and history, the lists they own, the lists they've been invited
+// to, their comments on other people's items, their tokens and reminders,
+// and their imports.
+func accountArchive(ctx context.Context, email string) *MaybeError {
+	var result = new(MaybeError)
+	archive := AccountArchive{Email: email, Exported: time.Now()}
+	archive.Settings.ReminderLead = reminderLead.String()
+	fail := func(err error) *MaybeError {
+		*result = E(err.Error())
+		return result
+	}
+
+	var items []TodoItem
+	keys, err := datastore.NewQuery("TodoItem").Filter("OwnerEmail=", email).GetAll(ctx, &items)
+	if err != nil {
+		return fail(err)
+	}
+	owned := map[int64]bool{}
+	for i, k := range keys {
+		owned[k.IntID()] = true
+		archived := ArchivedItem{ID: k.IntID(), Item: items[i]}
+		if _, err := datastore.NewQuery("Comment").Ancestor(k).GetAll(ctx, &archived.Comments); err != nil {
+			return fail(err)
+		}
+		if _, err := datastore.NewQuery("Activity").Ancestor(k).GetAll(ctx, &archived.Activities); err != nil {
+			return fail(err)
+		}
+		if _, err := datastore.NewQuery("Revision").Ancestor(k).GetAll(ctx, &archived.Revisions); err != nil {
+			return fail(err)
+		}
+		archive.Items = append(archive.Items, archived)
+		if items[i].State != "completed" && !items[i].InTrash() {
+			archive.Reminders = append(archive.Reminders,
+				ArchivedReminder{k.IntID(), reminderRecipient(items[i]), items[i].DueDate.Add(-reminderLead)})
+		}
+	}
+
+	var lists []TodoList
+	keys, err = datastore.NewQuery("TodoList").Filter("OwnerEmail=", email).GetAll(ctx, &lists)
+	if err != nil {
+		return fail(err)
+	}
+	for i, k := range keys {
+		members, err := listMembers(ctx, k.IntID())
+		if err != nil {
+			return fail(err)
+		}
+		archive.Lists = append(archive.Lists, ArchivedList{k.IntID(), lists[i], members})
+	}
+	if _, err := datastore.NewQuery("ListMember").Filter("Email=", email).GetAll(ctx, &archive.Memberships); err != nil {
+		return fail(err)
+	}
+
+	var comments []Comment
+	keys, err = datastore.NewQuery("Comment").Filter("AuthorEmail=", email).GetAll(ctx, &comments)
+	if err != nil {
+		return fail(err)
+	}
+	for i, k := range keys {
+		// the ones on their own items are already with the items
+		if !owned[k.Parent().IntID()] {
+			archive.Comments = append(archive.Comments, comments[i])
+		}
+	}
+
+	var token SecretToken
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, feedTokenKind, email, 0, nil), &token); err == nil {
+		archive.Settings.CalendarFeedCreated = token.Created
+	}
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, apiTokenKind, email, 0, nil), &token); err == nil {
+		archive.Settings.APITokenCreated = token.Created
+	}
+
+	if _, err := datastore.NewQuery("ImportJob").Filter("OwnerEmail=", email).GetAll(ctx, &archive.ImportJobs); err != nil {
+		return fail(err)
+	}
+	for i := range archive.ImportJobs {
+		// they're all in Items already, or they didn't get imported
+		archive.ImportJobs[i].Items = nil
+	}
+	*result = archive
+	return result
+}
+
+// Deletes the keys that query q finds, maxDeleteBatch at a time
+func deleteQueryKeys(ctx context.Context, q *datastore.Query) error {
+	keys, err := q.KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the reminders queued for email's items. Reminders for items that
+// are gone get dropped when they come up anyway (see sendOneReminder), but
+// that could be a long way off, and this way nothing of theirs is left in
+// the queue. n.b. reminders queued before they were tagged with the owner
+// can't be found this way, and have to wait their turn.
+func deleteReminders(ctx context.Context, email string) error {
+	for {
+		tasks, err := taskqueue.LeaseByTag(ctx, 1000, "reminders", 60, email)
+		if err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+		if err := taskqueue.DeleteMulti(ctx, tasks, "reminders"); err != nil {
+			return err
+		}
+	}
+}
+
+// What other people's items' histories say instead of the email address
+// of somebody who deleted their account
+const deletedAccountName = "a deleted account"
+
+// Takes the item with key k away from email, if it's still theirs. Unlike
+// changeTodoItem this doesn't leave a Revision, which would name them.
+func unassignDeletedAccount(ctx context.Context, k *datastore.Key, email string) error {
+	var item TodoItem
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, k, &item); err != nil {
+			return err
+		}
+		if item.Assignee != email {
+			return nil
+		}
+		// goes back to the owner, the same as unassigning it
+		item.Assignee = ""
+		item.Version++
+		item.UpdatedAt = time.Now()
+		_, err := datastore.Put(tc, k, &item)
+		return err
+	}, nil)
+	if err == nil {
+		updateCache(ctx, *k, item)
+	}
+	return err
+}
+
+// Takes email out of the Revisions and Activities of other people's items:
+// the ones they made, the ones that had them as the assignee, and the
+// reassignments on those items that mention them. items are more items
+// that might have reassignments mentioning them.
+func forgetAccountInHistories(ctx context.Context, email string, items []*datastore.Key) error {
+	var mentioned = make(map[string]*datastore.Key)
+	for _, k := range items {
+		mentioned[k.Encode()] = k
+	}
+	for _, filter := range []string{"EditorEmail=", "Item.Assignee="} {
+		var revisions []Revision
+		keys, err := datastore.NewQuery("Revision").Filter(filter, email).GetAll(ctx, &revisions)
+		if err != nil {
+			return err
+		}
+		var src = make([]interface{}, len(revisions))
+		for i := range revisions {
+			src[i] = &revisions[i]
+			if revisions[i].EditorEmail == email {
+				revisions[i].EditorEmail = deletedAccountName
+			}
+			if revisions[i].Item.Assignee == email {
+				revisions[i].Item.Assignee = ""
+			}
+			mentioned[keys[i].Parent().Encode()] = keys[i].Parent()
+		}
+		if err := putInBatches(ctx, keys, src); err != nil {
+			return err
+		}
+	}
+	var activities []Activity
+	keys, err := datastore.NewQuery("Activity").Filter("ActorEmail=", email).GetAll(ctx, &activities)
+	if err != nil {
+		return err
+	}
+	var seen = make(map[string]bool)
+	for _, k := range keys {
+		seen[k.Encode()] = true
+	}
+	for _, k := range mentioned {
+		var reassigned []Activity
+		more, err := datastore.NewQuery("Activity").Ancestor(k).Filter("Kind=", activityReassigned).GetAll(ctx, &reassigned)
+		if err != nil {
+			return err
+		}
+		for i, ak := range more {
+			// the ones they did themselves are already there
+			if !seen[ak.Encode()] {
+				keys = append(keys, ak)
+				activities = append(activities, reassigned[i])
+			}
+		}
+	}
+	var src = make([]interface{}, len(activities))
+	for i := range activities {
+		src[i] = &activities[i]
+		if activities[i].ActorEmail == email {
+			activities[i].ActorEmail = deletedAccountName
+		}
+		activities[i].Detail = strings.Replace(activities[i].Detail, email, deletedAccountName, -1)
+	}
+	return putInBatches(ctx, keys, src)
+}
+
+// PutMulti for more than the datastore takes at once. src holds pointers
+// to the entities.
+func putInBatches(ctx context.Context, keys []*datastore.Key, src []interface{}) error {
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(ctx, keys[start:end], src[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forgets email: deletes their items (and everything under them, their
+// cache entries and search documents), the lists they own along with
+// whatever's in them, their memberships of other people's lists, their
+// comments, tokens, imports and queued reminders, and unassigns them from
+// items they were assigned. Other people's items' activity logs and
+// histories stay, but say "a deleted account" instead of their address.
+func deleteAccount(ctx context.Context, email string) *MaybeError {
+	var result = new(MaybeError)
+	fail := func(err error) *MaybeError {
+		*result = E(err.Error())
+		return result
+	}
+	deleteItems := func(q *datastore.Query) error {
+		keys, err := q.KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(keys); start += maxBulkItems {
+			end := start + maxBulkItems
+			if end > len(keys) {
+				end = len(keys)
+			}
+			deleted := deleteTodoItems(ctx, keys[start:end])
+			switch (*deleted).(type) {
+			case Ok:
+			default:
+				return fmt.Errorf("%v", *deleted)
+			}
+		}
+		return nil
+	}
+
+	// reminders first, so none go out while the rest is being deleted
+	if err := deleteReminders(ctx, email); err != nil {
+		return fail(err)
+	}
+	if err := deleteItems(datastore.NewQuery("TodoItem").Filter("OwnerEmail=", email)); err != nil {
+		return fail(err)
+	}
+	listKeys, err := datastore.NewQuery("TodoList").Filter("OwnerEmail=", email).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return fail(err)
+	}
+	for _, k := range listKeys {
+		// other people's items in their lists go with the lists
+		if err := deleteItems(inListQuery(k.IntID())); err != nil {
+			return fail(err)
+		}
+		if err := deleteQueryKeys(ctx, datastore.NewQuery("ListMember").Ancestor(k)); err != nil {
+			return fail(err)
+		}
+	}
+	if err := datastore.DeleteMulti(ctx, listKeys); err != nil {
+		return fail(err)
+	}
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery("ListMember").Filter("Email=", email),
+		datastore.NewQuery("Comment").Filter("AuthorEmail=", email),
+		datastore.NewQuery("ImportJob").Filter("OwnerEmail=", email),
+	} {
+		if err := deleteQueryKeys(ctx, q); err != nil {
+			return fail(err)
+		}
+	}
+	for _, kind := range []string{feedTokenKind, apiTokenKind, mailTokenKind, inboxMigrationKind, inboxPointerKind} {
+		err := datastore.Delete(ctx, datastore.NewKey(ctx, kind, email, 0, nil))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return fail(err)
+		}
+	}
+	assigned, err := datastore.NewQuery("TodoItem").Filter("Assignee=", email).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return fail(err)
+	}
+	for _, k := range assigned {
+		if err := unassignDeletedAccount(ctx, k, email); err != nil {
+			return fail(err)
+		}
+	}
+	if err := forgetAccountInHistories(ctx, email, assigned); err != nil {
+		return fail(err)
+	}
+	log("deleted the account of " + email)
+	*result = Ok{}
+	return result
+}
+
+func exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	archive := accountArchive(ctx, email)
+	switch (*archive).(type) {
+	case AccountArchive:
+	default:
+		respondWith(w, *archive)
+		return
+	}
+	blob := accountArchiveToJson((*archive).(AccountArchive))
+	switch (*blob).(type) {
+	case Blob:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="tada-account.json"`)
+		w.Write((*blob).(Blob))
+	default:
+		respondWith(w, *blob)
+	}
+}
+
+// GET asks them to make sure; POST expects "confirm" to be their email
+// address, so nobody does this by accident
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	if r.Method != "POST" {
+		fmt.Fprint(w, `<html><h1>Delete your account</h1>
+<p>This deletes all your items and the lists you own, including other
+people's items in them, for good. You might want to
+<a href="/exportAccount">download your data</a> first.</p>
+ <form action="/deleteAccount" method="post">
+   Type your email address to make sure: <input name="confirm">
+   <input type="submit" value="Delete everything">
+ </form>
+<a href="/">Back to your lists</a>
+</html>`)
+		return
+	}
+	if r.FormValue("confirm") != email {
+		http.Error(w, "That isn't your email address, so nothing was deleted", 400)
+		return
+	}
+	result := deleteAccount(ctx, email)
+	switch (*result).(type) {
+	case Ok:
+		url, _ := user.LogoutURL(ctx, "/")
+		fmt.Fprintf(w, `<html><p>Your account is gone. <a href="%s">Sign out</a></p></html>`, url)
+	default:
+		respondWith(w, *result)
+	}
+}
@@ -0,0 +1,136 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// The JSON API that the command-line client (cmd/tada) uses, besides
+// /todo/{id} and /search. Like those, it takes an API token instead of a
+// login; see apiUser.
+
+func init() {
+	http.HandleFunc("/items", itemsHandler)
+	http.HandleFunc("/lists", listsHandler)
+}
+
+// GET lists the items the root page would show, all of them at once, for
+// the same "list", "view" and filter parameters (see viewItems): e.g.
+// /items?due=overdue. POST makes a new one out of JSON (see jsonToNewItem)
+// and answers with it the way /todo/{id} would.
+func itemsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		listID, view, f, err := viewFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		_, items := viewItems(ctx, u, listID, view, f)
+		switch (*items).(type) {
+		case Matches:
+		default:
+			respondWith(w, *items)
+			return
+		}
+		blob := pageToJson(Page{(*items).(Matches), ""})
+		switch (*blob).(type) {
+		case Blob:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write((*blob).(Blob))
+		default:
+			respondWith(w, *blob)
+		}
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if handleError(w, err) {
+			return
+		}
+		maybeItem := jsonToNewItem(body, time.Now())
+		switch (*maybeItem).(type) {
+		case TodoItem:
+		default:
+			http.Error(w, string((*maybeItem).(E)), 400)
+			return
+		}
+		item := (*maybeItem).(TodoItem)
+		if item.ListID == 0 {
+			inbox := ensureInbox(ctx, u)
+			switch (*inbox).(type) {
+			case TodoListID:
+				k := datastore.Key((*inbox).(TodoListID))
+				item.ListID = k.IntID()
+			default:
+				respondWith(w, *inbox)
+				return
+			}
+		}
+		id := writeNewTodoItem(ctx, item, u, true)
+		switch (*id).(type) {
+		case TodoID:
+			k := datastore.Key((*id).(TodoID))
+			detail := readItemDetail(ctx, u.Email, k.IntID())
+			switch (*detail).(type) {
+			case ItemDetail:
+			default:
+				respondWith(w, *detail)
+				return
+			}
+			blob := itemDetailToJson((*detail).(ItemDetail))
+			switch (*blob).(type) {
+			case Blob:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", itemETag((*detail).(ItemDetail).Item))
+				w.Header().Set("Location", fmt.Sprintf("/todo/%d", k.IntID()))
+				w.WriteHeader(http.StatusCreated)
+				w.Write((*blob).(Blob))
+			default:
+				respondWith(w, *blob)
+			}
+		case E:
+			// probably a list they can't add to
+			http.Error(w, string((*id).(E)), http.StatusForbidden)
+		default:
+			respondWith(w, *id)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, r.Method+" isn't something you can do to your items", http.StatusMethodNotAllowed)
+	}
+}
+
+// The lists the caller can see, theirs and the ones shared with them, as
+// JSON
+func listsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	lists := visibleTodoLists(ctx, u)
+	switch (*lists).(type) {
+	case TodoLists:
+	default:
+		respondWith(w, *lists)
+		return
+	}
+	blob := todoListsToJson((*lists).(TodoLists))
+	switch (*blob).(type) {
+	case Blob:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write((*blob).(Blob))
+	default:
+		respondWith(w, *blob)
+	}
+}
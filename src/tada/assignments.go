@@ -0,0 +1,107 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/assignTask", assignTaskHandler)
+}
+
+// Returns the email address that should get reminders about item:
+// whoever it's assigned to, or the owner if it isn't assigned to anybody
+func reminderRecipient(item TodoItem) string {
+	if item.Assignee != "" {
+		return item.Assignee
+	}
+	return item.OwnerEmail
+}
+
+// Assigns the item with ID id to assignee, or un-assigns it if assignee is "".
+// email is the user making the change, who has to be able to edit the item;
+// assignee has to be able to see it.
+func assignTodoItem(ctx context.Context, email string, id int64, assignee string) *MaybeError {
+	var result = new(MaybeError)
+	k := datastore.NewKey(ctx, "TodoItem", "", id, nil)
+	maybeItem := readTodoItem(ctx, TodoID(*k))
+	switch (*maybeItem).(type) {
+	case TodoItem:
+		item := (*maybeItem).(TodoItem)
+		if !canEdit(itemRole(ctx, email, item)) {
+			*result = E("you can't change that item")
+			return result
+		}
+		if assignee != "" && !canView(itemRole(ctx, assignee, item)) {
+			*result = E(assignee + " can't see that item; share its list with them first")
+			return result
+		}
+		changed := changeTodoItem(ctx, email, k, anyVersion, func(item *TodoItem) {
+			item.Assignee = assignee
+		})
+		switch (*changed).(type) {
+		case Change:
+		default:
+			return changed
+		}
+		change := (*changed).(Change)
+		previous := change.Before.Assignee
+		item = change.After
+		recordChanges(ctx, *k, email, change.Before, item)
+		if assignee != "" && assignee != previous && assignee != email {
+			// ignore errors: the item still shows up in their "assigned to me" view
+			sendAssignmentEmail(ctx, email, assignee, item)
+		}
+		*result = Ok{}
+	case E:
+		return maybeItem
+	default:
+		*result = E("weird answer from readTodoItem in assignTodoItem")
+	}
+	return result
+}
+
+// Returns an array of the todo items assigned to u, whoever created them
+func listAssignedTodoItems(ctx context.Context, u *user.User) *MaybeError {
+	return listTodoItemsForQuery(ctx, u, assignedQuery(u).Order("DueDate"))
+}
+
+// n.b. unordered, so applyFilter can add the order
+func assignedQuery(u *user.User) *datastore.Query {
+	return datastore.NewQuery("TodoItem").Filter("Assignee=", u.Email)
+}
+
+func sendAssignmentEmail(ctx context.Context, assignerEmail string, assignee string, item TodoItem) bool {
+	msg := &mail.Message{
+		Sender:  "Tada <tada@tada-1202.appspotmail.com>",
+		To:      []string{assignee},
+		Subject: fmt.Sprintf("[Tada] %s assigned you a task: %s", assignerEmail, item.Description),
+		Body: fmt.Sprintf(`%s assigned you a task:
+%s
+(due %s)
+`, assignerEmail, item.Description, item.DueDate.Format("2006-01-02")),
+	}
+	return (mail.Send(ctx, msg) == nil)
+}
+
+// Expects "id" and "assignee" parameters; an empty assignee un-assigns the item
+func assignTaskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+	} else {
+		respondWith(w, *(assignTodoItem(ctx, email, itemID, r.FormValue("assignee"))))
+		rootHandler(w, r)
+	}
+}
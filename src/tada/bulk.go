@@ -0,0 +1,395 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/search"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/bulk", bulkHandler)
+}
+
+// What bulkUpdate can do to a bunch of items at once
+const (
+	bulkComplete = "complete"
+	bulkReopen   = "reopen"
+	bulkDelete   = "delete"    // moves the items to the trash
+	bulkRestore  = "restore"   // gets them back out of the trash
+	bulkPurge    = "purge"     // deletes them for good
+	bulkRetag    = "retag"     // replaces the items' tags
+	bulkMove     = "move"      // into another list
+	bulkShift    = "shift"     // moves the due dates by a number of days
+	maxBulkItems = maxPageSize // you can only select what's on one page
+)
+
+// The search service only takes this many documents per call
+const maxSearchBatch = 200
+
+// and the datastore only takes this many keys per DeleteMulti
+const maxDeleteBatch = 500
+
+// How a bulk operation went. Skipped is the IDs of the items that weren't
+// changed because they're gone or email isn't allowed to change them.
+type BulkResult struct {
+	Changed int
+	Skipped []int64
+}
+
+func (b BulkResult) isMaybeError() {}
+
+// What to do to the items, for bulkUpdate. Only the field that goes with
+// Action has to be filled in.
+type BulkAction struct {
+	Action string
+	Tags   []string // for bulkRetag
+	ListID int64    // for bulkMove
+	Days   int      // for bulkShift
+}
+
+// Changes item the way a says to
+func (a BulkAction) apply(item *TodoItem, now time.Time) {
+	switch a.Action {
+	case bulkComplete:
+		item.State = "completed"
+	case bulkReopen:
+		item.State = "incomplete"
+	case bulkDelete:
+		item.DeletedAt = now
+	case bulkRestore:
+		item.DeletedAt = time.Time{}
+	case bulkRetag:
+		item.Tags = a.Tags
+	case bulkMove:
+		item.ListID = a.ListID
+	case bulkShift:
+		item.DueDate = item.DueDate.AddDate(0, 0, a.Days)
+	}
+}
+
+// Does action to all the items with IDs ids that email can edit. Each item
+// gets its own changeTodoItem transaction (they're all in different entity
+// groups), so the Revisions go in with the changes. n.b. unlike
+// updateTodoItem this doesn't check versions: whatever you selected gets changed.
+func bulkUpdate(ctx context.Context, email string, ids []int64, action BulkAction) *MaybeError {
+	var result = new(MaybeError)
+	switch action.Action {
+	case bulkComplete, bulkReopen, bulkDelete, bulkRestore, bulkPurge, bulkRetag, bulkMove, bulkShift:
+	default:
+		*result = E(action.Action + " isn't something you can do to a bunch of items")
+		return result
+	}
+	if len(ids) > maxBulkItems {
+		*result = E(fmt.Sprintf("you can only change %d items at once", maxBulkItems))
+		return result
+	}
+	if action.Action == bulkMove && !canEdit(listRole(ctx, email, action.ListID)) {
+		*result = E("you can't add items to that list")
+		return result
+	}
+	var keys = make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = todoItemKey(ctx, id)
+	}
+	var maybeItems *MaybeError
+	if action.Action == bulkRestore || action.Action == bulkPurge {
+		maybeItems = readTodoItemsWithTrash(ctx, keys)
+	} else {
+		maybeItems = readTodoItems(ctx, keys)
+	}
+	switch (*maybeItems).(type) {
+	case Matches:
+	default:
+		return maybeItems
+	}
+	var bulk BulkResult
+	var found = make(map[int64]bool)
+	var editable Matches
+	for _, m := range (*maybeItems).(Matches) {
+		found[m.Key.IntID()] = true
+		if action.Action == bulkPurge && !m.Value.InTrash() {
+			// n.b. purging is for the trash only; live items get trashed first
+			bulk.Skipped = append(bulk.Skipped, m.Key.IntID())
+		} else if canEdit(itemRole(ctx, email, m.Value)) {
+			editable = append(editable, m)
+		} else {
+			bulk.Skipped = append(bulk.Skipped, m.Key.IntID())
+		}
+	}
+	for _, id := range ids {
+		if !found[id] {
+			bulk.Skipped = append(bulk.Skipped, id)
+		}
+	}
+	bulk.Changed = len(editable)
+	if len(editable) == 0 {
+		*result = bulk
+		return result
+	}
+	if action.Action == bulkPurge {
+		var deleteKeys = make([]*datastore.Key, len(editable))
+		for i, m := range editable {
+			deleteKeys[i] = m.Key
+		}
+		deleted := deleteTodoItems(ctx, deleteKeys)
+		switch (*deleted).(type) {
+		case Ok:
+			*result = bulk
+		default:
+			result = deleted
+		}
+		return result
+	}
+
+	var changedKeys []*datastore.Key
+	var after []TodoItem
+	now := time.Now()
+	for _, m := range editable {
+		changed := changeTodoItem(ctx, email, m.Key, anyVersion, func(item *TodoItem) {
+			action.apply(item, now)
+		})
+		switch (*changed).(type) {
+		case Change:
+			change := (*changed).(Change)
+			recordChanges(ctx, *m.Key, email, change.Before, change.After)
+			changedKeys = append(changedKeys, m.Key)
+			after = append(after, change.After)
+		default:
+			// most likely somebody purged it since we read it
+			log(fmt.Sprintf("bulkUpdate skipped %s: %v", m.Key, *changed))
+			bulk.Skipped = append(bulk.Skipped, m.Key.IntID())
+		}
+	}
+	bulk.Changed = len(changedKeys)
+	indexed := indexTodoItemsForSearch(ctx, changedKeys, after)
+	switch (*indexed).(type) {
+	case Ok:
+		*result = bulk
+	default:
+		result = indexed
+	}
+	return result
+}
+
+// The same as indexCommentForSearch for a bunch of items at once. Items in
+// the trash get taken out of the index instead, so searches don't find them.
+func indexTodoItemsForSearch(ctx context.Context, keys []*datastore.Key, items []TodoItem) *MaybeError {
+	var result = new(MaybeError)
+	index, err := search.Open("tada")
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var docIDs []string
+	var docs []interface{}
+	var trashed []*datastore.Key
+	for i, k := range keys {
+		if items[i].InTrash() {
+			trashed = append(trashed, k)
+		} else {
+			docIDs = append(docIDs, strconv.FormatInt(k.IntID(), 10))
+			docs = append(docs, &items[i])
+		}
+	}
+	for start := 0; start < len(docIDs); start += maxSearchBatch {
+		end := start + maxSearchBatch
+		if end > len(docIDs) {
+			end = len(docIDs)
+		}
+		if _, err := index.PutMulti(ctx, docIDs[start:end], docs[start:end]); err != nil {
+			*result = E(err.Error())
+			return result
+		}
+	}
+	return unindexTodoItems(ctx, trashed)
+}
+
+// Takes the items with keys keys out of the search index
+func unindexTodoItems(ctx context.Context, keys []*datastore.Key) *MaybeError {
+	var result = new(MaybeError)
+	index, err := search.Open("tada")
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var docIDs = make([]string, len(keys))
+	for i, k := range keys {
+		docIDs[i] = strconv.FormatInt(k.IntID(), 10)
+	}
+	for start := 0; start < len(docIDs); start += maxSearchBatch {
+		end := start + maxSearchBatch
+		if end > len(docIDs) {
+			end = len(docIDs)
+		}
+		if err := index.DeleteMulti(ctx, docIDs[start:end]); err != nil {
+			*result = E(err.Error())
+			return result
+		}
+	}
+	*result = Ok{}
+	return result
+}
+
+// Deletes the items with keys keys for good, along with their comments and
+// activity logs, and takes them out of the cache and the search index.
+// Reminders that are already queued notice the item's gone when they run.
+// CalDAV clients find out from the tombstones this leaves in their lists.
+func deleteTodoItems(ctx context.Context, keys []*datastore.Key) *MaybeError {
+	var result = new(MaybeError)
+	items := readTodoItemsWithTrash(ctx, keys)
+	switch (*items).(type) {
+	case Matches:
+	default:
+		return items
+	}
+	// n.b. before the delete, so if it fails the worst that can happen is
+	// a client forgetting about an item that's still in the trash
+	now := time.Now()
+	for _, m := range (*items).(Matches) {
+		if err := putDAVTombstone(ctx, m, now); err != nil {
+			*result = E(err.Error())
+			return result
+		}
+	}
+	var allKeys []*datastore.Key
+	for _, k := range keys {
+		// a kindless ancestor query gets the item itself too
+		children, err := datastore.NewQuery("").Ancestor(k).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			*result = E(err.Error())
+			return result
+		}
+		allKeys = append(allKeys, children...)
+	}
+	// items with a long history can have more children than one DeleteMulti
+	// can take
+	for start := 0; start < len(allKeys); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(allKeys) {
+			end = len(allKeys)
+		}
+		if err := datastore.DeleteMulti(ctx, allKeys[start:end]); err != nil {
+			log("deleteTodoItems error: " + err.Error())
+			*result = E(err.Error())
+			return result
+		}
+	}
+	for _, k := range keys {
+		// n.b. not just invalidateCache: a reader that got the item before
+		// the delete could put it back in the cache afterwards
+		markDeletedInCache(ctx, *k)
+	}
+	return unindexTodoItems(ctx, keys)
+}
+
+// Splits a comma-separated list of tags, dropping empty ones
+func parseTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// writes the form that goes with the checkboxes writeItems puts next to
+// each item. listID is the list being shown; lists is where things can move to.
+func writeBulkForm(w http.ResponseWriter, listID int64, lists TodoLists) {
+	fmt.Fprintf(w, ` <form id="bulk" action="/bulk" method="post">
+   <input hidden=true name="list" value="%d">
+   With the checked items:
+   <select name="action">
+     <option value="%s">Mark done</option>
+     <option value="%s">Reopen</option>
+     <option value="%s">Move to trash</option>
+     <option value="%s">Set tags to</option>
+     <option value="%s">Move to</option>
+     <option value="%s">Move due dates by</option>
+   </select>
+   <input name="tags" placeholder="tag, tag">
+   <select name="toList">
+`, listID, bulkComplete, bulkReopen, bulkDelete, bulkRetag, bulkMove, bulkShift)
+	for _, l := range lists {
+		fmt.Fprintf(w, `     <option value="%d">%s</option>
+`, l.Key.IntID(), template.HTMLEscapeString(l.Value.Name))
+	}
+	fmt.Fprint(w, `   </select>
+   <input type="number" name="days" value="1"> days
+   <input type="submit" value="Go">
+ </form>
+`)
+}
+
+// Expects "id" parameters (one per item), an "action" that's one of the bulk...
+// constants, and whichever of "tags", "toList" and "days" goes with the action.
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	r.ParseForm()
+	var ids []int64
+	for _, id := range r.Form["id"] {
+		itemID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			http.Error(w, id+" doesn't look like an item ID to me!", 400)
+			return
+		}
+		ids = append(ids, itemID)
+	}
+	action := BulkAction{Action: r.FormValue("action")}
+	switch action.Action {
+	case bulkRetag:
+		action.Tags = parseTags(r.FormValue("tags"))
+	case bulkMove:
+		listID, err := strconv.ParseInt(r.FormValue("toList"), 10, 64)
+		if err != nil {
+			http.Error(w, r.FormValue("toList")+" doesn't look like a list ID to me!", 400)
+			return
+		}
+		action.ListID = listID
+	case bulkShift:
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil {
+			http.Error(w, r.FormValue("days")+" doesn't look like a number of days to me!", 400)
+			return
+		}
+		action.Days = days
+	}
+	result := bulkUpdate(ctx, email, ids, action)
+	switch (*result).(type) {
+	case BulkResult:
+		bulk := (*result).(BulkResult)
+		if action.Action == bulkDelete && bulk.Changed > 0 {
+			var skipped = make(map[int64]bool)
+			for _, id := range bulk.Skipped {
+				skipped[id] = true
+			}
+			var trashed []int64
+			for _, id := range ids {
+				if !skipped[id] {
+					trashed = append(trashed, id)
+				}
+			}
+			listID, _ := strconv.ParseInt(r.FormValue("list"), 10, 64)
+			writeUndoBanner(w, trashed, listID)
+		} else {
+			fmt.Fprintf(w, "Changed %d items", bulk.Changed)
+		}
+		if len(bulk.Skipped) > 0 {
+			fmt.Fprintf(w, " (skipped %d you can't change)", len(bulk.Skipped))
+		}
+		rootHandler(w, r)
+	default:
+		respondWith(w, *result)
+	}
+}
@@ -0,0 +1,446 @@
+// +build !appengine
+package tada
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func init() {
+	http.HandleFunc("/admin/cacheStats", cacheStatsHandler)
+}
+
+// Somewhere to keep recently-used todo items (as JSON blobs) so we don't
+// have to go to the datastore for them. See lookupCache and friends in tada.go.
+type Cache interface {
+	// Returns errCacheMiss if key isn't there
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Returns whichever keys were there; missing ones aren't an error
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	// Doesn't do anything if the cache already has version or newer for key
+	Set(ctx context.Context, key string, value []byte, version int64) error
+	// Set for several keys at once
+	SetMulti(ctx context.Context, entries map[string]CacheEntry) error
+	// Returns errCacheMiss if key wasn't there
+	Delete(ctx context.Context, key string) error
+}
+
+// A value along with the version of whatever it's a copy of
+type CacheEntry struct {
+	Value   []byte
+	Version int64
+}
+
+var errCacheMiss = errors.New("cache miss")
+
+// Too many other writers got in the way of a compare-and-swap
+var errCacheContention = errors.New("cache contention")
+
+// How many times to retry a compare-and-swap before giving up
+const casAttempts = 3
+
+// Entries are stored as the version, as a varint, followed by the value
+func encodeCacheEntry(entry CacheEntry) []byte {
+	var buf = make([]byte, binary.MaxVarintLen64+len(entry.Value))
+	n := binary.PutVarint(buf, entry.Version)
+	return append(buf[:n], entry.Value...)
+}
+
+func decodeCacheEntry(b []byte) (CacheEntry, error) {
+	version, n := binary.Varint(b)
+	if n <= 0 {
+		return CacheEntry{}, errors.New("can't decode cache entry")
+	}
+	return CacheEntry{b[n:], version}, nil
+}
+
+// The cache everything uses. Which kind it is depends on the TADA_CACHE
+// environment variable: "memcache" (the default), "lru" for standalone
+// deployments without memcache, or "none".
+var itemCache = newCountingCache(cacheFromEnv())
+
+func cacheFromEnv() Cache {
+	switch os.Getenv("TADA_CACHE") {
+	case "lru":
+		size, err := strconv.Atoi(os.Getenv("TADA_CACHE_SIZE"))
+		if err != nil || size <= 0 {
+			size = 10000
+		}
+		ttl, err := time.ParseDuration(os.Getenv("TADA_CACHE_TTL"))
+		if err != nil || ttl <= 0 {
+			ttl = time.Hour
+		}
+		return newLRUCache(size, ttl)
+	case "none":
+		return noCache{}
+	default:
+		return memcacheCache{}
+	}
+}
+
+// App Engine's memcache
+type memcacheCache struct{}
+
+func (c memcacheCache) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry, err := decodeCacheEntry(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+func (c memcacheCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	var result = make(map[string][]byte, len(items))
+	for k, item := range items {
+		if entry, err := decodeCacheEntry(item.Value); err == nil {
+			result[k] = entry.Value
+		}
+	}
+	return result, nil
+}
+
+// Adds the entry if there's nothing there yet, otherwise replaces the old one
+// with CompareAndSwap so that nobody else's newer version can sneak in between
+// checking the version and writing ours
+func (c memcacheCache) Set(ctx context.Context, key string, value []byte, version int64) error {
+	for i := 0; i < casAttempts; i++ {
+		item, err := memcache.Get(ctx, key)
+		if err == memcache.ErrCacheMiss {
+			err = memcache.Add(ctx, &memcache.Item{Key: key, Value: encodeCacheEntry(CacheEntry{value, version})})
+			if err == memcache.ErrNotStored { // somebody else added it first; go look at theirs
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		// if we can't decode what's there, it's not worth keeping
+		if old, err := decodeCacheEntry(item.Value); err == nil && old.Version >= version {
+			return nil
+		}
+		item.Value = encodeCacheEntry(CacheEntry{value, version})
+		err = memcache.CompareAndSwap(ctx, item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
+	return errCacheContention
+}
+
+// Does the same as Set in one round of batch calls, then falls back to Set
+// for whichever entries lost a race
+func (c memcacheCache) SetMulti(ctx context.Context, entries map[string]CacheEntry) error {
+	var keys = make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	existing, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	var adds, swaps []*memcache.Item
+	for k, entry := range entries {
+		item, ok := existing[k]
+		if !ok {
+			adds = append(adds, &memcache.Item{Key: k, Value: encodeCacheEntry(entry)})
+			continue
+		}
+		if old, err := decodeCacheEntry(item.Value); err == nil && old.Version >= entry.Version {
+			continue
+		}
+		item.Value = encodeCacheEntry(entry)
+		swaps = append(swaps, item)
+	}
+	var retry []string
+	collect := func(items []*memcache.Item, err error) error {
+		if err == nil {
+			return nil
+		}
+		errs, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for i, e := range errs {
+			if e == memcache.ErrNotStored || e == memcache.ErrCASConflict {
+				retry = append(retry, items[i].Key)
+			} else if e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	if len(adds) > 0 {
+		if err := collect(adds, memcache.AddMulti(ctx, adds)); err != nil {
+			return err
+		}
+	}
+	if len(swaps) > 0 {
+		if err := collect(swaps, memcache.CompareAndSwapMulti(ctx, swaps)); err != nil {
+			return err
+		}
+	}
+	for _, k := range retry {
+		if err := c.Set(ctx, k, entries[k].Value, entries[k].Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c memcacheCache) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return errCacheMiss
+	}
+	return err
+}
+
+// A cache that never has anything in it, for tests and for turning caching off
+type noCache struct{}
+
+func (c noCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errCacheMiss
+}
+
+func (c noCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func (c noCache) Set(ctx context.Context, key string, value []byte, version int64) error {
+	return nil
+}
+
+func (c noCache) SetMulti(ctx context.Context, entries map[string]CacheEntry) error {
+	return nil
+}
+
+func (c noCache) Delete(ctx context.Context, key string) error {
+	return errCacheMiss
+}
+
+// An in-process cache that holds at most maxEntries entries, throwing out
+// the least recently used one to make room, and forgets entries after ttl.
+// n.b. every instance has its own, so this is only consistent with a single
+// instance -- which is what a standalone deployment is.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List // front is most recently used; values are *lruEntry
+	entries    map[string]*list.Element
+	now        func() time.Time // for testing
+}
+
+type lruEntry struct {
+	key     string
+	entry   CacheEntry
+	expires time.Time
+}
+
+func newLRUCache(maxEntries int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// n.b. the caller has to hold c.mu
+func (c *lruCache) get(key string) (*lruEntry, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if c.now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry, true
+}
+
+// n.b. the caller has to hold c.mu
+func (c *lruCache) set(key string, entry CacheEntry) {
+	expires := c.now().Add(c.ttl)
+	if old, ok := c.get(key); ok {
+		if old.entry.Version < entry.Version {
+			old.entry = entry
+			old.expires = expires
+		}
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, entry, expires})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.get(key); ok {
+		return e.entry.Value, nil
+	}
+	return nil, errCacheMiss
+}
+
+func (c *lruCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result = make(map[string][]byte)
+	for _, k := range keys {
+		if e, ok := c.get(k); ok {
+			result[k] = e.entry.Value
+		}
+	}
+	return result, nil
+}
+
+func (c *lruCache) Set(ctx context.Context, key string, value []byte, version int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, CacheEntry{value, version})
+	return nil
+}
+
+func (c *lruCache) SetMulti(ctx context.Context, entries map[string]CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range entries {
+		c.set(k, entry)
+	}
+	return nil
+}
+
+func (c *lruCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.get(key); !ok {
+		return errCacheMiss
+	}
+	c.order.Remove(c.entries[key])
+	delete(c.entries, key)
+	return nil
+}
+
+// How the cache has been doing since this instance started
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Errors int64 // anything that went wrong other than a miss
+}
+
+func (s CacheStats) isMaybeError() {}
+
+// Wraps another cache and counts hits, misses and errors
+type countingCache struct {
+	Cache
+	hits, misses, errors int64
+}
+
+func newCountingCache(c Cache) *countingCache {
+	return &countingCache{Cache: c}
+}
+
+func (c *countingCache) count(err error) {
+	switch err {
+	case nil:
+	case errCacheMiss:
+		atomic.AddInt64(&c.misses, 1)
+	default:
+		log("cache error: " + err.Error())
+		atomic.AddInt64(&c.errors, 1)
+	}
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.Cache.Get(ctx, key)
+	if err == nil {
+		atomic.AddInt64(&c.hits, 1)
+	}
+	c.count(err)
+	return value, err
+}
+
+func (c *countingCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	values, err := c.Cache.GetMulti(ctx, keys)
+	if err != nil {
+		c.count(err)
+		return values, err
+	}
+	atomic.AddInt64(&c.hits, int64(len(values)))
+	atomic.AddInt64(&c.misses, int64(len(keys)-len(values)))
+	return values, err
+}
+
+func (c *countingCache) Set(ctx context.Context, key string, value []byte, version int64) error {
+	err := c.Cache.Set(ctx, key, value, version)
+	c.count(err)
+	return err
+}
+
+func (c *countingCache) SetMulti(ctx context.Context, entries map[string]CacheEntry) error {
+	err := c.Cache.SetMulti(ctx, entries)
+	c.count(err)
+	return err
+}
+
+func (c *countingCache) Delete(ctx context.Context, key string) error {
+	err := c.Cache.Delete(ctx, key)
+	// deleting something that isn't there isn't a miss in the sense
+	// that matters for monitoring
+	if err != errCacheMiss {
+		c.count(err)
+	}
+	return err
+}
+
+func (c *countingCache) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Errors: atomic.LoadInt64(&c.errors),
+	}
+}
+
+// Shows the cache counters as JSON. Only admins can see this; see app.yaml.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	blob := cacheStatsToJson(itemCache.stats())
+	switch (*blob).(type) {
+	case Blob:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write((*blob).(Blob))
+	default:
+		respondWith(w, *blob)
+	}
+}
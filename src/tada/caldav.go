@@ -0,0 +1,645 @@
+// +build !appengine
+package tada
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// A CalDAV server, so phone task apps can sync with Tada. The layout is:
+//   /caldav/                  the user's principal and calendar home
+//   /caldav/{listID}/         one calendar collection per visible list
+//   /caldav/{listID}/{name}.ics  one VTODO per item
+// Clients that can't do Google logins authenticate with their API token;
+// see requestEmail.
+
+func init() {
+	http.HandleFunc("/caldav/", caldavHandler)
+	http.HandleFunc("/.well-known/caldav", wellKnownCalDAVHandler)
+}
+
+const caldavRoot = "/caldav/"
+
+// One <D:response> in a multistatus answer. props are already XML; if
+// status isn't 0 the response just says that instead of having props.
+type davResponse struct {
+	href   string
+	props  []string
+	status int
+}
+
+func writeMultiStatus(w http.ResponseWriter, responses []davResponse, syncToken string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">
+`)
+	for _, r := range responses {
+		fmt.Fprintf(w, "<D:response><D:href>%s</D:href>", xmlText(r.href))
+		if r.status != 0 {
+			fmt.Fprintf(w, "<D:status>HTTP/1.1 %d %s</D:status>", r.status, http.StatusText(r.status))
+		} else {
+			fmt.Fprint(w, "<D:propstat><D:prop>"+strings.Join(r.props, "")+"</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+		}
+		fmt.Fprint(w, "</D:response>\n")
+	}
+	if syncToken != "" {
+		fmt.Fprintf(w, "<D:sync-token>%s</D:sync-token>\n", xmlText(syncToken))
+	}
+	fmt.Fprint(w, "</D:multistatus>\n")
+}
+
+func xmlText(s string) string {
+	b := new(bytes.Buffer)
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+func collectionHref(listID int64) string {
+	return fmt.Sprintf("%s%d/", caldavRoot, listID)
+}
+
+// The name a client knows an item by: whatever it PUT it as, or its ID
+func davName(m Match) string {
+	if m.Value.DAVName != "" {
+		return m.Value.DAVName
+	}
+	return strconv.FormatInt(m.Key.IntID(), 10)
+}
+
+func itemHref(m Match) string {
+	return collectionHref(m.Value.ListID) + davName(m) + ".ics"
+}
+
+// Sync tokens are the newest UpdatedAt in the list, as a URI the way RFC 6578 wants.
+// An empty list's token is 0.
+// How far before a sync token's time syncCollection looks for changes, to
+// catch ones that were written or indexed late
+const davSyncSlack = time.Minute
+
+func syncToken(t time.Time) string {
+	if t.IsZero() {
+		return fmt.Sprintf("https://%s/sync/0", calendarDomain)
+	}
+	return fmt.Sprintf("https://%s/sync/%d", calendarDomain, t.UnixNano())
+}
+
+func parseSyncToken(token string) (time.Time, error) {
+	n, err := strconv.ParseInt(token[strings.LastIndex(token, "/")+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n), nil
+}
+
+// Returns when the newest change to anything in the list with ID listID was,
+// including things going in the trash and things leaving the list
+func listUpdatedAt(ctx context.Context, listID int64) (time.Time, error) {
+	var items []TodoItem
+	_, err := datastore.NewQuery("TodoItem").Filter("ListID=", listID).Order("-UpdatedAt").Limit(1).GetAll(ctx, &items)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var tombstones []DAVTombstone
+	_, err = datastore.NewQuery(davTombstoneKind).Ancestor(todoListKey(ctx, listID)).Order("-Removed").Limit(1).GetAll(ctx, &tombstones)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var updated time.Time
+	if len(items) > 0 {
+		updated = items[0].UpdatedAt
+	}
+	if len(tombstones) > 0 && tombstones[0].Removed.After(updated) {
+		updated = tombstones[0].Removed
+	}
+	return updated, nil
+}
+
+// Remembers that the item a client knew as DAVName left a list, by moving
+// to another one or being deleted for good, so syncCollection can tell
+// clients to get rid of it. Stored with the list as its parent.
+type DAVTombstone struct {
+	DAVName string
+	Removed time.Time
+}
+
+const davTombstoneKind = "DAVTombstone"
+
+// How long tombstones are kept. Clients with sync tokens older than
+// this have to start over, since they might have missed some.
+const davTombstoneRetention = 60 * 24 * time.Hour
+
+// Writes a tombstone for m, which is leaving the list it's in now. ctx can
+// be a transaction's, as long as it's a cross-group one.
+func putDAVTombstone(ctx context.Context, m Match, removed time.Time) error {
+	if m.Value.ListID == 0 {
+		// nobody could have synced it
+		return nil
+	}
+	k := datastore.NewIncompleteKey(ctx, davTombstoneKind, todoListKey(ctx, m.Value.ListID))
+	_, err := datastore.Put(ctx, k, &DAVTombstone{davName(m), removed})
+	return err
+}
+
+// Deletes the tombstones from before cutoff. Returns how many it deleted.
+func purgeDAVTombstones(ctx context.Context, cutoff time.Time) (int, error) {
+	keys, err := datastore.NewQuery(davTombstoneKind).Filter("Removed<", cutoff).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(keys); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return start, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Returns the item called name in the list with ID listID. name is either
+// what a client PUT it as or its ID.
+func findDAVItem(ctx context.Context, listID int64, name string) *MaybeError {
+	var result = new(MaybeError)
+	keys, err := datastore.NewQuery("TodoItem").Filter("ListID=", listID).Filter("DAVName=", name).KeysOnly().Limit(1).GetAll(ctx, nil)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	if len(keys) == 0 {
+		if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+			keys = []*datastore.Key{todoItemKey(ctx, id)}
+		}
+	}
+	if len(keys) == 0 {
+		*result = E("no such item")
+		return result
+	}
+	items := readTodoItems(ctx, keys)
+	switch (*items).(type) {
+	case Matches:
+		matches := (*items).(Matches)
+		if len(matches) == 1 && matches[0].Value.ListID == listID {
+			*result = matches[0]
+			return result
+		}
+		*result = E("no such item")
+	default:
+		return items
+	}
+	return result
+}
+
+func homeProps() []string {
+	return []string{
+		"<D:resourcetype><D:collection/></D:resourcetype>",
+		"<D:displayname>Tada</D:displayname>",
+		"<D:current-user-principal><D:href>" + caldavRoot + "</D:href></D:current-user-principal>",
+		"<D:principal-URL><D:href>" + caldavRoot + "</D:href></D:principal-URL>",
+		"<C:calendar-home-set><D:href>" + caldavRoot + "</D:href></C:calendar-home-set>",
+	}
+}
+
+func collectionProps(ctx context.Context, list TodoListMatch) []string {
+	updated, _ := listUpdatedAt(ctx, list.Key.IntID())
+	return []string{
+		"<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>",
+		"<D:displayname>" + xmlText(list.Value.Name) + "</D:displayname>",
+		`<C:supported-calendar-component-set><C:comp name="VTODO"/></C:supported-calendar-component-set>`,
+		"<CS:getctag>" + xmlText(syncToken(updated)) + "</CS:getctag>",
+		"<D:sync-token>" + xmlText(syncToken(updated)) + "</D:sync-token>",
+	}
+}
+
+func itemProps(m Match, withData bool) []string {
+	props := []string{
+		"<D:getetag>" + xmlText(itemETag(m.Value)) + "</D:getetag>",
+		`<D:getcontenttype>text/calendar; charset=utf-8; component=vtodo</D:getcontenttype>`,
+		"<D:resourcetype/>",
+	}
+	if withData {
+		b := new(bytes.Buffer)
+		writeICal(b, Matches{m}, time.Now(), true)
+		props = append(props, "<C:calendar-data>"+xmlText(b.String())+"</C:calendar-data>")
+	}
+	return props
+}
+
+// Sends people who ask the well-known URL (RFC 6764) to the right place
+func wellKnownCalDAVHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, caldavRoot, http.StatusMovedPermanently)
+}
+
+func caldavHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	w.Header().Set("DAV", "1, 3, calendar-access")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		return
+	}
+	email := requestEmail(ctx, r)
+	if email == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Tada (use your API token as the password)"`)
+		http.Error(w, "Sign in with your email address and API token", http.StatusUnauthorized)
+		return
+	}
+	u := &user.User{Email: email}
+	rest := strings.TrimPrefix(r.URL.Path, caldavRoot)
+	if rest == "" {
+		if r.Method != "PROPFIND" {
+			http.Error(w, "The calendar home only does PROPFIND", http.StatusMethodNotAllowed)
+			return
+		}
+		propfindHome(w, r, ctx, u)
+		return
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	listID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "There's no calendar here", http.StatusNotFound)
+		return
+	}
+	role := listRole(ctx, email, listID)
+	if !canView(role) {
+		http.Error(w, "There's no calendar here", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		switch r.Method {
+		case "PROPFIND":
+			propfindCollection(w, r, ctx, u, listID)
+		case "REPORT":
+			reportCollection(w, r, ctx, u, listID)
+		default:
+			http.Error(w, r.Method+" isn't something you can do to a calendar", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	name := strings.TrimSuffix(parts[1], ".ics")
+	switch r.Method {
+	case "GET", "HEAD":
+		getDAVItem(w, r, ctx, listID, name)
+	case "PROPFIND":
+		found := findDAVItem(ctx, listID, name)
+		switch (*found).(type) {
+		case Match:
+			m := (*found).(Match)
+			writeMultiStatus(w, []davResponse{{itemHref(m), itemProps(m, false), 0}}, "")
+		default:
+			http.Error(w, "There's no item here", http.StatusNotFound)
+		}
+	case "PUT":
+		if !canEdit(role) {
+			http.Error(w, "You can't change things in that list", http.StatusForbidden)
+			return
+		}
+		putDAVItem(w, r, ctx, u, listID, name)
+	case "DELETE":
+		if !canEdit(role) {
+			http.Error(w, "You can't change things in that list", http.StatusForbidden)
+			return
+		}
+		deleteDAVItem(w, r, ctx, u, listID, name)
+	default:
+		http.Error(w, r.Method+" isn't something you can do to an item", http.StatusMethodNotAllowed)
+	}
+}
+
+// Depth 0 is just the home; depth 1 adds a calendar for each list
+func propfindHome(w http.ResponseWriter, r *http.Request, ctx context.Context, u *user.User) {
+	responses := []davResponse{{caldavRoot, homeProps(), 0}}
+	if r.Header.Get("Depth") != "0" {
+		lists := visibleTodoLists(ctx, u)
+		switch (*lists).(type) {
+		case TodoLists:
+			for _, l := range (*lists).(TodoLists) {
+				responses = append(responses, davResponse{collectionHref(l.Key.IntID()), collectionProps(ctx, l), 0})
+			}
+		default:
+			respondWith(w, *lists)
+			return
+		}
+	}
+	writeMultiStatus(w, responses, "")
+}
+
+// Depth 0 is just the calendar; depth 1 adds its items
+func propfindCollection(w http.ResponseWriter, r *http.Request, ctx context.Context, u *user.User, listID int64) {
+	list := readTodoList(ctx, listID)
+	switch (*list).(type) {
+	case TodoList:
+	default:
+		http.Error(w, "There's no calendar here", http.StatusNotFound)
+		return
+	}
+	k := todoListKey(ctx, listID)
+	responses := []davResponse{{collectionHref(listID), collectionProps(ctx, TodoListMatch{k, (*list).(TodoList)}), 0}}
+	if r.Header.Get("Depth") != "0" {
+		items := listTodoItemsInList(ctx, u, listID)
+		switch (*items).(type) {
+		case Matches:
+			for _, m := range (*items).(Matches) {
+				responses = append(responses, davResponse{itemHref(m), itemProps(m, false), 0})
+			}
+		default:
+			respondWith(w, *items)
+			return
+		}
+	}
+	writeMultiStatus(w, responses, "")
+}
+
+// What we care about in a REPORT body, whichever report it is
+type davReport struct {
+	XMLName   xml.Name
+	Hrefs     []string `xml:"DAV: href"`
+	SyncToken string   `xml:"DAV: sync-token"`
+}
+
+// Handles calendar-query (everything in the list), calendar-multiget (the
+// items in the hrefs) and sync-collection (what changed since the sync token)
+func reportCollection(w http.ResponseWriter, r *http.Request, ctx context.Context, u *user.User, listID int64) {
+	body, err := ioutil.ReadAll(r.Body)
+	if handleError(w, err) {
+		return
+	}
+	var report davReport
+	if err := xml.Unmarshal(body, &report); err != nil {
+		http.Error(w, "That doesn't look like a REPORT to me: "+err.Error(), 400)
+		return
+	}
+	withData := bytes.Contains(body, []byte("calendar-data"))
+	var responses []davResponse
+	switch report.XMLName.Local {
+	case "calendar-query":
+		// everything here is a VTODO, so a query for anything else finds nothing
+		if bytes.Contains(body, []byte(`"VEVENT"`)) && !bytes.Contains(body, []byte(`"VTODO"`)) {
+			writeMultiStatus(w, nil, "")
+			return
+		}
+		items := listTodoItemsInList(ctx, u, listID)
+		switch (*items).(type) {
+		case Matches:
+			for _, m := range (*items).(Matches) {
+				responses = append(responses, davResponse{itemHref(m), itemProps(m, withData), 0})
+			}
+		default:
+			respondWith(w, *items)
+			return
+		}
+		writeMultiStatus(w, responses, "")
+	case "calendar-multiget":
+		for _, href := range report.Hrefs {
+			name := strings.TrimSuffix(href[strings.LastIndex(href, "/")+1:], ".ics")
+			found := findDAVItem(ctx, listID, name)
+			switch (*found).(type) {
+			case Match:
+				m := (*found).(Match)
+				responses = append(responses, davResponse{href, itemProps(m, withData), 0})
+			default:
+				responses = append(responses, davResponse{href, nil, http.StatusNotFound})
+			}
+		}
+		writeMultiStatus(w, responses, "")
+	case "sync-collection":
+		syncCollection(w, ctx, u, listID, report.SyncToken, withData)
+	default:
+		http.Error(w, report.XMLName.Local+" isn't a report we know how to do", http.StatusForbidden)
+	}
+}
+
+// With no token, that's everything in the list. Otherwise it's whatever
+// changed since, with things that went in the trash, moved to another list
+// or were deleted for good as 404s.
+func syncCollection(w http.ResponseWriter, ctx context.Context, u *user.User, listID int64, token string, withData bool) {
+	// n.b. get the new token before looking at the changes, so anything that
+	// changes in between gets sent again next time rather than missed
+	updated, err := listUpdatedAt(ctx, listID)
+	if handleError(w, err) {
+		return
+	}
+	var responses []davResponse
+	if token == "" {
+		items := listTodoItemsInList(ctx, u, listID)
+		switch (*items).(type) {
+		case Matches:
+			for _, m := range (*items).(Matches) {
+				responses = append(responses, davResponse{itemHref(m), itemProps(m, withData), 0})
+			}
+		default:
+			respondWith(w, *items)
+			return
+		}
+		writeMultiStatus(w, responses, syncToken(updated))
+		return
+	}
+	since, err := parseSyncToken(token)
+	// the tombstones from before the cutoff might be gone. n.b. that doesn't
+	// matter for an empty list's token: the client didn't have anything to remove
+	expired := since.After(time.Unix(0, 0)) && since.Before(time.Now().Add(-davTombstoneRetention))
+	if err != nil || expired {
+		// RFC 6578 says to say it like this, and the client starts over
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:valid-sync-token/></D:error>`)
+		return
+	}
+	// n.b. a change can be stamped with a time before it commits, and the
+	// queries below are only eventually consistent, so look back a bit past
+	// the token. Sending something again that the client already has is fine.
+	after := since.Add(-davSyncSlack)
+	keys, err := datastore.NewQuery("TodoItem").Filter("ListID=", listID).Filter("UpdatedAt>", after).KeysOnly().GetAll(ctx, nil)
+	if handleError(w, err) {
+		return
+	}
+	items := readTodoItemsWithTrash(ctx, keys)
+	var mentioned = make(map[string]bool)
+	switch (*items).(type) {
+	case Matches:
+		for _, m := range (*items).(Matches) {
+			mentioned[itemHref(m)] = true
+			if m.Value.InTrash() {
+				responses = append(responses, davResponse{itemHref(m), nil, http.StatusNotFound})
+			} else {
+				responses = append(responses, davResponse{itemHref(m), itemProps(m, withData), 0})
+			}
+		}
+	default:
+		respondWith(w, *items)
+		return
+	}
+	var tombstones []DAVTombstone
+	_, err = datastore.NewQuery(davTombstoneKind).Ancestor(todoListKey(ctx, listID)).Filter("Removed>", after).GetAll(ctx, &tombstones)
+	if handleError(w, err) {
+		return
+	}
+	for _, t := range tombstones {
+		href := collectionHref(listID) + t.DAVName + ".ics"
+		// it might have come back since it left
+		if !mentioned[href] {
+			mentioned[href] = true
+			responses = append(responses, davResponse{href, nil, http.StatusNotFound})
+		}
+	}
+	if updated.Before(since) {
+		updated = since
+	}
+	writeMultiStatus(w, responses, syncToken(updated))
+}
+
+func getDAVItem(w http.ResponseWriter, r *http.Request, ctx context.Context, listID int64, name string) {
+	found := findDAVItem(ctx, listID, name)
+	switch (*found).(type) {
+	case Match:
+		m := (*found).(Match)
+		w.Header().Set("ETag", itemETag(m.Value))
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		if r.Method == "GET" {
+			writeICal(w, Matches{m}, time.Now(), true)
+		}
+	default:
+		http.Error(w, "There's no item here", http.StatusNotFound)
+	}
+}
+
+// Creates or changes the item called name from the VTODO in the body.
+// If-Match and If-None-Match work the way RFC 4791 says.
+func putDAVItem(w http.ResponseWriter, r *http.Request, ctx context.Context, u *user.User, listID int64, name string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if handleError(w, err) {
+		return
+	}
+	parsed := parseVTODO(string(body))
+	switch (*parsed).(type) {
+	case ICalTodo:
+	default:
+		http.Error(w, "That doesn't look like a VTODO to me", http.StatusUnsupportedMediaType)
+		return
+	}
+	todo := (*parsed).(ICalTodo)
+	patch := ItemPatch{Description: todo.Description, DueDate: todo.DueDate, State: todo.State, Notes: todo.Notes, Tags: &todo.Tags}
+	found := findDAVItem(ctx, listID, name)
+	switch (*found).(type) {
+	case Match:
+		if r.Header.Get("If-None-Match") == "*" {
+			http.Error(w, "There's already an item here", http.StatusPreconditionFailed)
+			return
+		}
+		m := (*found).(Match)
+		version, err := versionFromRequest(r)
+		if err != nil {
+			http.Error(w, "That doesn't look like an ETag to me!", 400)
+			return
+		}
+		// PUT replaces the whole thing, so a VTODO without notes clears them
+		if patch.Notes == nil {
+			patch.Notes = new(string)
+		}
+		result := patchTodoItem(ctx, u.Email, m.Key.IntID(), patch, version)
+		switch (*result).(type) {
+		case Ok:
+			writeDAVItemETag(w, ctx, m.Key, http.StatusNoContent)
+		case Conflict:
+			http.Error(w, errConflict.Error(), http.StatusPreconditionFailed)
+		default:
+			respondWith(w, *result)
+		}
+		return
+	}
+	if r.Header.Get("If-Match") != "" {
+		http.Error(w, "There's no item here", http.StatusPreconditionFailed)
+		return
+	}
+	item := TodoItem{
+		DueDate: startOfDay(time.Now()),
+		State:   "incomplete",
+		ListID:  listID,
+		Tags:    todo.Tags,
+		ICalUID: todo.UID,
+		DAVName: name,
+	}
+	if todo.Description != nil {
+		item.Description = *todo.Description
+	}
+	if todo.DueDate != nil {
+		item.DueDate = *todo.DueDate
+	}
+	if todo.State != nil {
+		item.State = *todo.State
+	}
+	if todo.Notes != nil {
+		item.Notes = *todo.Notes
+	}
+	id := writeNewTodoItem(ctx, item, u, true)
+	switch (*id).(type) {
+	case TodoID:
+		k := datastore.Key((*id).(TodoID))
+		writeDAVItemETag(w, ctx, &k, http.StatusCreated)
+	default:
+		respondWith(w, *id)
+	}
+}
+
+func writeDAVItemETag(w http.ResponseWriter, ctx context.Context, k *datastore.Key, status int) {
+	item := readTodoItem(ctx, TodoID(*k))
+	switch (*item).(type) {
+	case TodoItem:
+		w.Header().Set("ETag", itemETag((*item).(TodoItem)))
+	}
+	w.WriteHeader(status)
+}
+
+// Moves the item called name to the trash, so it can still be restored
+// from the web if the phone app deleted it by mistake. The If-Match check
+// and the move happen in the same transaction.
+func deleteDAVItem(w http.ResponseWriter, r *http.Request, ctx context.Context, u *user.User, listID int64, name string) {
+	found := findDAVItem(ctx, listID, name)
+	switch (*found).(type) {
+	case Match:
+	default:
+		http.Error(w, "There's no item here", http.StatusNotFound)
+		return
+	}
+	m := (*found).(Match)
+	version, err := versionFromRequest(r)
+	if err != nil {
+		http.Error(w, "That doesn't look like an ETag to me!", 400)
+		return
+	}
+	if !canEdit(itemRole(ctx, u.Email, m.Value)) {
+		http.Error(w, "You can't delete that item", http.StatusForbidden)
+		return
+	}
+	changed := changeTodoItem(ctx, u.Email, m.Key, version, func(item *TodoItem) {
+		item.DeletedAt = time.Now()
+	})
+	switch (*changed).(type) {
+	case Change:
+		change := (*changed).(Change)
+		recordChanges(ctx, *m.Key, u.Email, change.Before, change.After)
+		// this takes it out of the search index, since it's in the trash
+		indexed := indexTodoItemsForSearch(ctx, []*datastore.Key{m.Key}, []TodoItem{change.After})
+		switch (*indexed).(type) {
+		case Ok:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			respondWith(w, *indexed)
+		}
+	case Conflict:
+		http.Error(w, errConflict.Error(), http.StatusPreconditionFailed)
+	default:
+		respondWith(w, *changed)
+	}
+}
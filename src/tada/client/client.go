@@ -0,0 +1,338 @@
+// +build !appengine
+
+// Package client talks to a Tada server's JSON API, with an API token from
+// the server's /apiToken page instead of a Google login. The tada command
+// (see cmd/tada) uses it, and so can anything else.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fields of a todo item, the way the server sends them. n.b. a copy of
+// the server's TodoItem, minus the ones only the server cares about; this
+// package doesn't import the server so it can be built without App Engine.
+type TodoItem struct {
+	OwnerEmail  string
+	Description string
+	DueDate     time.Time
+	State       string // "completed" or "incomplete"
+	ListID      int64
+	Assignee    string
+	Notes       string
+	Created     time.Time
+	Version     int64
+	UpdatedAt   time.Time
+	Tags        []string
+	Priority    string
+}
+
+// Items due at midnight UTC are due some time that day rather than at a
+// particular time, the same as on the server
+func (item TodoItem) Timed() bool {
+	d := item.DueDate.UTC()
+	return d.Hour() != 0 || d.Minute() != 0 || d.Second() != 0
+}
+
+func (item TodoItem) Completed() bool {
+	return item.State == "completed"
+}
+
+// An item and its ID, which is what goes in the /todo/{id} URL
+type Item struct {
+	ID   int64
+	Item TodoItem
+}
+
+type TodoList struct {
+	OwnerEmail string
+	Name       string
+	Color      string
+	Archived   bool
+	SortOrder  int64
+}
+
+type List struct {
+	ID   int64
+	List TodoList
+}
+
+// A new item for Add. Only Description has to be set; the server makes it
+// due today if DueDate is "", and puts it in the Inbox if ListID is 0.
+type NewItem struct {
+	Description string
+	DueDate     string   `json:",omitempty"` // YYYY-MM-DD, or RFC 3339 for a particular time
+	ListID      int64    `json:",omitempty"`
+	Notes       string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+}
+
+// A change to an item for Patch. nil fields stay the way they are.
+type Patch struct {
+	Description *string   `json:",omitempty"`
+	DueDate     *string   `json:",omitempty"` // like NewItem's
+	State       *string   `json:",omitempty"`
+	Notes       *string   `json:",omitempty"`
+	Tags        *[]string `json:",omitempty"`
+}
+
+// Which items Items returns. The zero value is everything the user can see,
+// in due date order.
+type Query struct {
+	ListID        int64
+	AssignedToMe  bool
+	HideCompleted bool
+	Due           string // "", "overdue", "today" or "week"
+	From, To      string // YYYY-MM-DD, both inclusive; either one sets Due to "range"
+	Sort          string // "", "due", "created" or "description"
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	if q.ListID != 0 {
+		v.Set("list", strconv.FormatInt(q.ListID, 10))
+	}
+	if q.AssignedToMe {
+		v.Set("view", "assigned")
+	}
+	if q.HideCompleted {
+		v.Set("show", "incomplete")
+	}
+	if q.Due != "" {
+		v.Set("due", q.Due)
+	}
+	if q.From != "" || q.To != "" {
+		v.Set("due", "range")
+		if q.From != "" {
+			v.Set("from", q.From)
+		}
+		if q.To != "" {
+			v.Set("to", q.To)
+		}
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	return v
+}
+
+// What the server said when it didn't like a request
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+// Patch returns this when somebody else changed the item since the version
+// it was given. Current is the item as it is now.
+type ConflictError struct {
+	Current TodoItem
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("somebody else changed that item (it's at version %d now)", e.Current.Version)
+}
+
+var ErrNoToken = errors.New("no API token: get one from your server's /apiToken page and run tada config")
+
+// Where the server is and who to be there
+type Config struct {
+	Server string // e.g. https://tada-1202.appspot.com
+	Token  string
+}
+
+// ~/.config/tada/config.json, or under $XDG_CONFIG_HOME if that's set
+func DefaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "tada", "config.json")
+}
+
+// Reads the config at path, if there is one, and then lets TADA_SERVER and
+// TADA_TOKEN override it
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return c, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &c); err != nil {
+			return c, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	if s := os.Getenv("TADA_SERVER"); s != "" {
+		c.Server = s
+	}
+	if s := os.Getenv("TADA_TOKEN"); s != "" {
+		c.Token = s
+	}
+	return c, nil
+}
+
+// Writes c to path, readable only by its owner since the token's in it
+func SaveConfig(path string, c Config) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+type Client struct {
+	Config
+	HTTP *http.Client
+}
+
+func New(c Config) *Client {
+	return &Client{c, &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Sends a request with the token and decodes the JSON that comes back into
+// out (unless it's nil). ifMatch is the item version a change is based on,
+// or 0 for whatever the item's at.
+func (c *Client) do(method string, path string, body interface{}, ifMatch int64, out interface{}) error {
+	if c.Token == "" {
+		return ErrNoToken
+	}
+	if c.Server == "" {
+		return errors.New("which server? run tada config --server")
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Server, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ifMatch != 0 {
+		req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, ifMatch))
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		var conflict ConflictError
+		if err := json.Unmarshal(b, &conflict.Current); err != nil {
+			return &Error{resp.StatusCode, strings.TrimSpace(string(b))}
+		}
+		return &conflict
+	case resp.StatusCode >= 300:
+		return &Error{resp.StatusCode, strings.TrimSpace(string(b))}
+	case out == nil:
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("the server sent something that isn't what I expected: %s", err.Error())
+	}
+	return nil
+}
+
+// Items matching q, all of them at once
+func (c *Client) Items(q Query) ([]Item, error) {
+	var page struct {
+		Items []Item
+	}
+	err := c.do("GET", "/items?"+q.values().Encode(), nil, 0, &page)
+	return page.Items, err
+}
+
+// The item with ID id
+func (c *Client) Item(id int64) (Item, error) {
+	var item Item
+	err := c.do("GET", fmt.Sprintf("/todo/%d", id), nil, 0, &item)
+	return item, err
+}
+
+func (c *Client) Add(n NewItem) (Item, error) {
+	var item Item
+	err := c.do("POST", "/items", n, 0, &item)
+	return item, err
+}
+
+// Changes the item with ID id. version is the version the change is based
+// on, so nobody else's change gets clobbered, or 0 to change it whatever
+// it's at (n.b. then there's no way to tell if anybody else changed it).
+func (c *Client) Patch(id int64, p Patch, version int64) (Item, error) {
+	var item Item
+	err := c.do("PATCH", fmt.Sprintf("/todo/%d", id), p, version, &item)
+	return item, err
+}
+
+// Marks the item with ID id completed, or incomplete if done is false
+func (c *Client) SetDone(id int64, done bool) (Item, error) {
+	state := "incomplete"
+	if done {
+		state = "completed"
+	}
+	return c.Patch(id, Patch{State: &state}, 0)
+}
+
+// Items whose descriptions match query, going through all the pages of
+// results
+func (c *Client) Search(query string) ([]Item, error) {
+	var items []Item
+	next := ""
+	for {
+		v := url.Values{"q": {query}}
+		if next != "" {
+			v.Set("next", next)
+		}
+		var page struct {
+			Items []Item
+			Next  string
+		}
+		if err := c.do("GET", "/search?"+v.Encode(), nil, 0, &page); err != nil {
+			return items, err
+		}
+		items = append(items, page.Items...)
+		if page.Next == "" {
+			return items, nil
+		}
+		next = page.Next
+	}
+}
+
+// The user's lists and the ones shared with them
+func (c *Client) Lists() ([]List, error) {
+	var lists []List
+	err := c.do("GET", "/lists", nil, 0, &lists)
+	return lists, err
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A pretend server with one item, 7, at version 3
+func testServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Sign in, or send your API token", http.StatusUnauthorized)
+			return
+		}
+		item := Item{7, TodoItem{Description: "buy milk", State: "incomplete", Version: 3}}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /items":
+			if r.URL.RawQuery != "due=overdue&list=5&show=incomplete" {
+				t.Errorf("wrong query: %s", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(struct{ Items []Item }{[]Item{item}})
+		case "POST /items":
+			var n NewItem
+			json.NewDecoder(r.Body).Decode(&n)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(Item{8, TodoItem{Description: n.Description}})
+		case "PATCH /todo/7":
+			if m := r.Header.Get("If-Match"); m != "" && m != `"3"` {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(item.Item)
+				return
+			}
+			var p map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&p)
+			if len(p) != 1 || p["State"] != "completed" {
+				t.Errorf("wrong patch: %v", p)
+			}
+			item.Item.State = "completed"
+			json.NewEncoder(w).Encode(item)
+		case "GET /search":
+			// two pages
+			if r.FormValue("next") == "" {
+				json.NewEncoder(w).Encode(struct {
+					Items []Item
+					Next  string
+				}{[]Item{item}, "more"})
+			} else {
+				json.NewEncoder(w).Encode(struct{ Items []Item }{[]Item{{9, TodoItem{}}}})
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestClient(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+	c := New(Config{server.URL, "secret"})
+
+	items, err := c.Items(Query{ListID: 5, HideCompleted: true, Due: "overdue"})
+	if err != nil || len(items) != 1 || items[0].ID != 7 {
+		t.Errorf("Items: %v %v", items, err)
+	}
+	added, err := c.Add(NewItem{Description: "call mum"})
+	if err != nil || added.ID != 8 || added.Item.Description != "call mum" {
+		t.Errorf("Add: %v %v", added, err)
+	}
+	done, err := c.SetDone(7, true)
+	if err != nil || !done.Item.Completed() {
+		t.Errorf("SetDone: %v %v", done, err)
+	}
+	state := "completed"
+	_, err = c.Patch(7, Patch{State: &state}, 2)
+	if conflict, ok := err.(*ConflictError); !ok || conflict.Current.Version != 3 {
+		t.Errorf("Patch of an old version: %v", err)
+	}
+	found, err := c.Search("milk")
+	if err != nil || len(found) != 2 || found[1].ID != 9 {
+		t.Errorf("Search: %v %v", found, err)
+	}
+	_, err = c.Item(100)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusNotFound {
+		t.Errorf("Item that isn't there: %v", err)
+	}
+
+	c.Token = "wrong"
+	if _, err := c.Lists(); err == nil {
+		t.Errorf("the wrong token worked")
+	}
+	c.Token = ""
+	if _, err := c.Lists(); err != ErrNoToken {
+		t.Errorf("no token: %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tada", "config.json")
+	os.Setenv("TADA_TOKEN", "")
+	os.Setenv("TADA_SERVER", "")
+	if c, err := LoadConfig(path); err != nil || c != (Config{}) {
+		t.Errorf("no config file: %v %v", c, err)
+	}
+	if err := SaveConfig(path, Config{"https://example.com", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("anybody can read the token: %v %v", info.Mode(), err)
+	}
+	os.Setenv("TADA_TOKEN", "other")
+	defer os.Setenv("TADA_TOKEN", "")
+	if c, err := LoadConfig(path); err != nil || c != (Config{"https://example.com", "other"}) {
+		t.Errorf("TADA_TOKEN should win: %v %v", c, err)
+	}
+}
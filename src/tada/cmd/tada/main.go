@@ -0,0 +1,748 @@
+// +build !appengine
+
+// Command tada is a command-line client for a Tada server:
+//
+//	tada config --server https://tada-1202.appspot.com --token <API token>
+//	tada add "buy milk" --due tomorrow
+//	tada ls --overdue
+//	tada done 1234
+//
+// See "tada help" for the rest. It talks to the server's JSON API with the
+// API token from the server's /apiToken page; see package tada/client.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"tada/client"
+)
+
+// Something to do, like "add" or "ls". flags are the command's own; every
+// command also gets the global ones (see newFlags).
+type command struct {
+	name    string
+	args    string // what goes after the flags, for the help
+	summary string
+	flags   func(fs *flag.FlagSet) func(c *cli, args []string) error
+}
+
+var commands []command
+
+func init() {
+	// n.b. in init so the commands can refer to the list, for help and
+	// completion
+	commands = []command{
+		{"add", "TEXT...", "add an item", addFlags},
+		{"ls", "", "list items (the incomplete ones, unless --all)", lsFlags},
+		{"done", "ID...", "mark items completed", doneFlags},
+		{"search", "QUERY...", "find items by description", searchFlags},
+		{"show", "ID", "show an item with its notes", showFlags},
+		{"edit", "ID", "change an item (in $EDITOR, without flags)", editFlags},
+		{"lists", "", "list your lists and their IDs", listsFlags},
+		{"ui", "", "browse and change items interactively", uiFlags},
+		{"config", "", "set the server and API token (or show them)", configFlags},
+		{"completion", "bash|zsh|fish", "print a shell completion script", completionFlags},
+		{"help", "", "print this", helpFlags},
+	}
+}
+
+// What every command can get at
+type cli struct {
+	out        io.Writer
+	client     *client.Client
+	configPath string
+	config     client.Config
+	json       bool
+	now        time.Time
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, time.Now()))
+}
+
+// Runs the command in args and returns the exit status: 1 if the command
+// failed, 2 if it was never going to work
+func run(args []string, out io.Writer, errOut io.Writer, now time.Time) int {
+	if len(args) == 0 {
+		writeUsage(errOut)
+		return 2
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(errOut, "tada: there's no %q command\n", args[0])
+		writeUsage(errOut)
+		return 2
+	}
+	c := &cli{out: out, now: now}
+	fs := newFlags(cmd.name, c)
+	fs.SetOutput(errOut)
+	action := cmd.flags(fs)
+	positional, err := parseArgs(fs, args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		// the flag package has already said what was wrong
+		return 2
+	}
+	config, err := client.LoadConfig(c.configPath)
+	if err != nil {
+		fmt.Fprintf(errOut, "tada: %s\n", err.Error())
+		return 1
+	}
+	// flags beat the config file
+	if c.config.Server != "" {
+		config.Server = c.config.Server
+	}
+	if c.config.Token != "" {
+		config.Token = c.config.Token
+	}
+	c.config = config
+	c.client = client.New(config)
+	if err := action(c, positional); err != nil {
+		fmt.Fprintf(errOut, "tada: %s\n", err.Error())
+		if _, ok := err.(usageError); ok {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func newFlags(name string, c *cli) *flag.FlagSet {
+	fs := flag.NewFlagSet("tada "+name, flag.ContinueOnError)
+	fs.StringVar(&c.config.Server, "server", "", "the Tada server's URL (instead of the one in the config)")
+	fs.StringVar(&c.config.Token, "token", "", "your API token (instead of the one in the config)")
+	fs.StringVar(&c.configPath, "config", client.DefaultConfigPath(), "where the config file is")
+	fs.BoolVar(&c.json, "json", false, "print JSON instead of a table")
+	return fs
+}
+
+// The same as fs.Parse, but flags can come after the other arguments too,
+// like tada add "buy milk" --due tomorrow. Returns the other arguments.
+// Everything after "--" is one of them, flag or not.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func writeUsage(w io.Writer) {
+	fmt.Fprint(w, "usage: tada COMMAND [flags] [args]\n\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprint(w, `
+Every command takes --server, --token, --config and --json; "tada COMMAND -h"
+says what else it takes. TADA_SERVER and TADA_TOKEN override the config file.
+`)
+}
+
+// Dates can be YYYY-MM-DD, "YYYY-MM-DD HH:MM" (local time), today, tomorrow,
+// a day of the week (the next one), or +N days or weeks from today, like
+// +3d or +2w. Returns it the way the server wants it.
+func parseDate(s string, now time.Time) (string, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if d, err := time.Parse("2006-01-02", s); err == nil {
+		return d.Format("2006-01-02"), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04"} {
+		if d, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return d.Format(time.RFC3339), nil
+		}
+	}
+	lower := strings.ToLower(s)
+	switch lower {
+	case "today":
+		return today.Format("2006-01-02"), nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1).Format("2006-01-02"), nil
+	}
+	if m := relativeDate.FindStringSubmatch(lower); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if m[2] == "w" {
+			n *= 7
+		}
+		return today.AddDate(0, 0, n).Format("2006-01-02"), nil
+	}
+	if len(lower) >= 3 {
+		for i := 1; i <= 7; i++ {
+			d := today.AddDate(0, 0, i)
+			if strings.HasPrefix(strings.ToLower(d.Weekday().String()), lower) {
+				return d.Format("2006-01-02"), nil
+			}
+		}
+	}
+	return "", usageError(s + " doesn't look like a date to me")
+}
+
+var relativeDate = regexp.MustCompile(`^\+(\d+)([dw])$`)
+
+func parseID(s string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 10, 64)
+	if err != nil {
+		return 0, usageError(s + " doesn't look like an item ID to me")
+	}
+	return id, nil
+}
+
+// "a, b,c" -> [a b c]
+func splitTags(s string) []string {
+	var tags = []string{}
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "#"); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// Lets a flag be given more than once, e.g. --tag a --tag b
+type stringsFlag []string
+
+func (f *stringsFlag) String() string     { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(s string) error { *f = append(*f, splitTags(s)...); return nil }
+
+func formatDue(item client.TodoItem) string {
+	if item.Timed() {
+		return item.DueDate.Local().Format("2006-01-02 15:04")
+	}
+	return item.DueDate.UTC().Format("2006-01-02")
+}
+
+func overdue(item client.TodoItem, now time.Time) bool {
+	if item.Completed() {
+		return false
+	}
+	if item.Timed() {
+		return item.DueDate.Before(now)
+	}
+	return item.DueDate.UTC().Format("2006-01-02") < now.Format("2006-01-02")
+}
+
+// What the item looks like in a table: priority, description and tags
+func itemText(item client.TodoItem) string {
+	s := item.Description
+	if item.Priority != "" {
+		s = "(" + item.Priority + ") " + s
+	}
+	for _, t := range item.Tags {
+		s += " #" + t
+	}
+	return s
+}
+
+func (c *cli) writeJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\n", b)
+	return err
+}
+
+// Writes items as a table, or as JSON with --json
+func (c *cli) writeItems(items []client.Item) error {
+	if c.json {
+		if items == nil {
+			items = []client.Item{}
+		}
+		return c.writeJSON(items)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDUE\t\tDESCRIPTION")
+	for _, item := range items {
+		status := ""
+		if item.Item.Completed() {
+			status = "done"
+		} else if overdue(item.Item, c.now) {
+			status = "overdue"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", item.ID, formatDue(item.Item), status, itemText(item.Item))
+	}
+	return tw.Flush()
+}
+
+// Writes one item with its notes, or as JSON with --json
+func (c *cli) writeItem(item client.Item) error {
+	if c.json {
+		return c.writeJSON(item)
+	}
+	fmt.Fprintf(c.out, "%d: %s\ndue %s, %s", item.ID, itemText(item.Item), formatDue(item.Item), item.Item.State)
+	if item.Item.Assignee != "" {
+		fmt.Fprintf(c.out, ", assigned to %s", item.Item.Assignee)
+	}
+	fmt.Fprintf(c.out, "\n")
+	if item.Item.Notes != "" {
+		fmt.Fprintf(c.out, "\n%s\n", item.Item.Notes)
+	}
+	return nil
+}
+
+func addFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	due := fs.String("due", "", "when it's due (default today): YYYY-MM-DD, tomorrow, friday, +3d...")
+	list := fs.Int64("list", 0, "which list it goes in (default your first one; see tada lists)")
+	notes := fs.String("notes", "", "notes to go with it")
+	var tags stringsFlag
+	fs.Var(&tags, "tag", "a tag for it (more than one is ok, or a,b)")
+	return func(c *cli, args []string) error {
+		n := client.NewItem{Description: strings.Join(args, " "), ListID: *list, Notes: *notes, Tags: tags}
+		if strings.TrimSpace(n.Description) == "" {
+			return usageError("what's the item? e.g. tada add \"buy milk\"")
+		}
+		if *due != "" {
+			d, err := parseDate(*due, c.now)
+			if err != nil {
+				return err
+			}
+			n.DueDate = d
+		}
+		item, err := c.client.Add(n)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.writeJSON(item)
+		}
+		_, err = fmt.Fprintf(c.out, "added %d: %s, due %s\n", item.ID, itemText(item.Item), formatDue(item.Item))
+		return err
+	}
+}
+
+func lsFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	var q client.Query
+	all := fs.Bool("all", false, "completed items too")
+	overdue := fs.Bool("overdue", false, "just overdue items")
+	today := fs.Bool("today", false, "just items due today")
+	week := fs.Bool("week", false, "just items due this week")
+	from := fs.String("from", "", "just items due on or after this date")
+	to := fs.String("to", "", "just items due on or before this date")
+	fs.Int64Var(&q.ListID, "list", 0, "just the items in this list")
+	fs.BoolVar(&q.AssignedToMe, "assigned", false, "just items assigned to you")
+	fs.StringVar(&q.Sort, "sort", "", "due, created or description")
+	return func(c *cli, args []string) error {
+		if len(args) > 0 {
+			return usageError("ls doesn't take any arguments; did you mean tada search?")
+		}
+		q.HideCompleted = !*all
+		for _, due := range []struct {
+			set  bool
+			name string
+		}{{*overdue, "overdue"}, {*today, "today"}, {*week, "week"}} {
+			if due.set {
+				if q.Due != "" {
+					return usageError("pick one of --overdue, --today and --week")
+				}
+				q.Due = due.name
+			}
+		}
+		for _, d := range []struct {
+			flag string
+			to   *string
+		}{{*from, &q.From}, {*to, &q.To}} {
+			if d.flag != "" {
+				s, err := parseDate(d.flag, c.now)
+				if err != nil {
+					return err
+				}
+				// just the date, even if they said a time
+				*d.to = s[:len("2006-01-02")]
+			}
+		}
+		items, err := c.client.Items(q)
+		if err != nil {
+			return err
+		}
+		return c.writeItems(items)
+	}
+}
+
+func doneFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	undo := fs.Bool("undo", false, "mark them incomplete again instead")
+	return func(c *cli, args []string) error {
+		if len(args) == 0 {
+			return usageError("which items? e.g. tada done 1234")
+		}
+		var ids []int64
+		for _, arg := range args {
+			id, err := parseID(arg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		var done []client.Item
+		for _, id := range ids {
+			item, err := c.client.SetDone(id, !*undo)
+			if err != nil {
+				return fmt.Errorf("%d: %s", id, err.Error())
+			}
+			done = append(done, item)
+			if !c.json {
+				fmt.Fprintf(c.out, "%s %d: %s\n", item.Item.State, item.ID, itemText(item.Item))
+			}
+		}
+		if c.json {
+			return c.writeJSON(done)
+		}
+		return nil
+	}
+}
+
+func searchFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if len(args) == 0 {
+			return usageError("what do you want to search for?")
+		}
+		items, err := c.client.Search(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		return c.writeItems(items)
+	}
+}
+
+func showFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if len(args) != 1 {
+			return usageError("which item? e.g. tada show 1234")
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		item, err := c.client.Item(id)
+		if err != nil {
+			return err
+		}
+		return c.writeItem(item)
+	}
+}
+
+func editFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	text := fs.String("text", "", "the new description")
+	due := fs.String("due", "", "the new due date (see tada add -h)")
+	notes := fs.String("notes", "", "the new notes")
+	tags := fs.String("tags", "", `the new tags, like a,b ("," for none)`)
+	return func(c *cli, args []string) error {
+		if len(args) != 1 {
+			return usageError("which item? e.g. tada edit 1234 --due friday")
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		var p client.Patch
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if set["text"] {
+			p.Description = text
+		}
+		if set["due"] {
+			d, err := parseDate(*due, c.now)
+			if err != nil {
+				return err
+			}
+			p.DueDate = &d
+		}
+		if set["notes"] {
+			p.Notes = notes
+		}
+		if set["tags"] {
+			ts := splitTags(*tags)
+			p.Tags = &ts
+		}
+		var version int64
+		if p == (client.Patch{}) {
+			// no flags, so they get to edit the whole thing
+			item, err := c.client.Item(id)
+			if err != nil {
+				return err
+			}
+			edited, err := runEditor(editForm(item.Item))
+			if err != nil {
+				return err
+			}
+			p, err = parseEditForm(edited, item.Item, c.now)
+			if err != nil {
+				return err
+			}
+			if p == (client.Patch{}) {
+				fmt.Fprintln(c.out, "nothing changed")
+				return nil
+			}
+			// so we don't clobber whatever anybody else did while they were
+			// in the editor
+			version = item.Item.Version
+		}
+		item, err := c.client.Patch(id, p, version)
+		if conflict, ok := err.(*client.ConflictError); ok {
+			return fmt.Errorf("%s, so your change wasn't saved; it's due %s now, and says %q",
+				conflict.Error(), formatDue(conflict.Current), conflict.Current.Description)
+		}
+		if err != nil {
+			return err
+		}
+		return c.writeItem(item)
+	}
+}
+
+const notesLine = "--- notes (everything below this line) ---"
+
+// What tada edit puts in the editor
+func editForm(item client.TodoItem) string {
+	return fmt.Sprintf("Description: %s\nDue: %s\nTags: %s\n%s\n%s", item.Description, formatDue(item),
+		strings.Join(item.Tags, ", "), notesLine, item.Notes)
+}
+
+// Reads editForm back after it's been edited, and returns what's different
+// from item
+func parseEditForm(s string, item client.TodoItem, now time.Time) (client.Patch, error) {
+	var p client.Patch
+	head, notes := s, ""
+	if i := strings.Index(s, notesLine); i >= 0 {
+		head, notes = s[:i], strings.TrimPrefix(s[i+len(notesLine):], "\n")
+	}
+	scanner := bufio.NewScanner(strings.NewReader(head))
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.Index(line, ":")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if colon < 0 {
+			return p, fmt.Errorf("I don't understand %q", line)
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "description":
+			if value == "" {
+				return p, errors.New("the description can't be empty")
+			}
+			if value != item.Description {
+				p.Description = &value
+			}
+		case "due":
+			if value != formatDue(item) {
+				d, err := parseDate(value, now)
+				if err != nil {
+					return p, err
+				}
+				p.DueDate = &d
+			}
+		case "tags":
+			tags := splitTags(value)
+			if strings.Join(tags, ",") != strings.Join(item.Tags, ",") {
+				p.Tags = &tags
+			}
+		default:
+			return p, fmt.Errorf("I don't know what %q is", line[:colon])
+		}
+	}
+	if strings.TrimRight(notes, "\n") != strings.TrimRight(item.Notes, "\n") {
+		p.Notes = &notes
+	}
+	return p, nil
+}
+
+// Lets them edit s in $VISUAL or $EDITOR (vi if neither) and returns what
+// they saved
+func runEditor(s string) (string, error) {
+	f, err := ioutil.TempFile("", "tada-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(s); err != nil {
+		f.Close()
+		return "", err
+	}
+	f.Close()
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// n.b. through the shell, since $EDITOR is often something like "code -w"
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("the editor didn't work out (%s), so nothing changed", err.Error())
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	return string(b), err
+}
+
+func listsFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		lists, err := c.client.Lists()
+		if err != nil {
+			return err
+		}
+		if c.json {
+			if lists == nil {
+				lists = []client.List{}
+			}
+			return c.writeJSON(lists)
+		}
+		tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tOWNER")
+		for _, l := range lists {
+			name := l.List.Name
+			if l.List.Archived {
+				name += " (archived)"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", l.ID, name, l.List.OwnerEmail)
+		}
+		return tw.Flush()
+	}
+}
+
+// With --server or --token, saves them in the config file; otherwise says
+// what's there. n.b. those are the global flags, which run has already put
+// in c.config, along with whatever was in the file.
+func configFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if set["server"] || set["token"] {
+			if err := client.SaveConfig(c.configPath, c.config); err != nil {
+				return err
+			}
+			fmt.Fprintf(c.out, "saved in %s\n", c.configPath)
+			return nil
+		}
+		token := "(none)"
+		if len(c.config.Token) > 4 {
+			// enough to tell which one it is, not enough to use it
+			token = strings.Repeat("*", len(c.config.Token)-4) + c.config.Token[len(c.config.Token)-4:]
+		}
+		fmt.Fprintf(c.out, "config: %s\nserver: %s\ntoken: %s\n", c.configPath, c.config.Server, token)
+		return nil
+	}
+}
+
+func helpFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		writeUsage(c.out)
+		return nil
+	}
+}
+
+func completionFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if len(args) != 1 {
+			return usageError("which shell? bash, zsh or fish")
+		}
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(c.out)
+		case "zsh":
+			// zsh can use the bash one
+			fmt.Fprint(c.out, "autoload -U +X bashcompinit && bashcompinit\n")
+			writeBashCompletion(c.out)
+		case "fish":
+			writeFishCompletion(c.out)
+		default:
+			return usageError("I don't know how to do completion for " + args[0])
+		}
+		return nil
+	}
+}
+
+// Each command's flags, with a "--" in front, sorted
+func commandFlags(cmd command) []string {
+	fs := newFlags(cmd.name, &cli{})
+	cmd.flags(fs)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+	sort.Strings(names)
+	return names
+}
+
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// For: source <(tada completion bash)
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintf(w, `_tada() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W %q -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+`, strings.Join(commandNames(), " "))
+	for _, cmd := range commands {
+		words := commandFlags(cmd)
+		if cmd.name == "completion" {
+			words = append(words, "bash", "zsh", "fish")
+		}
+		fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", cmd.name, strings.Join(words, " "))
+	}
+	fmt.Fprint(w, `    esac
+}
+complete -F _tada tada
+`)
+}
+
+// For: tada completion fish > ~/.config/fish/completions/tada.fish
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprint(w, "complete -c tada -f\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c tada -n __fish_use_subcommand -a %s -d %q\n", cmd.name, cmd.summary)
+	}
+	for _, cmd := range commands {
+		for _, f := range commandFlags(cmd) {
+			fmt.Fprintf(w, "complete -c tada -n '__fish_seen_subcommand_from %s' -l %s\n", cmd.name, strings.TrimPrefix(f, "--"))
+		}
+	}
+	fmt.Fprint(w, "complete -c tada -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tada/client"
+)
+
+// a Monday
+var testNow = time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+
+func TestParseDate(t *testing.T) {
+	for s, want := range map[string]string{
+		"2026-11-01":       "2026-11-01",
+		"today":            "2026-10-19",
+		"Tomorrow":         "2026-10-20",
+		"fri":              "2026-10-23",
+		"monday":           "2026-10-26",
+		"+3d":              "2026-10-22",
+		"+2w":              "2026-11-02",
+		"2026-11-01 09:30": "2026-11-01T09:30:00Z",
+	} {
+		got, err := parseDate(s, testNow)
+		if err != nil || got != want {
+			t.Errorf("parseDate(%q) = %q, %v; wanted %q", s, got, err, want)
+		}
+	}
+	if _, err := parseDate("someday", testNow); err == nil {
+		t.Errorf("someday isn't a date")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	due := fs.String("due", "", "")
+	args, err := parseArgs(fs, []string{"buy", "--due", "friday", "milk", "--", "--not-a-flag"})
+	if err != nil || *due != "friday" || !reflect.DeepEqual(args, []string{"buy", "milk", "--not-a-flag"}) {
+		t.Errorf("parseArgs: %v %q %v", args, *due, err)
+	}
+}
+
+func TestEditForm(t *testing.T) {
+	item := client.TodoItem{Description: "buy milk", DueDate: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC),
+		Tags: []string{"errands"}, Notes: "semi-skimmed\n"}
+	p, err := parseEditForm(editForm(item), item, testNow)
+	if err != nil || p != (client.Patch{}) {
+		t.Errorf("nothing changed, but got %+v %v", p, err)
+	}
+	edited := strings.Replace(editForm(item), "Due: 2026-10-20", "Due: friday", 1)
+	edited = strings.Replace(edited, "errands", "errands, shops", 1)
+	edited = strings.Replace(edited, "semi-skimmed", "whole", 1)
+	p, err = parseEditForm(edited, item, testNow)
+	if err != nil || p.Description != nil || *p.DueDate != "2026-10-23" ||
+		!reflect.DeepEqual(*p.Tags, []string{"errands", "shops"}) || *p.Notes != "whole\n" {
+		t.Errorf("wrong patch %+v %v", p, err)
+	}
+	if _, err := parseEditForm("Description:\n", item, testNow); err == nil {
+		t.Errorf("an empty description got through")
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/items" || r.FormValue("due") != "overdue" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(struct{ Items []client.Item }{[]client.Item{
+			{ID: 12, Item: client.TodoItem{Description: "call mum", DueDate: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC),
+				State: "incomplete", Priority: "A", Tags: []string{"family"}}},
+		}})
+	}))
+	defer server.Close()
+	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+	status := run([]string{"ls", "--overdue", "--server", server.URL, "--token", "secret", "--config", "/nonexistent"},
+		out, errOut, testNow)
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, errOut)
+	}
+	want := "ID  DUE                  DESCRIPTION\n" +
+		"12  2026-10-18  overdue  (A) call mum #family\n"
+	if out.String() != want {
+		t.Errorf("wanted\n%s\ngot\n%s", want, out)
+	}
+	if status := run([]string{"frobnicate"}, out, errOut, testNow); status != 2 {
+		t.Errorf("an unknown command got status %d", status)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	out := new(bytes.Buffer)
+	if status := run([]string{"completion", "bash", "--config", "/nonexistent"}, out, out, testNow); status != 0 {
+		t.Fatalf("status %d: %s", status, out)
+	}
+	for _, s := range []string{"complete -F _tada tada", "add ls done", `ls) COMPREPLY=($(compgen -W "--all --assigned`} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("no %q in\n%s", s, out)
+		}
+	}
+}
+
+// Pretends to be the server for tui, with what's in items
+type fakeAPI struct {
+	items   []client.Item
+	lists   []client.List
+	queries []client.Query
+}
+
+func (a *fakeAPI) Items(q client.Query) ([]client.Item, error) {
+	a.queries = append(a.queries, q)
+	if q.HideCompleted {
+		return incomplete(a.items), nil
+	}
+	return append([]client.Item(nil), a.items...), nil
+}
+
+func (a *fakeAPI) Lists() ([]client.List, error) { return a.lists, nil }
+
+func (a *fakeAPI) Search(query string) ([]client.Item, error) {
+	var found []client.Item
+	for _, item := range a.items {
+		if strings.Contains(item.Item.Description, query) {
+			found = append(found, item)
+		}
+	}
+	return found, nil
+}
+
+func (a *fakeAPI) SetDone(id int64, done bool) (client.Item, error) {
+	for i := range a.items {
+		if a.items[i].ID == id {
+			a.items[i].Item.State = map[bool]string{true: "completed", false: "incomplete"}[done]
+			return a.items[i], nil
+		}
+	}
+	return client.Item{}, &client.Error{Status: 404, Message: "no such item"}
+}
+
+func (a *fakeAPI) Patch(id int64, p client.Patch, version int64) (client.Item, error) {
+	for i := range a.items {
+		if a.items[i].ID == id {
+			if version != a.items[i].Item.Version {
+				return client.Item{}, &client.ConflictError{Current: a.items[i].Item}
+			}
+			d, _ := time.Parse("2006-01-02", *p.DueDate)
+			a.items[i].Item.DueDate = d
+			a.items[i].Item.Version++
+			return a.items[i], nil
+		}
+	}
+	return client.Item{}, &client.Error{Status: 404, Message: "no such item"}
+}
+
+// Waits for everything tui asked the pretend server to come back
+func settle(t *tui) {
+	for t.pending > 0 {
+		t.apply(<-t.results)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("j\x1b[A\x1b[6~\r\x1b\x7f\x15é"))
+	want := []string{"j", "up", "pgdown", "enter", "esc", "backspace", "ctrl-u", "é"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeys: got %q, wanted %q", got, want)
+	}
+}
+
+func TestTUI(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	a := &fakeAPI{
+		items: []client.Item{
+			{ID: 1, Item: client.TodoItem{Description: "call mum", DueDate: day(18), State: "incomplete", Version: 1}},
+			{ID: 2, Item: client.TodoItem{Description: "buy milk", DueDate: day(20), State: "incomplete", Version: 1, Notes: "semi-skimmed"}},
+			{ID: 3, Item: client.TodoItem{Description: "old thing", DueDate: day(1), State: "completed", Version: 1}},
+		},
+		lists: []client.List{{ID: 5, List: client.TodoList{Name: "Groceries"}}, {ID: 6, List: client.TodoList{Name: "Old", Archived: true}}},
+	}
+	ui := newTUI(a, func() time.Time { return testNow })
+	ui.refresh()
+	settle(ui)
+	if len(ui.views) != 3 || ui.views[2].name != "Groceries" || len(ui.items) != 2 {
+		t.Fatalf("wrong views %v or items %v", ui.views, ui.items)
+	}
+	screen := ui.render(60, 10)
+	for _, s := range []string{"Tada: Everything", "[ ] 2026-10-18       call mum", "buy milk", "as of 15:00:00"} {
+		if !strings.Contains(screen, s) {
+			t.Errorf("no %q on the screen:\n%s", s, screen)
+		}
+	}
+	if strings.Contains(screen, "old thing") {
+		t.Errorf("completed items are showing")
+	}
+
+	// mark "buy milk" done; it stays on the screen until the next refresh
+	ui.key("j")
+	ui.key(" ")
+	if !ui.items[1].Item.Completed() {
+		t.Errorf("toggling didn't change the screen straight away")
+	}
+	settle(ui)
+	if !a.items[1].Item.Completed() {
+		t.Errorf("toggling didn't change the item")
+	}
+	ui.key("r")
+	settle(ui)
+	if len(ui.items) != 1 {
+		t.Errorf("the completed item's still there after a refresh: %v", ui.items)
+	}
+
+	// change the due date of what's selected
+	for _, k := range append([]string{"d", "ctrl-u"}, strings.Split("fri", "")...) {
+		ui.key(k)
+	}
+	if !strings.Contains(ui.render(60, 10), "Due (YYYY-MM-DD, tomorrow, fri, +3d): fri_") {
+		t.Errorf("no prompt on the screen")
+	}
+	ui.key("enter")
+	settle(ui)
+	if !a.items[0].Item.DueDate.Equal(day(23)) || !ui.items[0].Item.DueDate.Equal(day(23)) {
+		t.Errorf("the due date didn't change: %v", a.items[0].Item.DueDate)
+	}
+
+	// somebody else changed it in the meantime
+	a.items[0].Item.Version = 10
+	ui.key("d")
+	ui.key("enter")
+	settle(ui)
+	if !strings.Contains(ui.status, "somebody else changed that item") {
+		t.Errorf("no conflict: %q", ui.status)
+	}
+
+	// search, with completed items too
+	ui.key("c")
+	for _, k := range append([]string{"/"}, strings.Split("thing", "")...) {
+		ui.key(k)
+	}
+	ui.key("enter")
+	settle(ui)
+	if len(ui.items) != 1 || ui.items[0].ID != 3 || !strings.Contains(ui.render(60, 10), `searching for "thing"`) {
+		t.Errorf("wrong search results %v", ui.items)
+	}
+	ui.key("esc")
+	settle(ui)
+	if ui.search != "" || len(ui.items) != 3 {
+		t.Errorf("esc didn't stop searching: %v", ui.items)
+	}
+
+	// on to the Groceries list, skipping "Assigned to me"
+	ui.key("l")
+	settle(ui)
+	ui.key("l")
+	settle(ui)
+	if q := a.queries[len(a.queries)-1]; q.ListID != 5 {
+		t.Errorf("wrong query for the list: %+v", q)
+	}
+	ui.key("h")
+	settle(ui)
+	if q := a.queries[len(a.queries)-1]; !q.AssignedToMe {
+		t.Errorf("wrong query for assigned items: %+v", q)
+	}
+	ui.key("q")
+	if !ui.quit {
+		t.Errorf("q didn't quit")
+	}
+}
@@ -0,0 +1,632 @@
+// +build !appengine
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"tada/client"
+)
+
+// tada ui: the same things as the other commands, but interactively, in the
+// whole terminal. It's all one loop (see runUI): keys come in, requests to
+// the server go off in the background (see tui.background) so the keys
+// keep working while they do, and the screen gets drawn again after
+// anything happens. Everything that isn't talking to the terminal is in
+// tui, which the tests drive directly.
+
+func uiFlags(fs *flag.FlagSet) func(c *cli, args []string) error {
+	every := fs.Duration("refresh", 30*time.Second, "how often to get the items again")
+	return func(c *cli, args []string) error {
+		if len(args) > 0 {
+			return usageError("ui doesn't take any arguments")
+		}
+		if *every <= 0 {
+			return usageError("--refresh has to be more than 0")
+		}
+		return runUI(c.client, *every)
+	}
+}
+
+// What tui needs from the server; *client.Client, or something pretend in
+// the tests
+type api interface {
+	Items(q client.Query) ([]client.Item, error)
+	Lists() ([]client.List, error)
+	Search(query string) ([]client.Item, error)
+	SetDone(id int64, done bool) (client.Item, error)
+	Patch(id int64, p client.Patch, version int64) (client.Item, error)
+}
+
+// Something to look at: everything, what's assigned to them, or a list
+type view struct {
+	name  string
+	query client.Query
+}
+
+type tui struct {
+	api api
+	now func() time.Time
+
+	views         []view
+	view          int // which one's showing
+	search        string
+	showCompleted bool
+	items         []client.Item
+	cursor        int // which item's selected
+	top           int // the first item on the screen, for scrolling
+	height        int // how many items fit on the screen, as of the last render
+	detail        bool
+	help          bool
+
+	// when it's asking for something, like a due date, what it says, what
+	// they've typed so far, and what to do when they hit enter
+	prompt  string
+	input   []rune
+	onInput func(string)
+
+	status    string // e.g. an error; goes away at the next key
+	loading   bool
+	refreshed time.Time
+	seq       int // goes up with every refresh, so older ones can be ignored
+	pending   int // requests that haven't come back yet
+	results   chan func(*tui)
+	quit      bool
+}
+
+func newTUI(a api, now func() time.Time) *tui {
+	return &tui{
+		api:     a,
+		now:     now,
+		views:   []view{{"Everything", client.Query{}}, {"Assigned to me", client.Query{AssignedToMe: true}}},
+		results: make(chan func(*tui), 16),
+	}
+}
+
+// Runs f in the background. Whatever it returns gets run in the main loop
+// (see runUI), which is the only place t changes.
+func (t *tui) background(f func() func(*tui)) {
+	t.pending++
+	go func() { t.results <- f() }()
+}
+
+// Applies a result from background
+func (t *tui) apply(f func(*tui)) {
+	t.pending--
+	f(t)
+}
+
+func (t *tui) selected() (client.Item, bool) {
+	if t.cursor < 0 || t.cursor >= len(t.items) {
+		return client.Item{}, false
+	}
+	return t.items[t.cursor], true
+}
+
+// Gets the lists and the items being looked at again
+func (t *tui) refresh() {
+	t.seq++
+	seq, search, hide := t.seq, t.search, !t.showCompleted
+	q := t.views[t.view].query
+	q.HideCompleted = hide
+	a := t.api
+	t.loading = true
+	t.background(func() func(*tui) {
+		lists, err := a.Lists()
+		var items []client.Item
+		if err == nil && search != "" {
+			items, err = a.Search(search)
+			if hide {
+				items = incomplete(items)
+			}
+		} else if err == nil {
+			items, err = a.Items(q)
+		}
+		return func(t *tui) {
+			if seq != t.seq {
+				// there's a newer one on the way
+				return
+			}
+			t.loading = false
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+			t.refreshed = t.now()
+			t.setLists(lists)
+			t.setItems(items)
+		}
+	})
+}
+
+func incomplete(items []client.Item) []client.Item {
+	var result []client.Item
+	for _, item := range items {
+		if !item.Item.Completed() {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Replaces the list views, staying on the same one if it's still there
+func (t *tui) setLists(lists []client.List) {
+	current := t.views[t.view]
+	views := t.views[:2:2]
+	for _, l := range lists {
+		if !l.List.Archived {
+			views = append(views, view{l.List.Name, client.Query{ListID: l.ID}})
+		}
+	}
+	t.views, t.view = views, 0
+	for i, v := range views {
+		if v.query == current.query {
+			t.view = i
+		}
+	}
+}
+
+// Replaces the items, keeping the same one selected if it's still there
+func (t *tui) setItems(items []client.Item) {
+	item, ok := t.selected()
+	t.items = items
+	if ok {
+		for i, it := range items {
+			if it.ID == item.ID {
+				t.cursor = i
+				return
+			}
+		}
+	}
+	if t.cursor >= len(items) {
+		t.cursor = len(items) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+}
+
+// Puts item where the old copy of it was
+func (t *tui) replace(item client.Item) {
+	for i := range t.items {
+		if t.items[i].ID == item.ID {
+			t.items[i] = item
+		}
+	}
+}
+
+// Starts asking for something; f gets what they typed
+func (t *tui) ask(prompt string, initial string, f func(string)) {
+	t.prompt, t.input, t.onInput = prompt, []rune(initial), f
+}
+
+// Does whatever key k (see parseKeys) means
+func (t *tui) key(k string) {
+	t.status = ""
+	if t.prompt != "" {
+		t.promptKey(k)
+		return
+	}
+	if t.help {
+		// any key gets rid of it
+		t.help = false
+		return
+	}
+	switch k {
+	case "q", "ctrl-c":
+		t.quit = true
+	case "j", "down":
+		t.move(1)
+	case "k", "up":
+		t.move(-1)
+	case "pgdown", "ctrl-f":
+		t.move(t.height)
+	case "pgup", "ctrl-b":
+		t.move(-t.height)
+	case "g", "home":
+		t.move(-len(t.items))
+	case "G", "end":
+		t.move(len(t.items))
+	case "l", "right", "tab":
+		t.switchView(1)
+	case "h", "left", "shift-tab":
+		t.switchView(-1)
+	case "enter":
+		t.detail = !t.detail
+	case " ", "x":
+		t.toggle()
+	case "d":
+		if item, ok := t.selected(); ok {
+			t.ask("Due (YYYY-MM-DD, tomorrow, fri, +3d): ", formatDue(item.Item), func(s string) { t.setDue(item, s) })
+		}
+	case "/":
+		t.ask("Search: ", t.search, func(s string) {
+			t.search = strings.TrimSpace(s)
+			t.cursor, t.top = 0, 0
+			t.refresh()
+		})
+	case "esc":
+		if t.search != "" {
+			t.search = ""
+			t.refresh()
+		}
+	case "c":
+		t.showCompleted = !t.showCompleted
+		t.refresh()
+	case "r":
+		t.refresh()
+	case "?":
+		t.help = true
+	}
+}
+
+func (t *tui) promptKey(k string) {
+	switch k {
+	case "enter":
+		f, s := t.onInput, string(t.input)
+		t.prompt, t.input, t.onInput = "", nil, nil
+		f(s)
+	case "esc", "ctrl-c":
+		t.prompt, t.input, t.onInput = "", nil, nil
+	case "backspace":
+		if len(t.input) > 0 {
+			t.input = t.input[:len(t.input)-1]
+		}
+	case "ctrl-u":
+		t.input = nil
+	default:
+		// n.b. named keys like "up" are more than one rune; typing only
+		// makes one at a time
+		if utf8.RuneCountInString(k) == 1 {
+			t.input = append(t.input, []rune(k)...)
+		}
+	}
+}
+
+func (t *tui) move(by int) {
+	t.cursor += by
+	if t.cursor >= len(t.items) {
+		t.cursor = len(t.items) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+}
+
+func (t *tui) switchView(by int) {
+	t.view = (t.view + by + len(t.views)) % len(t.views)
+	t.search = ""
+	t.cursor, t.top = 0, 0
+	t.items = nil
+	t.refresh()
+}
+
+// Marks the selected item completed, or incomplete if it already is. It
+// changes on the screen straight away, and changes back if the server says
+// no. n.b. it stays on the screen until the next refresh, so it's easy to
+// undo.
+func (t *tui) toggle() {
+	item, ok := t.selected()
+	if !ok {
+		return
+	}
+	done := !item.Item.Completed()
+	changed := item
+	changed.Item.State = "incomplete"
+	if done {
+		changed.Item.State = "completed"
+	}
+	t.replace(changed)
+	a := t.api
+	t.background(func() func(*tui) {
+		saved, err := a.SetDone(item.ID, done)
+		return func(t *tui) {
+			if err != nil {
+				t.replace(item)
+				t.status = err.Error()
+				return
+			}
+			t.replace(saved)
+		}
+	})
+}
+
+func (t *tui) setDue(item client.Item, s string) {
+	d, err := parseDate(strings.TrimSpace(s), t.now())
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	a := t.api
+	t.background(func() func(*tui) {
+		saved, err := a.Patch(item.ID, client.Patch{DueDate: &d}, item.Item.Version)
+		return func(t *tui) {
+			if conflict, ok := err.(*client.ConflictError); ok {
+				t.status = conflict.Error() + ", so the due date didn't change"
+				t.refresh()
+				return
+			}
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+			t.replace(saved)
+		}
+	})
+}
+
+const (
+	reverse = "\x1b[7m"
+	bold    = "\x1b[1m"
+	dim     = "\x1b[2m"
+	red     = "\x1b[31m"
+	plain   = "\x1b[0m"
+)
+
+const uiHelp = `j/k, up/down    move          h/l, left/right  other lists
+g/G             top/bottom    pgup/pgdown      a screenful
+space or x      done/not done d                change the due date
+enter           show notes    /                search (esc to stop)
+c               show completed items too       r  get everything again
+q               quit
+
+Press any key to go back.`
+
+// Pads or cuts s to exactly width characters. n.b. it assumes every rune
+// is one column wide.
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
+
+// Returns the whole screen, width by height, ready to write to the terminal
+func (t *tui) render(width, height int) string {
+	if width < 20 || height < 5 {
+		return "\x1b[H\x1b[2J" + "too small"
+	}
+	var lines []string
+	add := func(style string, s string) {
+		if style == "" {
+			lines = append(lines, fit(s, width))
+		} else {
+			lines = append(lines, style+fit(s, width)+plain)
+		}
+	}
+
+	title := "Tada: " + t.views[t.view].name
+	if t.search != "" {
+		title = fmt.Sprintf("Tada: searching for %q", t.search)
+	}
+	var state []string
+	if t.showCompleted {
+		state = append(state, "with completed")
+	}
+	if t.loading {
+		state = append(state, "loading...")
+	} else if !t.refreshed.IsZero() {
+		state = append(state, "as of "+t.refreshed.Format("15:04:05"))
+	}
+	add(reverse+bold, fmt.Sprintf("%s  [%d/%d]  %s", title, t.view+1, len(t.views), strings.Join(state, ", ")))
+
+	if t.help {
+		for _, line := range strings.Split(uiHelp, "\n") {
+			add("", line)
+		}
+		for len(lines) < height {
+			add("", "")
+		}
+		return "\x1b[H" + strings.Join(lines[:height], "\r\n")
+	}
+
+	var detail []string
+	if item, ok := t.selected(); ok && t.detail {
+		detail = append(detail, strings.Repeat("-", width))
+		about := fmt.Sprintf("%d: due %s, %s", item.ID, formatDue(item.Item), item.Item.State)
+		if item.Item.Assignee != "" {
+			about += ", assigned to " + item.Item.Assignee
+		}
+		detail = append(detail, about)
+		notes := strings.Split(strings.TrimRight(item.Item.Notes, "\n"), "\n")
+		if len(notes) > height/3 {
+			notes = append(notes[:height/3], "...")
+		}
+		detail = append(detail, notes...)
+	}
+
+	t.height = height - 2 - len(detail)
+	if t.height < 1 {
+		t.height, detail = height-2, nil
+	}
+	// scroll so the cursor's on the screen
+	if t.cursor < t.top {
+		t.top = t.cursor
+	}
+	if t.cursor >= t.top+t.height {
+		t.top = t.cursor - t.height + 1
+	}
+	if len(t.items) == 0 && !t.loading {
+		add(dim, "  nothing here")
+	}
+	now := t.now()
+	for i := t.top; i < len(t.items) && i < t.top+t.height; i++ {
+		item := t.items[i].Item
+		check := "[ ]"
+		style := ""
+		if item.Completed() {
+			check, style = "[x]", dim
+		} else if overdue(item, now) {
+			style = red
+		}
+		if i == t.cursor {
+			style += reverse
+		}
+		add(style, fmt.Sprintf("%s %-16s %s", check, formatDue(item), itemText(item)))
+	}
+	for len(lines) < height-1-len(detail) {
+		add("", "")
+	}
+	for _, line := range detail {
+		add("", line)
+	}
+
+	switch {
+	case t.prompt != "":
+		add("", t.prompt+string(t.input)+"_")
+	case t.status != "":
+		add(bold, t.status)
+	default:
+		add(dim, "j/k move  h/l lists  space done  d due  / search  c completed  ? help  q quit")
+	}
+	return "\x1b[H" + strings.Join(lines, "\r\n")
+}
+
+// What escape sequences (after the ESC [) the keys send
+var escapeKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left", "H": "home", "F": "end",
+	"1~": "home", "4~": "end", "5~": "pgup", "6~": "pgdown", "3~": "delete", "Z": "shift-tab",
+}
+
+// Turns what the terminal sent into keys: a character like "j", or a name
+// like "up", "enter" or "ctrl-u". n.b. an ESC on its own is the escape key,
+// which only works because terminals send a whole escape sequence at once.
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch c := b[0]; {
+		case c == 0x1b && len(b) > 2 && (b[1] == '[' || b[1] == 'O'):
+			end := 2
+			for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+				end++
+			}
+			if end == len(b) {
+				// cut off; give up on the rest
+				return keys
+			}
+			if k, ok := escapeKeys[string(b[2:end+1])]; ok {
+				keys = append(keys, k)
+			}
+			b = b[end+1:]
+		case c == 0x1b:
+			keys = append(keys, "esc")
+			b = b[1:]
+		case c == '\r' || c == '\n':
+			keys = append(keys, "enter")
+			b = b[1:]
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, "backspace")
+			b = b[1:]
+		case c == '\t':
+			keys = append(keys, "tab")
+			b = b[1:]
+		case c < 0x20:
+			keys = append(keys, "ctrl-"+string(rune('a'+c-1)))
+			b = b[1:]
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, string(r))
+			b = b[size:]
+		}
+	}
+	return keys
+}
+
+// Takes over the terminal until they quit
+func runUI(c *client.Client, every time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("tada ui needs a terminal")
+	}
+	// find out now if the token's no good, rather than in a blank screen
+	if _, err := c.Lists(); err != nil {
+		return err
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, old)
+	out := bufio.NewWriter(os.Stdout)
+	// the alternate screen, so their scrollback's still there afterwards,
+	// without a cursor
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+		out.Flush()
+	}()
+
+	keys := make(chan []string)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- parseKeys(buf[:n])
+		}
+	}()
+	refresh := time.NewTicker(every)
+	defer refresh.Stop()
+	// there's no portable way to hear about the terminal changing size, so
+	// look every so often
+	resize := time.NewTicker(500 * time.Millisecond)
+	defer resize.Stop()
+
+	t := newTUI(c, time.Now)
+	t.refresh()
+	size := func() (int, int) {
+		w, h, err := term.GetSize(fd)
+		if err != nil {
+			return 80, 24
+		}
+		return w, h
+	}
+	var width, height int
+	redraw := true
+	for !t.quit {
+		if w, h := size(); w != width || h != height {
+			// clear whatever was off the edge of the old size
+			width, height, redraw = w, h, true
+			fmt.Fprint(out, "\x1b[2J")
+		}
+		if redraw {
+			out.WriteString(t.render(width, height))
+			out.Flush()
+		}
+		redraw = true
+		select {
+		case ks, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, k := range ks {
+				t.key(k)
+			}
+		case f := <-t.results:
+			t.apply(f)
+		case <-refresh.C:
+			// n.b. not while they're typing something, which might be
+			// about an item that's about to move
+			if t.pending == 0 && t.prompt == "" {
+				t.refresh()
+			}
+		case <-resize.C:
+			// the top of the loop redraws if it's changed
+			redraw = false
+		}
+	}
+	return nil
+}
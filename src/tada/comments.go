@@ -0,0 +1,171 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/addComment", addCommentHandler)
+}
+
+// Somebody's remark about a todo item. Stored with the item as its parent.
+type Comment struct {
+	AuthorEmail string    // email address of the user who wrote this
+	Body        string    `datastore:",noindex"` // what they said
+	Created     time.Time // when they said it
+}
+
+// Something that happened to a todo item, written automatically.
+// Stored with the item as its parent.
+type Activity struct {
+	ActorEmail string    // email address of the user who did it
+	Kind       string    // one of the activity... constants
+	Detail     string    // e.g. the old and new due dates; can be ""
+	Created    time.Time // when it happened
+}
+
+type Comments []Comment
+type Activities []Activity
+
+func (c Comments) isMaybeError()   {}
+func (a Activities) isMaybeError() {}
+
+const (
+	activityCreated        = "created"
+	activityDueDateChanged = "due date changed"
+	activityCompleted      = "completed"
+	activityReopened       = "reopened"
+	activityReassigned     = "reassigned"
+	activityTrashed        = "moved to the trash"
+	activityRestored       = "restored from the trash"
+)
+
+func todoItemKey(ctx context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, "TodoItem", "", id, nil)
+}
+
+// Adds a comment to the item with ID id. email has to be able to see the item.
+func addComment(ctx context.Context, email string, id int64, body string) *MaybeError {
+	var result = new(MaybeError)
+	k := todoItemKey(ctx, id)
+	item := readTodoItemAs(ctx, email, TodoID(*k))
+	switch (*item).(type) {
+	case TodoItem:
+	default:
+		return item
+	}
+	comment := Comment{
+		AuthorEmail: email,
+		Body:        body,
+		Created:     time.Now(),
+	}
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Comment", k), &comment); err != nil {
+		log("addComment error: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		*result = Ok{}
+	}
+	return result
+}
+
+// Returns the comments on the item with key k, oldest first
+func listComments(ctx context.Context, k datastore.Key) *MaybeError {
+	var result = new(MaybeError)
+	var comments = make([]Comment, 0)
+	q := datastore.NewQuery("Comment").Ancestor(&k).Order("Created")
+	if _, err := q.GetAll(ctx, &comments); err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = Comments(comments)
+	}
+	return result
+}
+
+// Adds an entry to the activity log of the item with key k
+func recordActivity(ctx context.Context, k datastore.Key, email string, kind string, detail string) *MaybeError {
+	var result = new(MaybeError)
+	activity := Activity{
+		ActorEmail: email,
+		Kind:       kind,
+		Detail:     detail,
+		Created:    time.Now(),
+	}
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Activity", &k), &activity); err != nil {
+		log("recordActivity error: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		*result = Ok{}
+	}
+	return result
+}
+
+// Records whatever changed between before and after in the activity log of
+// the item with key k
+func recordChanges(ctx context.Context, k datastore.Key, email string, before TodoItem, after TodoItem) {
+	// ignore errors here: losing a log entry isn't worth failing the update over
+	if !before.DueDate.Equal(after.DueDate) {
+		recordActivity(ctx, k, email, activityDueDateChanged,
+			before.DueDate.Format("2006-01-02")+" to "+after.DueDate.Format("2006-01-02"))
+	}
+	if before.State != after.State {
+		if after.State == "completed" {
+			recordActivity(ctx, k, email, activityCompleted, "")
+		} else {
+			recordActivity(ctx, k, email, activityReopened, "")
+		}
+	}
+	if before.InTrash() != after.InTrash() {
+		if after.InTrash() {
+			recordActivity(ctx, k, email, activityTrashed, "")
+		} else {
+			recordActivity(ctx, k, email, activityRestored, "")
+		}
+	}
+	if before.Assignee != after.Assignee {
+		recordActivity(ctx, k, email, activityReassigned, reminderRecipient(before)+" to "+reminderRecipient(after))
+	}
+}
+
+// Returns the activity log of the item with key k, oldest first
+func listActivities(ctx context.Context, k datastore.Key) *MaybeError {
+	var result = new(MaybeError)
+	var activities = make([]Activity, 0)
+	q := datastore.NewQuery("Activity").Ancestor(&k).Order("Created")
+	if _, err := q.GetAll(ctx, &activities); err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = Activities(activities)
+	}
+	return result
+}
+
+// Expects "id" and "body" parameters
+func addCommentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	body := r.FormValue("body")
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+	} else if body == "" {
+		http.Error(w, "A comment needs to say something", 400)
+	} else {
+		result := addComment(ctx, email, itemID, body)
+		switch (*result).(type) {
+		case Ok:
+			http.Redirect(w, r, fmt.Sprintf("/todo/%d", itemID), http.StatusSeeOther)
+		default:
+			respondWith(w, *result)
+		}
+	}
+}
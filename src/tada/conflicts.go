@@ -0,0 +1,111 @@
+// +build !appengine
+package tada
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pass this as the version to updateTodoItem and friends to overwrite
+// whatever's there, whoever changed it last
+const anyVersion = -1
+
+var errConflict = errors.New("somebody else changed that item first")
+
+// What changeTodoItem did to an item
+type Change struct {
+	Before TodoItem
+	After  TodoItem
+}
+
+// Somebody else changed the item since the version the change was based on.
+// Current is what it looks like now.
+type Conflict struct {
+	Current TodoItem
+}
+
+func (c Change) isMaybeError()   {}
+func (c Conflict) isMaybeError() {}
+
+// The ETag for an item is just its version
+func itemETag(item TodoItem) string {
+	return fmt.Sprintf(`"%d"`, item.Version)
+}
+
+// Returns the version of the item the request's change is based on: from the
+// If-Match header if there is one (that's what API clients send), otherwise
+// from the "version" field the HTML forms have in them, otherwise anyVersion
+// for old clients that don't know about versions.
+func versionFromRequest(r *http.Request) (int64, error) {
+	if m := strings.TrimSpace(r.Header.Get("If-Match")); m != "" {
+		if m == "*" {
+			return anyVersion, nil
+		}
+		return strconv.ParseInt(strings.Trim(strings.TrimPrefix(m, "W/"), `"`), 10, 64)
+	}
+	if v := r.FormValue("version"); v != "" {
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return anyVersion, nil
+}
+
+const conflictPageTemplate = `<html><h1>Somebody else changed this item</h1>
+<p>{{.Current.OwnerEmail}}'s item was changed at {{FmtTime .Current.UpdatedAt}}, after you started editing it,
+so your change wasn't saved. Here's how it looks now next to what you tried to save:</p>
+<table border="1">
+<tr><th></th><th>Now</th><th>Yours</th></tr>
+<tr{{if ne .Current.Description .Mine.Description}} style="background-color:pink"{{end}}><td>Description</td><td>{{.Current.Description}}</td><td>{{.Mine.Description}}</td></tr>
+<tr{{if ne (FmtDate .Current.DueDate) (FmtDate .Mine.DueDate)}} style="background-color:pink"{{end}}><td>Due</td><td>{{FmtDate .Current.DueDate}}</td><td>{{FmtDate .Mine.DueDate}}</td></tr>
+<tr{{if ne .Current.State .Mine.State}} style="background-color:pink"{{end}}><td>State</td><td>{{.Current.State}}</td><td>{{.Mine.State}}</td></tr>
+<tr{{if ne .Current.Notes .Mine.Notes}} style="background-color:pink"{{end}}><td>Notes</td><td><pre>{{.Current.Notes}}</pre></td><td><pre>{{.Mine.Notes}}</pre></td></tr>
+</table>
+ <form action="{{.Action}}" method="post">
+   <input hidden=true name="description" value="{{.Mine.Description}}">
+   <input hidden=true name="dueDate" value="{{FmtDate .Mine.DueDate}}">
+   <input hidden=true name="state" value="{{.Mine.State}}">
+   <input hidden=true name="notes" value="{{.Mine.Notes}}">
+   <input hidden=true name="id" value="{{.ID}}">
+   <input hidden=true name="list" value="{{.Current.ListID}}">
+   <input hidden=true name="version" value="{{.Current.Version}}">
+   <input type="submit" value="Save mine anyway">
+ </form>
+<a href="/todo/{{.ID}}">Keep theirs</a>
+</html>
+`
+
+var conflictPageT = template.Must(template.New("conflictPage").Funcs(template.FuncMap{
+	"FmtDate": func(d time.Time) string { return d.Format("2006-01-02") },
+	"FmtTime": func(d time.Time) string { return d.Format("2006-01-02 15:04") },
+}).Parse(conflictPageTemplate))
+
+// Tells the client its change to the item with ID id was based on an old
+// version, with a 409. mine is what the client tried to save, and action is
+// where the page's "save mine anyway" form should go. API clients get the
+// current item as JSON, with its ETag, so they can merge and try again.
+func writeConflict(w http.ResponseWriter, r *http.Request, id int64, mine TodoItem, conflict Conflict, action string) {
+	w.Header().Set("ETag", itemETag(conflict.Current))
+	if wantsJson(r) {
+		blob := itemToJson(conflict.Current)
+		switch (*blob).(type) {
+		case Blob:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write((*blob).(Blob))
+		default:
+			respondWith(w, *blob)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusConflict)
+	handleError(w, conflictPageT.Execute(w, struct {
+		ID      int64
+		Mine    TodoItem
+		Current TodoItem
+		Action  string
+	}{id, mine, conflict.Current, action}))
+}
@@ -0,0 +1,305 @@
+// +build !appengine
+package tada
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/export.csv", exportCSVHandler)
+	http.HandleFunc("/importCSV", importCSVHandler)
+}
+
+// The columns in an exported file. Importing only looks at the ones
+// csvImportColumns knows, so an exported file can be imported again.
+var csvExportColumns = []string{"ID", "Description", "DueDate", "State", "Priority", "ListID", "Assignee", "Notes", "Tags", "Created", "UpdatedAt"}
+
+// What the columns of an imported file can be called, lowercased, and which
+// field they go in
+var csvImportColumns = map[string]string{
+	"description": "Description",
+	"duedate":     "DueDate",
+	"due date":    "DueDate",
+	"due":         "DueDate",
+	"state":       "State",
+	"status":      "State",
+	"priority":    "Priority",
+	"notes":       "Notes",
+	"tags":        "Tags",
+}
+
+// More rows than this and you should split the file up
+const maxImportRows = 1000
+
+// Dates are just dates unless the item's due at a particular time
+func formatCSVDate(item TodoItem) string {
+	if isTimed(item) {
+		return item.DueDate.UTC().Format(time.RFC3339)
+	}
+	return item.DueDate.UTC().Format("2006-01-02")
+}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseCSVDate(s string) (time.Time, error) {
+	if d, err := time.Parse("2006-01-02", s); err == nil {
+		return d, nil
+	}
+	if d, err := time.Parse(time.RFC3339, s); err == nil {
+		return d, nil
+	}
+	return time.Time{}, fmt.Errorf("%q doesn't look like a date to me (try YYYY-MM-DD)", s)
+}
+
+// Spreadsheets run cells that start with these as formulas
+const csvFormulaStarts = "=+-@"
+
+// Makes s safe to open in a spreadsheet: anything that would be a formula
+// gets a ' in front, which spreadsheets take to mean "this is text".
+// parseCSVItems takes it off again.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune(csvFormulaStarts, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// Undoes csvText
+func parseCSVText(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(csvFormulaStarts, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// Writes items as CSV, one row each, with a header row of csvExportColumns.
+// Tags are separated by commas, the same as the retag form. Text that
+// people typed goes through csvText.
+func writeItemsCSV(w io.Writer, items Matches) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(csvExportColumns); err != nil {
+		return err
+	}
+	for _, m := range items {
+		item := m.Value
+		err := out.Write([]string{
+			strconv.FormatInt(m.Key.IntID(), 10),
+			csvText(item.Description),
+			formatCSVDate(item),
+			item.State,
+			item.Priority,
+			strconv.FormatInt(item.ListID, 10),
+			csvText(item.Assignee),
+			csvText(item.Notes),
+			csvText(strings.Join(item.Tags, ", ")),
+			formatCSVTime(item.Created),
+			formatCSVTime(item.UpdatedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Reads items from CSV with a header row. There has to be a Description
+// column; see csvImportColumns for the rest. Items without a due date are
+// due today. Returns the items and what's wrong with the rows that aren't
+// right; blank rows are skipped. n.b. rows are spreadsheet rows, not lines:
+// notes with line breaks in them are still one row.
+func parseCSVItems(r io.Reader, today time.Time) ([]ImportedItem, []RowError) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err != nil {
+		return nil, []RowError{{1, "couldn't read the header row: " + err.Error()}}
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		if field, ok := csvImportColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+	if _, ok := columns["Description"]; !ok {
+		return nil, []RowError{{1, "there's no Description column"}}
+	}
+	var items []ImportedItem
+	var errors []RowError
+	for row := 2; ; row++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errors = append(errors, RowError{row, err.Error()})
+			// the reader can't always find its way to the next row
+			if _, ok := err.(*csv.ParseError); !ok {
+				break
+			}
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return parseCSVText(strings.TrimSpace(record[i]))
+			}
+			return ""
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		if len(items)+len(errors) >= maxImportRows {
+			errors = append(errors, RowError{row, fmt.Sprintf("that's more than %d rows; split the file up", maxImportRows)})
+			break
+		}
+		item := TodoItem{
+			Description: field("Description"),
+			DueDate:     startOfDay(today),
+			State:       "incomplete",
+			Notes:       field("Notes"),
+			Tags:        parseTags(field("Tags")),
+		}
+		if item.Description == "" {
+			errors = append(errors, RowError{row, "the description is empty"})
+			continue
+		}
+		if due := field("DueDate"); due != "" {
+			d, err := parseCSVDate(due)
+			if err != nil {
+				errors = append(errors, RowError{row, err.Error()})
+				continue
+			}
+			item.DueDate = d
+		}
+		if p := strings.ToUpper(field("Priority")); p != "" {
+			if len(p) != 1 || p[0] < 'A' || p[0] > 'Z' {
+				errors = append(errors, RowError{row, fmt.Sprintf("%q isn't a priority; use a letter from A to Z", field("Priority"))})
+				continue
+			}
+			item.Priority = p
+		}
+		switch strings.ToLower(field("State")) {
+		case "", "incomplete":
+		case "completed", "done":
+			item.State = "completed"
+		default:
+			errors = append(errors, RowError{row, fmt.Sprintf("%q isn't a state; use completed or incomplete", field("State"))})
+			continue
+		}
+		items = append(items, ImportedItem{Row: row, Item: item})
+	}
+	return items, errors
+}
+
+// Expects an optional "list" parameter; without it, it's everything the
+// user can see
+func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := user.Current(ctx)
+	var items *MaybeError
+	name := "tada.csv"
+	if list := r.FormValue("list"); list != "" {
+		listID, err := strconv.ParseInt(list, 10, 64)
+		if err != nil {
+			http.Error(w, list+" doesn't look like a list ID to me!", 400)
+			return
+		}
+		items = listTodoItemsInList(ctx, u, listID)
+		name = fmt.Sprintf("tada-%d.csv", listID)
+	} else {
+		items = listTodoItems(ctx, u)
+	}
+	switch (*items).(type) {
+	case Matches:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		handleError(w, writeItemsCSV(w, (*items).(Matches)))
+	default:
+		respondWith(w, *items)
+	}
+}
+
+const importCSVTemplate = `<html><h1>Import from a spreadsheet</h1>
+<p>Save your spreadsheet as CSV with a header row. It needs a Description
+column, and can have DueDate (YYYY-MM-DD), State (completed or incomplete),
+Priority (A to Z), Notes and Tags (separated by commas) columns too. Anything else is ignored,
+so you can import a file you exported. If any row has something wrong with it
+nothing gets imported, so you can fix the file and try again.</p>
+ <form action="/importCSV" method="post" enctype="multipart/form-data">
+   <input type="file" name="file" accept=".csv,text/csv">
+   into <select name="list">
+{{range .Lists}}     <option value="{{.Key.IntID}}"{{if eq .Key.IntID $.ListID}} selected{{end}}>{{.Value.Name}}</option>
+{{end}}   </select>
+   <label><input type="checkbox" name="remind" checked> Email reminders</label>
+   <input type="submit" value="Import">
+ </form>
+<a href="/?list={{.ListID}}">Back to your lists</a>
+</html>
+`
+
+var importCSVT = template.Must(template.New("importCSV").Parse(importCSVTemplate))
+
+// GET shows the form; POST expects a "file", a "list" to put the items in,
+// and "remind" if they should get reminders
+func importCSVHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := user.Current(ctx)
+	listID, _ := strconv.ParseInt(r.FormValue("list"), 10, 64)
+	if r.Method != "POST" {
+		lists := visibleTodoLists(ctx, u)
+		switch (*lists).(type) {
+		case TodoLists:
+			handleError(w, importCSVT.Execute(w, struct {
+				Lists  TodoLists
+				ListID int64
+			}{(*lists).(TodoLists), listID}))
+		default:
+			respondWith(w, *lists)
+		}
+		return
+	}
+	if !canEdit(listRole(ctx, u.Email, listID)) {
+		http.Error(w, "You can't add items to that list", http.StatusForbidden)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Pick a CSV file to import", 400)
+		return
+	}
+	defer file.Close()
+	items, errors := parseCSVItems(file, time.Now())
+	fmt.Fprint(w, `<html><h1>Import from a spreadsheet</h1>`)
+	if len(errors) > 0 {
+		fmt.Fprintf(w, "<p>Nothing was imported, because %d rows have something wrong with them:</p>\n", len(errors))
+		writeRowErrors(w, errors)
+		fmt.Fprintf(w, `<a href="/importCSV?list=%d">Try again</a></html>`, listID)
+		return
+	}
+	result := importItems(ctx, u, listID, items, r.FormValue("remind") != "")
+	switch (*result).(type) {
+	case ImportResult:
+		done := (*result).(ImportResult)
+		fmt.Fprintf(w, "<p>Imported %d items.</p>\n", done.Created)
+		writeRowErrors(w, done.Errors)
+		fmt.Fprintf(w, `<a href="/?list=%d">Back to the list</a></html>`, listID)
+	default:
+		respondWith(w, *result)
+	}
+}
@@ -0,0 +1,420 @@
+// +build !appengine
+package tada
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// Making items by sending email. On App Engine, mail to
+// anything@tada-1202.appspotmail.com comes in at /_ah/mail/; standalone
+// deployments can run an SMTP or LMTP server instead (see serveMail).
+// Either way the subject is the description, the body is the notes, and the
+// body can say when it's due. Anybody can put anything in a From header, so
+// that doesn't say whose item it is: the address does. Mail to
+// todo+<secret>@... goes in the Inbox of whoever's mail token that is, and
+// mail to todo+<secret>+<list ID>@... goes in that list. Anything else
+// gets turned away.
+
+func init() {
+	http.HandleFunc("/_ah/mail/", incomingMailHandler)
+}
+
+// Bigger than this is probably an attachment nobody wants in their notes
+const maxMailBytes = 10 << 20
+
+// Notes longer than this get cut off; it's a todo item, not an archive
+const maxMailNotes = 20000
+
+// "due: 2026-10-20", "Due tomorrow", "due by Friday" and so on
+var dueLine = regexp.MustCompile(`(?i)\bdue(?:\s+(?:on|by))?\s*:?\s*([A-Za-z0-9-]+)`)
+
+var isoDate = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+
+// Returns the date that word means: a YYYY-MM-DD date, "today", "tomorrow",
+// or a day of the week (the next one after today)
+func parseMailDate(word string, now time.Time) (time.Time, bool) {
+	today := startOfDay(now)
+	if d, err := time.Parse("2006-01-02", word); err == nil {
+		return d, true
+	}
+	switch w := strings.ToLower(word); w {
+	case "today":
+		return today, true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), true
+	default:
+		for i := 1; i <= 7; i++ {
+			d := today.AddDate(0, 0, i)
+			name := strings.ToLower(d.Weekday().String())
+			if w == name || (len(w) >= 3 && strings.HasPrefix(name, w)) {
+				return d, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Finds the due date in the body of an email: whatever follows "due", or
+// failing that the first YYYY-MM-DD date. The second result is false if
+// there isn't one.
+func dueDateFromText(body string, now time.Time) (time.Time, bool) {
+	for _, m := range dueLine.FindAllStringSubmatch(body, -1) {
+		if d, ok := parseMailDate(m[1], now); ok {
+			return d, true
+		}
+	}
+	if s := isoDate.FindString(body); s != "" {
+		return parseMailDate(s, now)
+	}
+	return time.Time{}, false
+}
+
+// Takes "Fwd:" and the like off the front of a subject, after decoding any
+// =?utf-8?...?= parts
+func mailSubject(subject string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	for {
+		trimmed := strings.TrimSpace(subject)
+		lower := strings.ToLower(trimmed)
+		found := false
+		for _, prefix := range []string{"fwd:", "fw:", "re:"} {
+			if strings.HasPrefix(lower, prefix) {
+				trimmed, found = trimmed[len(prefix):], true
+				break
+			}
+		}
+		subject = trimmed
+		if !found {
+			return strings.TrimSpace(subject)
+		}
+	}
+}
+
+// Returns the text/plain part of a message, or a part of one, with header
+// header and body body, decoded. "" if there isn't one.
+func plainTextBody(header textproto.MIMEHeader, body io.Reader) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no Content-Type means plain text
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				return ""
+			}
+			// n.b. NextPart undoes quoted-printable itself
+			if text := plainTextBody(part.Header, part); text != "" {
+				return text
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return ""
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Replace(string(b), "\r\n", "\n", -1))
+}
+
+// Where people send mail to make items, for the page that tells them.
+// Set TADA_MAIL_DOMAIN for standalone deployments.
+func mailDomain() string {
+	if d := os.Getenv("TADA_MAIL_DOMAIN"); d != "" {
+		return d
+	}
+	return "tada-1202.appspotmail.com"
+}
+
+// The address that makes items for whoever has the mail token token, in
+// the list with ID listID, or in their Inbox if listID is 0
+func itemMailAddress(token string, listID int64) string {
+	if listID != 0 {
+		return fmt.Sprintf("todo+%s+%d@%s", token, listID, mailDomain())
+	}
+	return fmt.Sprintf("todo+%s@%s", token, mailDomain())
+}
+
+// The mail token and list ID in an address like todo+<token>+123@...;
+// either can be missing, in which case it's "" or 0
+func parseItemMailAddress(address string) (string, int64) {
+	local := address
+	if at := strings.LastIndex(local, "@"); at >= 0 {
+		local = local[:at]
+	}
+	parts := strings.Split(local, "+")
+	if len(parts) < 2 {
+		return "", 0
+	}
+	if len(parts) < 3 {
+		return parts[1], 0
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return parts[1], 0
+	}
+	return parts[1], id
+}
+
+// Makes an item out of msg, which was sent to recipient, for whoever's mail
+// token is in recipient. now is for working out dates like "tomorrow".
+// Returns the new item's ID.
+func createItemFromMail(ctx context.Context, msg *mail.Message, recipient string, now time.Time) *MaybeError {
+	var result = new(MaybeError)
+	token, listID := parseItemMailAddress(recipient)
+	email, err := emailForToken(ctx, mailTokenKind, token)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	if email == "" {
+		*result = E("nobody has that address; see /apiToken for yours")
+		return result
+	}
+	u := &user.User{Email: email}
+	item := TodoItem{
+		Description: mailSubject(msg.Header.Get("Subject")),
+		State:       "incomplete",
+		Notes:       plainTextBody(textproto.MIMEHeader(msg.Header), msg.Body),
+		ListID:      listID,
+	}
+	if item.Description == "" {
+		*result = E("there's no subject to use as the description")
+		return result
+	}
+	if len(item.Notes) > maxMailNotes {
+		item.Notes = item.Notes[:maxMailNotes] + "..."
+	}
+	if d, ok := dueDateFromText(item.Notes, now); ok {
+		item.DueDate = d
+	} else {
+		item.DueDate = startOfDay(now)
+	}
+	if item.ListID == 0 {
+		inbox := ensureInbox(ctx, u)
+		switch (*inbox).(type) {
+		case TodoListID:
+			k := (*inbox).(TodoListID)
+			item.ListID = (*datastore.Key)(&k).IntID()
+		default:
+			return inbox
+		}
+	}
+	log(fmt.Sprintf("making an item for %s from mail from %s", email, msg.Header.Get("From")))
+	return writeNewTodoItem(ctx, item, u, true)
+}
+
+// App Engine posts incoming mail here, with the recipient at the end of the
+// path. Answering with an error doesn't bounce anything, so errors just get
+// logged.
+func incomingMailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	recipient := strings.TrimPrefix(r.URL.Path, "/_ah/mail/")
+	msg, err := mail.ReadMessage(io.LimitReader(r.Body, maxMailBytes))
+	if err != nil {
+		log("couldn't read incoming mail: " + err.Error())
+		return
+	}
+	id := createItemFromMail(ctx, msg, recipient, time.Now())
+	switch (*id).(type) {
+	case TodoID:
+	default:
+		// n.b. not the recipient: it has somebody's mail token in it
+		log(fmt.Sprintf("incoming mail didn't make an item: %v", *id))
+	}
+}
+
+// Starts the standalone mail servers, if TADA_SMTP_ADDR or TADA_LMTP_ADDR
+// (e.g. ":2525") say where to listen. n.b. App Engine itself doesn't let
+// apps listen on sockets; it has /_ah/mail/ instead.
+func startMailServers(ctx context.Context) {
+	for _, s := range []struct {
+		env  string
+		lmtp bool
+	}{{"TADA_SMTP_ADDR", false}, {"TADA_LMTP_ADDR", true}} {
+		if addr := os.Getenv(s.env); addr != "" {
+			go func(addr string, lmtp bool) {
+				if err := serveMail(ctx, addr, lmtp); err != nil {
+					log(fmt.Sprintf("mail server on %s stopped: %s", addr, err.Error()))
+				}
+			}(addr, s.lmtp)
+		}
+	}
+}
+
+// Listens on addr for SMTP (or LMTP, if lmtp is set) and makes an item out
+// of each message it's given
+func serveMail(ctx context.Context, addr string, lmtp bool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveMailConn(ctx, conn, lmtp, time.Now)
+	}
+}
+
+// Talks enough SMTP (RFC 5321), or LMTP (RFC 2033), to be handed mail by
+// another server: no relaying, no auth and no TLS, so put it behind one
+// that does those. The difference with LMTP is that it says LHLO instead of
+// EHLO, and gets an answer for each recipient after DATA.
+func serveMailConn(ctx context.Context, conn io.ReadWriteCloser, lmtp bool, now func() time.Time) {
+	defer conn.Close()
+	in := textproto.NewReader(bufio.NewReader(conn))
+	out := bufio.NewWriter(conn)
+	reply := func(code int, format string, a ...interface{}) {
+		fmt.Fprintf(out, "%d %s\r\n", code, fmt.Sprintf(format, a...))
+		out.Flush()
+	}
+	protocol, hello := "ESMTP", "EHLO"
+	if lmtp {
+		protocol, hello = "LMTP", "LHLO"
+	}
+	var from string
+	var recipients []string
+	reply(220, "tada %s ready", protocol)
+	for {
+		line, err := in.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if space := strings.Index(line, " "); space >= 0 {
+			verb, arg = line[:space], strings.TrimSpace(line[space+1:])
+		}
+		switch verb = strings.ToUpper(verb); {
+		case verb == hello:
+			fmt.Fprintf(out, "250-tada\r\n250-8BITMIME\r\n")
+			reply(250, "SIZE %d", maxMailBytes)
+		case verb == "HELO" && !lmtp:
+			reply(250, "tada")
+		case verb == "MAIL":
+			from, recipients = mailPath(arg, "FROM:"), nil
+			reply(250, "OK")
+		case verb == "RCPT":
+			to := mailPath(arg, "TO:")
+			if to == "" {
+				reply(501, "Who's it to?")
+				continue
+			}
+			recipients = append(recipients, to)
+			reply(250, "OK")
+		case verb == "DATA":
+			if len(recipients) == 0 {
+				reply(503, "Say who it's to first")
+				continue
+			}
+			reply(354, "Go ahead, end with <CRLF>.<CRLF>")
+			dot := in.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dot, maxMailBytes+1))
+			if err == nil {
+				// the rest of one that's too big, so it isn't taken for commands
+				_, err = io.Copy(ioutil.Discard, dot)
+			}
+			if err != nil {
+				return
+			}
+			var errors []string
+			for _, to := range recipients {
+				var problem string
+				if len(data) > maxMailBytes {
+					problem = "552 That's too big"
+				} else if msg, err := mail.ReadMessage(bytes.NewReader(data)); err != nil {
+					problem = "554 That doesn't look like an email to me"
+				} else if id := createItemFromMail(ctx, msg, to, now()); !isTodoID(id) {
+					problem = fmt.Sprintf("550 %v", *id)
+				}
+				if lmtp {
+					if problem == "" {
+						reply(250, "OK, made an item for %s", to)
+					} else {
+						fmt.Fprintf(out, "%s\r\n", problem)
+						out.Flush()
+					}
+				} else if problem != "" {
+					errors = append(errors, problem)
+				}
+			}
+			if !lmtp {
+				if len(errors) == 0 {
+					reply(250, "OK, made an item")
+				} else {
+					fmt.Fprintf(out, "%s\r\n", errors[0])
+					out.Flush()
+				}
+			}
+			log(fmt.Sprintf("%s from %s to %d recipients", protocol, from, len(recipients)))
+			from, recipients = "", nil
+		case verb == "RSET":
+			from, recipients = "", nil
+			reply(250, "OK")
+		case verb == "NOOP":
+			reply(250, "OK")
+		case verb == "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "I don't know how to %s", verb)
+		}
+	}
+}
+
+func isTodoID(result *MaybeError) bool {
+	_, ok := (*result).(TodoID)
+	return ok
+}
+
+// Returns the address in an argument like "FROM:<a@example.com> SIZE=100"
+func mailPath(arg string, prefix string) string {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return ""
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if end := strings.Index(arg, ">"); strings.HasPrefix(arg, "<") && end > 0 {
+		return arg[1:end]
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
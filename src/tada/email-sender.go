@@ -8,6 +8,7 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/mail"
 	"google.golang.org/appengine/runtime"
 	"google.golang.org/appengine/taskqueue"
@@ -17,9 +18,24 @@ func init() {
 	http.HandleFunc("/_ah/start", startPoller)
 }
 
+// What goes in the reminders queue. The item's fields are at the top level
+// of the JSON, so this is backwards-compatible with when the payload was
+// just a TodoItem.
+type Reminder struct {
+	TodoItem
+	Key string // encoded datastore key of the item, so we can see if it's changed
+}
+
+func (r Reminder) isMaybeError() {}
+
 func startPoller(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	err := runtime.RunInBackground(ctx, poller)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = runtime.RunInBackground(ctx, startMailServers)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 	}
@@ -42,17 +58,20 @@ func poller(ctx context.Context) {
 
 func sendOneReminder(ctx context.Context, t *taskqueue.Task) {
 	// decode todo item
-	todoItem_ := jsonToTodoItem(t.Payload)
-	switch (*todoItem_).(type) {
-	case TodoItem:
+	reminder_ := jsonToReminder(t.Payload)
+	switch (*reminder_).(type) {
+	case Reminder:
 		{
-			todoItem := (*todoItem_).(TodoItem)
-			if reminderDue(todoItem) {
+			todoItem, ok := currentReminderItem(ctx, (*reminder_).(Reminder))
+			if !ok {
+				// the item's been deleted for good, so nobody needs reminding
+				taskqueue.Delete(ctx, t, "reminders")
+			} else if reminderDue(todoItem) && !todoItem.InTrash() {
 				// send email reminder
 				// note: this doesn't handle the case where a task gets complete in between
 				// when it's enqueued and when the reminder is due to be sent
 				if sendReminderEmail(ctx,
-					todoItem.OwnerEmail,
+					reminderRecipient(todoItem),
 					todoItem.Description,
 					todoItem.DueDate) {
 					err := taskqueue.Delete(ctx, t, "reminders")
@@ -74,10 +93,38 @@ func sendOneReminder(ctx context.Context, t *taskqueue.Task) {
 	}
 }
 
+// Returns the item as it is now, so the reminder goes to whoever it's
+// assigned to now rather than when the reminder was queued.
+// Falls back to the queued copy for old reminders or if the read fails.
+// Items in the trash still come back, in case they get restored; the
+// second result is false only if the item's been deleted for good.
+func currentReminderItem(ctx context.Context, reminder Reminder) (TodoItem, bool) {
+	if reminder.Key == "" {
+		return reminder.TodoItem, true
+	}
+	key, err := datastore.DecodeKey(reminder.Key)
+	if err != nil {
+		return reminder.TodoItem, true
+	}
+	item := readTodoItemWithTrash(ctx, TodoID(*key))
+	switch (*item).(type) {
+	case TodoItem:
+		return (*item).(TodoItem), true
+	case E:
+		if string((*item).(E)) == datastore.ErrNoSuchEntity.Error() {
+			return reminder.TodoItem, false
+		}
+	}
+	return reminder.TodoItem, true
+}
+
+// How long before an item's due date its reminder goes out
+const reminderLead = time.Hour
+
 func reminderDue(todoItem TodoItem) bool {
 	now := time.Now()
-	// returns true if it's less than an hour before the due date
-	return (todoItem.DueDate.Local().Sub(now).Minutes() <= 60)
+	// returns true if it's less than reminderLead before the due date
+	return (todoItem.DueDate.Local().Sub(now) <= reminderLead)
 }
 
 func sendReminderEmail(ctx context.Context,
@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 )
 
 func itemToJson(item TodoItem) *MaybeError {
@@ -62,3 +64,215 @@ func jsonToMatches(blob []byte) *MaybeError {
 	}
 	return result
 }
+
+func reminderToJson(reminder Reminder) *MaybeError {
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(reminder)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode reminder")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+// Also decodes reminders that were queued before they had a Key,
+// which just come back with Key == ""
+func jsonToReminder(blob []byte) *MaybeError {
+	d := json.NewDecoder(bytes.NewReader(blob))
+	var reminder = new(Reminder)
+	var result = new(MaybeError)
+	err := d.Decode(&reminder)
+	if err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = *reminder
+	}
+	return result
+}
+
+func itemDetailToJson(detail ItemDetail) *MaybeError {
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(detail)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode item detail")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+// What a todo item looks like in the JSON API: the item plus its ID, since
+// the item itself doesn't know its key
+type jsonItem struct {
+	ID   int64
+	Item TodoItem
+}
+
+func pageToJson(page Page) *MaybeError {
+	var items = make([]jsonItem, len(page.Items))
+	for i, m := range page.Items {
+		items[i] = jsonItem{m.Key.IntID(), m.Value}
+	}
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(struct {
+		Items []jsonItem
+		Next  string
+	}{items, page.Next})
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode page")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+func cacheStatsToJson(stats CacheStats) *MaybeError {
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(stats)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode cache stats")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+func accountArchiveToJson(archive AccountArchive) *MaybeError {
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(archive)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode account archive")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+func importResultToJson(done ImportResult) *MaybeError {
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(done)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode import result")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
+
+// Expects an object with any of the fields of an ItemPatch. DueDate can be
+// "2006-01-02" or RFC 3339.
+func jsonToItemPatch(blob []byte) *MaybeError {
+	var fields struct {
+		Description *string
+		DueDate     *string
+		State       *string
+		Notes       *string
+		Tags        *[]string
+	}
+	var result = new(MaybeError)
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var patch = ItemPatch{Description: fields.Description, Notes: fields.Notes, Tags: fields.Tags}
+	if fields.DueDate != nil {
+		d, err := parseDueDate(*fields.DueDate)
+		if err != nil {
+			*result = E(*fields.DueDate + " doesn't look like a valid date to me!")
+			return result
+		}
+		patch.DueDate = &d
+	}
+	if fields.State != nil {
+		state, ok := parseState(*fields.State)
+		if !ok {
+			*result = E(*fields.State + " isn't a state a todo item can be in")
+			return result
+		}
+		patch.State = &state
+	}
+	*result = patch
+	return result
+}
+
+// Decodes a new item from an API client, e.g.
+// {"Description": "buy milk", "DueDate": "2026-11-01", "ListID": 123}.
+// Only the description has to be there; it's due today if there's no
+// DueDate, and goes in their Inbox if there's no ListID.
+func jsonToNewItem(blob []byte, now time.Time) *MaybeError {
+	var fields struct {
+		Description string
+		DueDate     string
+		ListID      int64
+		Notes       string
+		Tags        []string
+	}
+	var result = new(MaybeError)
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	if strings.TrimSpace(fields.Description) == "" {
+		*result = E("What's the item?")
+		return result
+	}
+	item := TodoItem{
+		Description: fields.Description,
+		DueDate:     startOfDay(now),
+		State:       "incomplete",
+		ListID:      fields.ListID,
+		Notes:       fields.Notes,
+		Tags:        fields.Tags,
+	}
+	if fields.DueDate != "" {
+		d, err := parseDueDate(fields.DueDate)
+		if err != nil {
+			*result = E(fields.DueDate + " doesn't look like a valid date to me!")
+			return result
+		}
+		item.DueDate = d
+	}
+	*result = item
+	return result
+}
+
+func todoListsToJson(lists TodoLists) *MaybeError {
+	type jsonList struct {
+		ID   int64
+		List TodoList
+	}
+	var ls = make([]jsonList, len(lists))
+	for i, l := range lists {
+		ls[i] = jsonList{l.Key.IntID(), l.Value}
+	}
+	b := new(bytes.Buffer)
+	e := json.NewEncoder(b)
+	err := e.Encode(ls)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E("error trying to encode lists")
+		return result
+	}
+	var result = new(MaybeError)
+	*result = Blob(b.Bytes())
+	return result
+}
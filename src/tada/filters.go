@@ -0,0 +1,213 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Which items to show and what order to show them in.
+// The zero value shows everything in due date order.
+type ItemFilter struct {
+	HideCompleted bool
+	DueAfter      time.Time // only items due at or after this; zero means no limit
+	DueBefore     time.Time // only items due before this; zero means no limit
+	Sort          string    // one of the sortBy... constants; "" means sortByDueDate
+}
+
+const (
+	sortByDueDate     = "due"
+	sortByCreated     = "created"
+	sortByDescription = "description"
+)
+
+// The parameters filterFromRequest looks at, for keeping them in links
+var filterParams = []string{"show", "due", "from", "to", "sort"}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Gets the filter from the request's parameters:
+// show=all|incomplete
+// due=any|overdue|today|week|range (with from=YYYY-MM-DD and/or to=YYYY-MM-DD, both inclusive)
+// sort=due|created|description
+// now is a parameter for testing reasons
+func filterFromRequest(r *http.Request, now time.Time) (ItemFilter, error) {
+	var f ItemFilter
+	switch r.FormValue("show") {
+	case "", "all":
+	case "incomplete":
+		f.HideCompleted = true
+	default:
+		return f, fmt.Errorf("%s isn't something I know how to show", r.FormValue("show"))
+	}
+	today := startOfDay(now)
+	switch r.FormValue("due") {
+	case "", "any":
+	case "overdue":
+		// completed items aren't overdue, however late they were
+		f.HideCompleted = true
+		f.DueBefore = now
+	case "today":
+		f.DueAfter = today
+		f.DueBefore = today.AddDate(0, 0, 1)
+	case "week":
+		// Monday to Sunday
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		f.DueAfter = today.AddDate(0, 0, -daysSinceMonday)
+		f.DueBefore = f.DueAfter.AddDate(0, 0, 7)
+	case "range":
+		if s := r.FormValue("from"); s != "" {
+			d, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return f, fmt.Errorf("%s doesn't look like a valid date to me!", s)
+			}
+			f.DueAfter = d
+		}
+		if s := r.FormValue("to"); s != "" {
+			d, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return f, fmt.Errorf("%s doesn't look like a valid date to me!", s)
+			}
+			f.DueBefore = d.AddDate(0, 0, 1)
+		}
+	default:
+		return f, fmt.Errorf("%s isn't a due date filter I know about", r.FormValue("due"))
+	}
+	switch s := r.FormValue("sort"); s {
+	case "", sortByDueDate, sortByCreated, sortByDescription:
+		f.Sort = s
+	default:
+		return f, fmt.Errorf("I don't know how to sort by %s", s)
+	}
+	return f, nil
+}
+
+func (f ItemFilter) hasDateRange() bool {
+	return !f.DueAfter.IsZero() || !f.DueBefore.IsZero()
+}
+
+// Returns q (which shouldn't have an order yet) restricted and ordered by f.
+// The datastore can only sort by DueDate when there's a date range, so in
+// that case the query's in due date order and sortMatches has to finish the job.
+// See index.yaml for the indexes these need. n.b. entities without a property
+// aren't in its indexes, so old items only show up once migrateToInbox has
+// written them back.
+func applyFilter(q *datastore.Query, f ItemFilter) *datastore.Query {
+	if f.HideCompleted {
+		q = q.Filter("State=", "incomplete")
+	}
+	if !f.DueAfter.IsZero() {
+		q = q.Filter("DueDate>=", f.DueAfter)
+	}
+	if !f.DueBefore.IsZero() {
+		q = q.Filter("DueDate<", f.DueBefore)
+	}
+	if f.hasDateRange() {
+		return q.Order("DueDate")
+	}
+	switch f.Sort {
+	case sortByCreated:
+		return q.Order("-Created")
+	case sortByDescription:
+		return q.Order("Description")
+	default:
+		return q.Order("DueDate")
+	}
+}
+
+type byCreated []Match
+
+func (m byCreated) Len() int           { return len(m) }
+func (m byCreated) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byCreated) Less(i, j int) bool { return m[i].Value.Created.After(m[j].Value.Created) }
+
+type byDescription []Match
+
+func (m byDescription) Len() int      { return len(m) }
+func (m byDescription) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byDescription) Less(i, j int) bool {
+	return strings.ToLower(m[i].Value.Description) < strings.ToLower(m[j].Value.Description)
+}
+
+// Whether sortMatches has to do the sorting, because applyFilter couldn't
+func (f ItemFilter) sortsInMemory() bool {
+	return f.hasDateRange() && (f.Sort == sortByCreated || f.Sort == sortByDescription)
+}
+
+// Sorts matches the way f says to, for when applyFilter couldn't.
+// n.b. this only sorts the matches it's given, which is why
+// pageOfTodoItems doesn't page when f.sortsInMemory()
+func sortMatches(matches Matches, f ItemFilter) {
+	if !f.sortsInMemory() {
+		return
+	}
+	switch f.Sort {
+	case sortByCreated:
+		sort.Stable(byCreated(matches))
+	case sortByDescription:
+		sort.Stable(byDescription(matches))
+	}
+}
+
+// Sorts matches the way f says to whatever order they're in, for when
+// they came from more than one query
+func sortAllMatches(matches Matches, f ItemFilter) {
+	switch f.Sort {
+	case sortByCreated:
+		sort.Stable(byCreated(matches))
+	case sortByDescription:
+		sort.Stable(byDescription(matches))
+	default:
+		sort.Stable(byDueDate(matches))
+	}
+}
+
+// writes the controls for filtering and sorting, with the current choices selected
+func makeFilterForm(w http.ResponseWriter, r *http.Request) {
+	const form = `
+ <form action="/" method="get">
+   show: <select name="show">
+     <option value="all">everything</option>
+     <option value="incomplete"{{if Equal .Show "incomplete"}} selected{{end}}>incomplete only</option>
+   </select>
+   due: <select name="due">
+     <option value="any">any time</option>
+     <option value="overdue"{{if Equal .Due "overdue"}} selected{{end}}>overdue</option>
+     <option value="today"{{if Equal .Due "today"}} selected{{end}}>today</option>
+     <option value="week"{{if Equal .Due "week"}} selected{{end}}>this week</option>
+     <option value="range"{{if Equal .Due "range"}} selected{{end}}>between</option>
+   </select>
+   <input type="date" name="from" value="{{.From}}"> and <input type="date" name="to" value="{{.To}}">
+   sort by: <select name="sort">
+     <option value="due">due date</option>
+     <option value="created"{{if Equal .Sort "created"}} selected{{end}}>newest first</option>
+     <option value="description"{{if Equal .Sort "description"}} selected{{end}}>description</option>
+   </select>
+   <input hidden=true name="list" value="{{.List}}">
+   <input hidden=true name="view" value="{{.View}}">
+   <input type="submit" value="Show">
+ </form>
+`
+	t, err := template.New("filterForm").Funcs(template.FuncMap{
+		"Equal": func(a, b string) bool { return a == b },
+	}).Parse(form)
+	if !handleError(w, err) {
+		handleError(w, t.Execute(w, map[string]string{
+			"Show": r.FormValue("show"),
+			"Due":  r.FormValue("due"),
+			"From": r.FormValue("from"),
+			"To":   r.FormValue("to"),
+			"Sort": r.FormValue("sort"),
+			"List": r.FormValue("list"),
+			"View": r.FormValue("view"),
+		}))
+	}
+}
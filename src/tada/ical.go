@@ -0,0 +1,324 @@
+// +build !appengine
+package tada
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/calendar/", calendarHandler)
+	http.HandleFunc("/calendarFeed", calendarFeedHandler)
+	http.HandleFunc("/resetCalendarFeed", resetCalendarFeedHandler)
+}
+
+const calendarDomain = "tada-1202.appspot.com"
+
+// Items due at midnight UTC came from a date-only form field, so they're
+// due some time that day rather than at a particular time
+func isTimed(item TodoItem) bool {
+	d := item.DueDate.UTC()
+	return d.Hour() != 0 || d.Minute() != 0 || d.Second() != 0
+}
+
+// Escapes a TEXT value the way RFC 5545 says to
+func icalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// Writes one content line, folded so no line is longer than 75 octets
+func writeICalLine(w io.Writer, line string) {
+	for len(line) > 75 {
+		cut := 75
+		// don't split a UTF-8 sequence
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		fmt.Fprint(w, line[:cut]+"\r\n")
+		line = " " + line[cut:]
+	}
+	fmt.Fprint(w, line+"\r\n")
+}
+
+// Writes items as an iCalendar file. Items due at a particular time are
+// VEVENTs so they show up at that time, unless todosOnly is set; the rest are
+// VTODOs due on their date. now is for DTSTAMP on items from before there
+// was UpdatedAt.
+func writeICal(w io.Writer, items Matches, now time.Time, todosOnly bool) {
+	writeICalLine(w, "BEGIN:VCALENDAR")
+	writeICalLine(w, "VERSION:2.0")
+	writeICalLine(w, "PRODID:-//Tada//Tada todo list//EN")
+	writeICalLine(w, "X-WR-CALNAME:Tada")
+	for _, m := range items {
+		writeICalItem(w, m, now, todosOnly)
+	}
+	writeICalLine(w, "END:VCALENDAR")
+}
+
+// The UID a calendar client knows the item by: whatever it said when it
+// created the item (see caldav.go), or one made from its ID
+func icalUID(m Match) string {
+	if m.Value.ICalUID != "" {
+		return m.Value.ICalUID
+	}
+	return fmt.Sprintf("%d@%s", m.Key.IntID(), calendarDomain)
+}
+
+// Writes one item as a VTODO or VEVENT; see writeICal. Incomplete items get an
+// alarm at the same time the reminder emails go out.
+func writeICalItem(w io.Writer, m Match, now time.Time, todosOnly bool) {
+	const stamp = "20060102T150405Z"
+	line := func(format string, a ...interface{}) {
+		writeICalLine(w, fmt.Sprintf(format, a...))
+	}
+	item := m.Value
+	updated := item.UpdatedAt
+	if updated.IsZero() {
+		updated = now
+	}
+	kind := "VTODO"
+	if isTimed(item) && !todosOnly {
+		kind = "VEVENT"
+	}
+	line("BEGIN:%s", kind)
+	line("UID:%s", icalText(icalUID(m)))
+	line("DTSTAMP:%s", updated.UTC().Format(stamp))
+	line("SEQUENCE:%d", item.Version)
+	line("SUMMARY:%s", icalText(item.Description))
+	if item.Notes != "" {
+		line("DESCRIPTION:%s", icalText(item.Notes))
+	}
+	if len(item.Tags) > 0 {
+		var tags = make([]string, len(item.Tags))
+		for i, t := range item.Tags {
+			tags[i] = icalText(t)
+		}
+		line("CATEGORIES:%s", strings.Join(tags, ","))
+	}
+	trigger := "TRIGGER;RELATED=END"
+	if kind == "VEVENT" {
+		line("DTSTART:%s", item.DueDate.UTC().Format(stamp))
+		// VEVENTs don't have a "done"; a finished one is still something
+		// that happened
+		line("STATUS:CONFIRMED")
+		trigger = "TRIGGER"
+	} else {
+		if isTimed(item) {
+			line("DUE:%s", item.DueDate.UTC().Format(stamp))
+		} else {
+			line("DUE;VALUE=DATE:%s", item.DueDate.UTC().Format("20060102"))
+		}
+		if item.State == "completed" {
+			line("STATUS:COMPLETED")
+			line("COMPLETED:%s", updated.UTC().Format(stamp))
+		} else {
+			line("STATUS:NEEDS-ACTION")
+		}
+	}
+	if item.State != "completed" {
+		line("BEGIN:VALARM")
+		line("ACTION:DISPLAY")
+		line("DESCRIPTION:%s", icalText(item.Description))
+		line("%s:-PT%dM", trigger, int(reminderLead.Minutes()))
+		line("END:VALARM")
+	}
+	line("END:%s", kind)
+}
+
+// What parseVTODO found in a VTODO. Fields that weren't there are nil.
+type ICalTodo struct {
+	UID         string
+	Description *string // from SUMMARY
+	DueDate     *time.Time
+	State       *string // from STATUS
+	Notes       *string // from DESCRIPTION
+	Tags        []string
+}
+
+func (t ICalTodo) isMaybeError() {}
+
+// Undoes icalText
+func icalUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// Parses the first VTODO in an iCalendar file, the way calendar clients
+// send them to CalDAV servers. Only knows about the properties Tada has
+// somewhere to put.
+func parseVTODO(data string) *MaybeError {
+	var result = new(MaybeError)
+	// unfold: a line starting with a space or tab continues the one before
+	data = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(data)
+	var todo ICalTodo
+	var inTodo, found bool
+	var depth int // of components nested in the VTODO, like VALARMs
+	for _, l := range strings.Split(data, "\n") {
+		l = strings.TrimRight(l, "\r")
+		colon := strings.Index(l, ":")
+		if colon < 0 {
+			continue
+		}
+		nameAndParams, value := l[:colon], l[colon+1:]
+		parts := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(parts[0])
+		params := map[string]string{}
+		for _, p := range parts[1:] {
+			if eq := strings.Index(p, "="); eq > 0 {
+				params[strings.ToUpper(p[:eq])] = strings.Trim(p[eq+1:], `"`)
+			}
+		}
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VTODO" && !found:
+			inTodo, found = true, true
+			continue
+		case !inTodo:
+			continue
+		case name == "BEGIN":
+			depth++
+			continue
+		case name == "END" && depth > 0:
+			depth--
+			continue
+		case name == "END":
+			inTodo = false
+			continue
+		case depth > 0:
+			continue
+		}
+		switch name {
+		case "UID":
+			todo.UID = icalUnescape(value)
+		case "SUMMARY":
+			s := icalUnescape(value)
+			todo.Description = &s
+		case "DESCRIPTION":
+			s := icalUnescape(value)
+			todo.Notes = &s
+		case "STATUS":
+			s := "incomplete"
+			if strings.ToUpper(value) == "COMPLETED" {
+				s = "completed"
+			}
+			todo.State = &s
+		case "CATEGORIES":
+			for _, t := range splitICalList(value) {
+				if t = strings.TrimSpace(icalUnescape(t)); t != "" {
+					todo.Tags = append(todo.Tags, t)
+				}
+			}
+		case "DUE":
+			d, err := parseICalTime(value, params)
+			if err != nil {
+				*result = E(err.Error())
+				return result
+			}
+			todo.DueDate = &d
+		}
+	}
+	if !found {
+		*result = E("there's no VTODO in that")
+		return result
+	}
+	*result = todo
+	return result
+}
+
+// Splits a list value like CATEGORIES on its commas, but not escaped ones
+func splitICalList(value string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+		} else if value[i] == ',' {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// Parses a DATE or DATE-TIME value, in the time zone from its TZID
+// parameter if it has one and we know it
+func parseICalTime(value string, params map[string]string) (time.Time, error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		return time.Parse("20060102", value)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	loc := time.UTC
+	if tzid, ok := params["TZID"]; ok {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+// Serves /calendar/{token}.ics: everything the token's owner can see
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+	email, err := emailForToken(ctx, feedTokenKind, token)
+	if handleError(w, err) {
+		return
+	}
+	if email == "" {
+		http.Error(w, "There's no calendar here", http.StatusNotFound)
+		return
+	}
+	items := listTodoItems(ctx, &user.User{Email: email})
+	switch (*items).(type) {
+	case Matches:
+		b := new(bytes.Buffer)
+		writeICal(b, (*items).(Matches), time.Now(), false)
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write(b.Bytes())
+	default:
+		respondWith(w, *items)
+	}
+}
+
+func calendarFeedURL(r *http.Request, token SecretToken) string {
+	return fmt.Sprintf("https://%s/calendar/%s.ics", r.Host, token.Token)
+}
+
+// Shows the current user their feed URL
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	token := secretToken(ctx, feedTokenKind, user.Current(ctx).Email, false)
+	switch (*token).(type) {
+	case SecretToken:
+		feedURL := calendarFeedURL(r, (*token).(SecretToken))
+		fmt.Fprintf(w, `<html><h1>Your calendar feed</h1>
+<p>Subscribe to this in your calendar app to see your todo items there.
+Anybody who has it can see your items, so keep it to yourself.</p>
+<p><a href="%s">%s</a></p>
+ <form action="/resetCalendarFeed" method="post">
+   <input type="submit" value="Make a new URL (the old one stops working)">
+ </form>
+<a href="/">Back to your lists</a>
+</html>`, feedURL, feedURL)
+	default:
+		respondWith(w, *token)
+	}
+}
+
+func resetCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	token := secretToken(ctx, feedTokenKind, user.Current(ctx).Email, true)
+	switch (*token).(type) {
+	case SecretToken:
+		http.Redirect(w, r, "/calendarFeed", http.StatusSeeOther)
+	default:
+		respondWith(w, *token)
+	}
+}
@@ -0,0 +1,687 @@
+// +build !appengine
+package tada
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+// Importing from other task managers, for people moving to Tada. Uploading
+// a file parses it and starts an ImportJob, which the imports queue runs a
+// batch at a time, skipping anything that's already here.
+
+func init() {
+	http.HandleFunc("/importFrom", importFromHandler)
+	http.HandleFunc("/importJob", importJobHandler)
+	http.HandleFunc("/tasks/runImport", runImportHandler)
+}
+
+// What can be imported, and what the importer page calls them
+const (
+	sourceGoogleTasks = "gtasks"
+	sourceTodoist     = "todoist"
+	sourceTaskwarrior = "taskwarrior"
+)
+
+var importSources = map[string]string{
+	sourceGoogleTasks: "Google Tasks (Tasks.json from Google Takeout)",
+	sourceTodoist:     "Todoist (a project exported as CSV)",
+	sourceTaskwarrior: "Taskwarrior (task export)",
+}
+
+// An import that's running or has finished. The items to import are in
+// Items as JSON, with their lists already worked out; Next is how far the
+// job's got through them.
+type ImportJob struct {
+	OwnerEmail string
+	Source     string // one of the source... constants
+	ListID     int64  // where items go if the file doesn't say
+	Remind     bool
+	Items      []byte     `datastore:",noindex"`
+	Total      int        // how many items there are to import
+	Next       int        // index in Items of the next one to import
+	Created    int        // how many items the job made
+	Duplicates int        // how many it skipped because they were already here
+	Errors     []RowError `datastore:",noindex"` // rows that couldn't be read or saved
+	Started    time.Time
+	Finished   time.Time // zero while it's still running
+	FirstID    int64     // item i in Items is saved with ID FirstID+i; 0 for older jobs
+}
+
+type ImportJobID int64
+
+func (j ImportJob) isMaybeError()   {}
+func (j ImportJobID) isMaybeError() {}
+
+func (j ImportJob) Done() bool {
+	return !j.Finished.IsZero()
+}
+
+// Datastore entities can't be bigger than a megabyte, and Items has to fit
+// in one along with everything else
+const maxImportJobBytes = 900 * 1024
+
+// The last line of defense against dates like "every other tuesday": the
+// item's due today, and the date goes in its notes so nothing's lost
+func keepUnknownDate(item *TodoItem, app string, date string, today time.Time) {
+	item.DueDate = startOfDay(today)
+	if item.Notes != "" {
+		item.Notes += "\n"
+	}
+	item.Notes += app + " due date: " + date
+}
+
+// Google Tasks Takeout is {"items": [task lists]}, and each task list has
+// "items" too. Task lists become lists with the same name.
+type googleTaskLists struct {
+	Items []struct {
+		Title string
+		Items []struct {
+			ID      string
+			Title   string
+			Notes   string
+			Status  string // "needsAction" or "completed"
+			Due     string // RFC 3339, but only the date means anything
+			Created string
+			Deleted bool
+		}
+	}
+}
+
+// Parses a Google Tasks Takeout file. Deleted tasks are left out.
+// Rows count tasks across all the task lists, starting from 1.
+func parseGoogleTasks(r io.Reader, today time.Time) ([]ImportedItem, []RowError) {
+	var lists googleTaskLists
+	if err := json.NewDecoder(r).Decode(&lists); err != nil {
+		return nil, []RowError{{1, "that doesn't look like Google Tasks JSON to me: " + err.Error()}}
+	}
+	var items []ImportedItem
+	var errors []RowError
+	row := 0
+	for _, l := range lists.Items {
+		for _, task := range l.Items {
+			row++
+			if task.Deleted {
+				continue
+			}
+			item := TodoItem{
+				Description: strings.TrimSpace(task.Title),
+				DueDate:     startOfDay(today),
+				State:       "incomplete",
+				Notes:       task.Notes,
+			}
+			if item.Description == "" {
+				errors = append(errors, RowError{row, "the title is empty"})
+				continue
+			}
+			if task.ID != "" {
+				item.ImportID = sourceGoogleTasks + ":" + task.ID
+			}
+			if task.Status == "completed" {
+				item.State = "completed"
+			}
+			if task.Due != "" {
+				d, err := time.Parse(time.RFC3339, task.Due)
+				if err != nil {
+					keepUnknownDate(&item, "Google Tasks", task.Due, today)
+				} else {
+					item.DueDate = startOfDay(d.UTC())
+				}
+			}
+			if created, err := time.Parse(time.RFC3339, task.Created); err == nil {
+				item.Created = created
+			}
+			items = append(items, ImportedItem{Row: row, Item: item, Project: l.Title})
+		}
+	}
+	return items, errors
+}
+
+// Todoist's priorities go from 1 (the most important) to 4 (not at all)
+var todoistPriorities = map[string]string{"1": "A", "2": "B", "3": "C"}
+
+// The date formats Todoist uses when the date isn't something like "every day"
+var todoistDateFormats = []string{"2006-01-02", "2006-01-02 15:04", "Jan 2 2006", "Jan 2, 2006", "2 Jan 2006"}
+
+// Parses a Todoist project exported as CSV: a header row with TYPE, CONTENT,
+// DESCRIPTION, PRIORITY and DATE columns, among others, then a row for
+// each task, note and section. @labels in a task become tags, and notes are
+// added to the notes of the task before them. n.b. sections and subtasks
+// aren't a thing here, so everything just goes in the one list.
+func parseTodoistCSV(r io.Reader, today time.Time) ([]ImportedItem, []RowError) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	header, err := in.Read()
+	if err != nil {
+		return nil, []RowError{{1, "couldn't read the header row: " + err.Error()}}
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToUpper(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["CONTENT"]; !ok {
+		return nil, []RowError{{1, "there's no CONTENT column; is that a Todoist export?"}}
+	}
+	var items []ImportedItem
+	var errors []RowError
+	for row := 2; ; row++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errors = append(errors, RowError{row, err.Error()})
+			if _, ok := err.(*csv.ParseError); !ok {
+				break
+			}
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		switch strings.ToLower(field("TYPE")) {
+		case "task", "":
+		case "note":
+			if len(items) > 0 && field("CONTENT") != "" {
+				last := &items[len(items)-1].Item
+				if last.Notes != "" {
+					last.Notes += "\n"
+				}
+				last.Notes += field("CONTENT")
+			}
+			continue
+		default:
+			continue
+		}
+		if len(items)+len(errors) >= maxImportRows {
+			errors = append(errors, RowError{row, fmt.Sprintf("that's more than %d rows; split the file up", maxImportRows)})
+			break
+		}
+		item := TodoItem{
+			DueDate:  startOfDay(today),
+			State:    "incomplete",
+			Notes:    field("DESCRIPTION"),
+			Priority: todoistPriorities[field("PRIORITY")],
+		}
+		var words []string
+		for _, word := range strings.Fields(field("CONTENT")) {
+			if len(word) > 1 && word[0] == '@' {
+				item.Tags = append(item.Tags, word[1:])
+			} else {
+				words = append(words, word)
+			}
+		}
+		item.Description = strings.Join(words, " ")
+		if item.Description == "" {
+			if field("CONTENT") != "" || field("TYPE") != "" {
+				errors = append(errors, RowError{row, "the content is empty"})
+			}
+			continue
+		}
+		if date := field("DATE"); date != "" {
+			parsed := false
+			for _, format := range todoistDateFormats {
+				if d, err := time.Parse(format, date); err == nil {
+					item.DueDate, parsed = d, true
+					break
+				}
+			}
+			if !parsed {
+				keepUnknownDate(&item, "Todoist", date, today)
+			}
+		}
+		// Todoist doesn't export IDs, so make one up from what's in the row
+		// as it was exported; startImportJob adds the list to it
+		item.ImportID = todoistImportID(field("CONTENT"), field("DATE"))
+		items = append(items, ImportedItem{Row: row, Item: item})
+	}
+	return items, errors
+}
+
+// An ImportID for a Todoist task that's the same every time it's exported,
+// as long as it says the same thing and has the same due date. n.b. the raw
+// DATE, so "every day" doesn't turn into a different day each time.
+func todoistImportID(content string, date string) string {
+	return fmt.Sprintf("%s:%x", sourceTodoist, sha1.Sum([]byte(content+"\x00"+date)))
+}
+
+// One task from "task export"
+type taskwarriorTask struct {
+	UUID        string
+	Description string
+	Status      string // pending, waiting, completed, deleted or recurring
+	Entry       string // when it was made
+	Due         string
+	Project     string
+	Priority    string // H, M or L
+	Tags        []string
+	Annotations []struct {
+		Description string
+	}
+}
+
+var taskwarriorPriorities = map[string]string{"H": "A", "M": "B", "L": "C"}
+
+const taskwarriorTime = "20060102T150405Z"
+
+// Parses the output of "task export": either a JSON array of tasks, or one
+// task per line the way older versions did it. Projects become lists, and
+// annotations become notes. Deleted tasks and the templates recurring tasks
+// are made from are left out.
+func parseTaskwarrior(r io.Reader, today time.Time) ([]ImportedItem, []RowError) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, []RowError{{1, err.Error()}}
+	}
+	var tasks []taskwarriorTask
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &tasks)
+	} else {
+		d := json.NewDecoder(bytes.NewReader(trimmed))
+		for d.More() {
+			var task taskwarriorTask
+			if err = d.Decode(&task); err != nil {
+				break
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	if err != nil {
+		return nil, []RowError{{len(tasks) + 1, "that doesn't look like Taskwarrior JSON to me: " + err.Error()}}
+	}
+	var items []ImportedItem
+	var errors []RowError
+	for i, task := range tasks {
+		row := i + 1
+		if task.Status == "deleted" || task.Status == "recurring" {
+			continue
+		}
+		if len(items)+len(errors) >= maxImportRows {
+			errors = append(errors, RowError{row, fmt.Sprintf("that's more than %d tasks; export them a project at a time", maxImportRows)})
+			break
+		}
+		item := TodoItem{
+			Description: strings.TrimSpace(task.Description),
+			DueDate:     startOfDay(today),
+			State:       "incomplete",
+			Priority:    taskwarriorPriorities[task.Priority],
+			Tags:        task.Tags,
+		}
+		if item.Description == "" {
+			errors = append(errors, RowError{row, "the description is empty"})
+			continue
+		}
+		if task.UUID != "" {
+			item.ImportID = sourceTaskwarrior + ":" + task.UUID
+		}
+		if task.Status == "completed" {
+			item.State = "completed"
+		}
+		if task.Due != "" {
+			d, err := time.Parse(taskwarriorTime, task.Due)
+			if err != nil {
+				keepUnknownDate(&item, "Taskwarrior", task.Due, today)
+			} else {
+				item.DueDate = d
+			}
+		}
+		if entry, err := time.Parse(taskwarriorTime, task.Entry); err == nil {
+			item.Created = entry
+		}
+		var notes []string
+		for _, a := range task.Annotations {
+			notes = append(notes, a.Description)
+		}
+		if item.Notes != "" {
+			notes = append([]string{item.Notes}, notes...)
+		}
+		item.Notes = strings.Join(notes, "\n")
+		items = append(items, ImportedItem{Row: row, Item: item, Project: task.Project})
+	}
+	return items, errors
+}
+
+func parseImport(source string, r io.Reader, today time.Time) ([]ImportedItem, []RowError) {
+	switch source {
+	case sourceGoogleTasks:
+		return parseGoogleTasks(r, today)
+	case sourceTodoist:
+		return parseTodoistCSV(r, today)
+	case sourceTaskwarrior:
+		return parseTaskwarrior(r, today)
+	}
+	return nil, []RowError{{1, source + " isn't something we know how to import"}}
+}
+
+// How descriptions are compared when deciding whether two items are the
+// same, in dedupeImports and alreadyImported
+func importDescriptionKey(description string) string {
+	return strings.ToLower(strings.TrimSpace(description))
+}
+
+// What makes two items the same, for dedupeImports: where they came from if
+// we know, or else what they say, when they're due and where they are
+func importDedupeKey(item TodoItem) string {
+	if item.ImportID != "" {
+		return item.ImportID
+	}
+	return fmt.Sprintf("%d|%s|%s", item.ListID, importDescriptionKey(item.Description), item.DueDate.UTC().Format(time.RFC3339))
+}
+
+// Leaves out items that are in items more than once, after the first.
+// Returns the rest and how many it left out.
+func dedupeImports(items []ImportedItem) ([]ImportedItem, int) {
+	seen := map[string]bool{}
+	var rest []ImportedItem
+	for _, imported := range items {
+		k := importDedupeKey(imported.Item)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rest = append(rest, imported)
+	}
+	return rest, len(items) - len(rest)
+}
+
+// Returns whether email already has item: one with the same ImportID, or
+// if it doesn't have one, one with the same description (see
+// importDescriptionKey) and due date in the same list. Items in the trash
+// count, so importing again doesn't bring back things people deleted on purpose.
+func alreadyImported(ctx context.Context, email string, item TodoItem) (bool, error) {
+	q := datastore.NewQuery("TodoItem").Filter("OwnerEmail=", email)
+	if item.ImportID != "" {
+		keys, err := q.Filter("ImportID=", item.ImportID).KeysOnly().Limit(1).GetAll(ctx, nil)
+		return len(keys) > 0, err
+	}
+	// the datastore can't compare descriptions the way importDescriptionKey
+	// does, so get everything due then and compare them here
+	var due []TodoItem
+	if _, err := q.Filter("ListID=", item.ListID).Filter("DueDate=", item.DueDate).GetAll(ctx, &due); err != nil {
+		return false, err
+	}
+	for _, existing := range due {
+		if importDescriptionKey(existing.Description) == importDescriptionKey(item.Description) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Starts an import of items for u, into the list with ID listID unless
+// they say otherwise. errors are the rows that couldn't be read, so the job
+// can show them. Returns the job's ID.
+func startImportJob(ctx context.Context, u *user.User, source string, listID int64, items []ImportedItem, errors []RowError, remind bool) *MaybeError {
+	var result = new(MaybeError)
+	assigned := assignProjectLists(ctx, u, items)
+	switch (*assigned).(type) {
+	case Ok:
+	default:
+		return assigned
+	}
+	for i := range items {
+		if items[i].Item.ListID == 0 {
+			items[i].Item.ListID = listID
+		}
+		// a Todoist export is one project, and the list stands in for it,
+		// so the same task in two projects doesn't look like a duplicate
+		if source == sourceTodoist {
+			items[i].Item.ImportID += ":" + strconv.FormatInt(items[i].Item.ListID, 10)
+		}
+	}
+	items, duplicates := dedupeImports(items)
+	blob, err := json.Marshal(items)
+	if err == nil && len(blob) > maxImportJobBytes {
+		err = fmt.Errorf("that's too much to import at once; try it a bit at a time")
+	}
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	job := ImportJob{
+		OwnerEmail: u.Email,
+		Source:     source,
+		ListID:     listID,
+		Remind:     remind,
+		Items:      blob,
+		Total:      len(items),
+		Duplicates: duplicates,
+		Errors:     errors,
+		Started:    time.Now(),
+	}
+	if len(items) == 0 {
+		job.Finished = job.Started
+	} else {
+		// n.b. the datastore never hands these out for anything else
+		job.FirstID, _, err = datastore.AllocateIDs(ctx, "TodoItem", nil, len(items))
+		if err != nil {
+			*result = E(err.Error())
+			return result
+		}
+	}
+	k, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "ImportJob", nil), &job)
+	if err == nil && !job.Done() {
+		err = queueImportBatch(ctx, k.IntID())
+	}
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	*result = ImportJobID(k.IntID())
+	return result
+}
+
+func queueImportBatch(ctx context.Context, jobID int64) error {
+	t := taskqueue.NewPOSTTask("/tasks/runImport", url.Values{"id": {strconv.FormatInt(jobID, 10)}})
+	_, err := taskqueue.Add(ctx, t, "imports")
+	return err
+}
+
+// Imports the next importBatchSize items of the job with ID jobID, then
+// queues the next batch if there is one. Every row has its own ID reserved
+// when the job started, so if the task gets retried after saving some of
+// the batch, a Get by key finds them and they aren't saved twice.
+func runImportBatch(ctx context.Context, jobID int64) error {
+	k := datastore.NewKey(ctx, "ImportJob", "", jobID, nil)
+	var job ImportJob
+	if err := datastore.Get(ctx, k, &job); err != nil {
+		return err
+	}
+	if job.Done() {
+		return nil
+	}
+	var items []ImportedItem
+	if err := json.Unmarshal(job.Items, &items); err != nil {
+		return err
+	}
+	u := &user.User{Email: job.OwnerEmail}
+	end := job.Next + importBatchSize
+	if end > len(items) {
+		end = len(items)
+	}
+	for i := job.Next; i < end; i++ {
+		imported := items[i]
+		key := datastore.NewIncompleteKey(ctx, "TodoItem", nil)
+		if job.FirstID != 0 {
+			key = todoItemKey(ctx, job.FirstID+int64(i))
+			err := datastore.Get(ctx, key, &TodoItem{})
+			if err == nil { // saved by an earlier try at this batch
+				job.Created++
+				continue
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		dup, err := alreadyImported(ctx, u.Email, imported.Item)
+		if err != nil {
+			return err
+		}
+		if dup {
+			job.Duplicates++
+			continue
+		}
+		id := writeNewTodoItemWithKey(ctx, key, imported.Item, u, job.Remind)
+		switch (*id).(type) {
+		case TodoID:
+			job.Created++
+		default:
+			job.Errors = append(job.Errors, RowError{imported.Row, fmt.Sprint(*id)})
+		}
+	}
+	job.Next = end
+	if job.Next >= len(items) {
+		job.Finished = time.Now()
+	}
+	if _, err := datastore.Put(ctx, k, &job); err != nil {
+		return err
+	}
+	log(fmt.Sprintf("import job %d: %d of %d", jobID, job.Next, job.Total))
+	if !job.Done() {
+		return queueImportBatch(ctx, jobID)
+	}
+	return nil
+}
+
+// Run by the imports queue. An error makes the queue try again.
+func runImportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	id := r.FormValue("id")
+	jobID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		// trying again won't help
+		log(id + " doesn't look like an import job ID")
+		return
+	}
+	if err := runImportBatch(ctx, jobID); err != nil {
+		log(fmt.Sprintf("import job %d failed: %s", jobID, err.Error()))
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+const importFromTemplate = `<html><h1>Import from another app</h1>
+<p>Anything that's already here gets skipped, so it's safe to import the
+same file again. Projects and task lists become lists with the same names.</p>
+ <form action="/importFrom" method="post" enctype="multipart/form-data">
+   <select name="source">
+{{range $source, $name := .Sources}}     <option value="{{$source}}">{{$name}}</option>
+{{end}}   </select>
+   <input type="file" name="file">
+   Anything without a list goes in <select name="list">
+{{range .Lists}}     <option value="{{.Key.IntID}}"{{if eq .Key.IntID $.ListID}} selected{{end}}>{{.Value.Name}}</option>
+{{end}}   </select>
+   <label><input type="checkbox" name="remind"> Email reminders</label>
+   <input type="submit" value="Import">
+ </form>
+<a href="/?list={{.ListID}}">Back to your lists</a>
+</html>
+`
+
+var importFromT = template.Must(template.New("importFrom").Parse(importFromTemplate))
+
+// GET shows the form; POST expects a "source" (one of the source...
+// constants), a "file", the "list" for items that don't say, and "remind" if
+// they should get reminders. Starts the job and goes to its page.
+func importFromHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := user.Current(ctx)
+	listID, _ := strconv.ParseInt(r.FormValue("list"), 10, 64)
+	if r.Method != "POST" {
+		lists := visibleTodoLists(ctx, u)
+		switch (*lists).(type) {
+		case TodoLists:
+			handleError(w, importFromT.Execute(w, struct {
+				Sources map[string]string
+				Lists   TodoLists
+				ListID  int64
+			}{importSources, (*lists).(TodoLists), listID}))
+		default:
+			respondWith(w, *lists)
+		}
+		return
+	}
+	if !canEdit(listRole(ctx, u.Email, listID)) {
+		http.Error(w, "You can't add items to that list", http.StatusForbidden)
+		return
+	}
+	source := r.FormValue("source")
+	if _, ok := importSources[source]; !ok {
+		http.Error(w, source+" isn't something we know how to import", 400)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Pick a file to import", 400)
+		return
+	}
+	defer file.Close()
+	items, errors := parseImport(source, file, time.Now())
+	job := startImportJob(ctx, u, source, listID, items, errors, r.FormValue("remind") != "")
+	switch (*job).(type) {
+	case ImportJobID:
+		http.Redirect(w, r, fmt.Sprintf("/importJob?id=%d", (*job).(ImportJobID)), http.StatusSeeOther)
+	default:
+		respondWith(w, *job)
+	}
+}
+
+const importJobTemplate = `<html>{{if not .Job.Done}}<head><meta http-equiv="refresh" content="2"></head>
+{{end}}<h1>Importing from {{.Source}}</h1>
+<p>{{if .Job.Done}}Finished.{{else}}Still going...{{end}}
+Imported {{.Job.Created}} of {{.Job.Total}} items{{if .Job.Duplicates}}, and skipped {{.Job.Duplicates}} that were already here{{end}}.</p>
+{{if .Job.Errors}}<p>These didn't get imported:</p>
+<ul>
+{{range .Job.Errors}}<li>Row {{.Row}}: {{.Message}}</li>
+{{end}}</ul>
+{{end}}<a href="/?list={{.Job.ListID}}">Back to your lists</a>
+</html>
+`
+
+var importJobT = template.Must(template.New("importJob").Parse(importJobTemplate))
+
+// Shows how the import job in the "id" parameter is going. Only whoever
+// started it can see it.
+func importJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := user.Current(ctx)
+	id := r.FormValue("id")
+	jobID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an import job ID to me!", 400)
+		return
+	}
+	var job ImportJob
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "ImportJob", "", jobID, nil), &job)
+	if err == datastore.ErrNoSuchEntity || (err == nil && job.OwnerEmail != u.Email) {
+		http.Error(w, "There's no import job here", http.StatusNotFound)
+		return
+	}
+	if handleError(w, err) {
+		return
+	}
+	handleError(w, importJobT.Execute(w, struct {
+		Job    ImportJob
+		Source string
+	}{job, importSources[job.Source]}))
+}
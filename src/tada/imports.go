@@ -0,0 +1,242 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+// What's wrong with one row (or line, or entry) of a file somebody's
+// importing. Row counts from 1, the way spreadsheets and editors do.
+type RowError struct {
+	Row     int
+	Message string
+}
+
+// How an import went: how many items it made, and the rows it couldn't
+type ImportResult struct {
+	Created int
+	Errors  []RowError
+}
+
+func (r ImportResult) isMaybeError() {}
+
+// One item from a file somebody's importing, with the row it came from
+type ImportedItem struct {
+	Row     int
+	Item    TodoItem // just the fields from the file; writeNewTodoItem does the rest
+	Project string   // the name of the list it goes in, if the file says; see assignProjectLists
+}
+
+// Sets the list of each item with a Project to u's list with that name,
+// ignoring case and the difference between spaces and dashes, making the
+// list if there isn't one. Lists u can't add to don't count.
+func assignProjectLists(ctx context.Context, u *user.User, items []ImportedItem) *MaybeError {
+	lists := visibleTodoLists(ctx, u)
+	switch (*lists).(type) {
+	case TodoLists:
+	default:
+		return lists
+	}
+	listName := func(name string) string {
+		return strings.ToLower(strings.Join(strings.Fields(strings.Replace(name, "-", " ", -1)), " "))
+	}
+	byName := map[string]int64{}
+	var sortOrder int64
+	for _, l := range (*lists).(TodoLists) {
+		if canEdit(listRole(ctx, u.Email, l.Key.IntID())) {
+			byName[listName(l.Value.Name)] = l.Key.IntID()
+		}
+		if l.Value.OwnerEmail == u.Email && l.Value.SortOrder >= sortOrder {
+			sortOrder = l.Value.SortOrder + 1
+		}
+	}
+	for i, imported := range items {
+		if imported.Project == "" {
+			continue
+		}
+		id, ok := byName[listName(imported.Project)]
+		if !ok {
+			made := writeTodoList(ctx, u, imported.Project, defaultListColor, sortOrder)
+			switch (*made).(type) {
+			case TodoListID:
+				k := datastore.Key((*made).(TodoListID))
+				id = k.IntID()
+				byName[listName(imported.Project)] = id
+				sortOrder++
+			default:
+				return made
+			}
+		}
+		items[i].Item.ListID = id
+	}
+	var result = new(MaybeError)
+	*result = Ok{}
+	return result
+}
+
+// How many imported items to save at once, with one PutMulti, one search
+// index PutMulti and one taskqueue AddMulti. n.b. the task queue only takes
+// 100 tasks per AddMulti.
+const importBatchSize = 100
+
+// Saves items as new items owned by u, in the list with ID listID unless
+// they already say which list they go in, queueing
+// reminders for them if remind is set. Stops at the first batch that fails,
+// so the result says exactly which rows didn't get in.
+func importItems(ctx context.Context, u *user.User, listID int64, items []ImportedItem, remind bool) *MaybeError {
+	var result = new(MaybeError)
+	var done ImportResult
+	var editable = make(map[int64]bool)
+	for start := 0; start < len(items); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := items[start:end]
+		// writeNewTodoItem checks this for each item; do it up front, and
+		// save whatever's before the first one that fails
+		var stop = len(batch)
+		for i := range batch {
+			if batch[i].Item.ListID == 0 {
+				batch[i].Item.ListID = listID
+			}
+			l := batch[i].Item.ListID
+			if _, ok := editable[l]; !ok {
+				editable[l] = l == 0 || canEdit(listRole(ctx, u.Email, l))
+			}
+			if !editable[l] {
+				stop = i
+				break
+			}
+		}
+		written := writeImportedItems(ctx, u, batch[:stop], remind)
+		done.Created += written.Created
+		done.Errors = append(done.Errors, written.Errors...)
+		var next = start + stop
+		if len(written.Errors) == 0 && stop < len(batch) {
+			done.Errors = append(done.Errors, RowError{batch[stop].Row, "you can't add items to that list"})
+			next++
+		}
+		if len(done.Errors) > 0 {
+			for _, rest := range items[next:] {
+				done.Errors = append(done.Errors, RowError{rest.Row, "not imported because of the error above"})
+			}
+			*result = done
+			return result
+		}
+		log(fmt.Sprintf("imported %d of %d items for %s", end, len(items), u.Email))
+	}
+	*result = done
+	return result
+}
+
+// The same as writeNewTodoItem for a batch of importItems' items, whose
+// lists it's already checked. If some of them don't get saved, the result
+// has an error for each of those.
+func writeImportedItems(ctx context.Context, u *user.User, batch []ImportedItem, remind bool) ImportResult {
+	var done ImportResult
+	if len(batch) == 0 {
+		return done
+	}
+	now := time.Now()
+	var keys = make([]*datastore.Key, len(batch))
+	var items = make([]TodoItem, len(batch))
+	for i, imported := range batch {
+		keys[i] = datastore.NewIncompleteKey(ctx, "TodoItem", nil)
+		items[i] = imported.Item
+		items[i].OwnerEmail = u.Email
+		// imported items can say when they were created
+		if items[i].Created.IsZero() {
+			items[i].Created = now
+		}
+		items[i].Version = 1
+		items[i].UpdatedAt = now
+	}
+	keys, err := datastore.PutMulti(ctx, keys, items)
+	if err != nil {
+		// PutMulti isn't a transaction, so some of them might have made it
+		errs, isMulti := err.(appengine.MultiError)
+		var savedKeys []*datastore.Key
+		var saved []TodoItem
+		for i, imported := range batch {
+			if isMulti && errs[i] == nil {
+				savedKeys = append(savedKeys, keys[i])
+				saved = append(saved, items[i])
+			} else if isMulti {
+				done.Errors = append(done.Errors, RowError{imported.Row, errs[i].Error()})
+			} else {
+				done.Errors = append(done.Errors, RowError{imported.Row, err.Error()})
+			}
+		}
+		keys, items = savedKeys, saved
+	}
+	done.Created = len(keys)
+	if len(keys) == 0 {
+		return done
+	}
+	updateCacheMulti(ctx, keys, items)
+	var activityKeys = make([]*datastore.Key, len(keys))
+	var activities = make([]Activity, len(keys))
+	for i, k := range keys {
+		activityKeys[i] = datastore.NewIncompleteKey(ctx, "Activity", k)
+		activities[i] = Activity{ActorEmail: u.Email, Kind: activityCreated, Created: now}
+	}
+	// ignore errors, the same as recordActivity's callers
+	if _, err := datastore.PutMulti(ctx, activityKeys, activities); err != nil {
+		log("importItems activity error: " + err.Error())
+	}
+	// the items are in, so these errors go on the first row; they're still worth stopping for
+	first := batch[0].Row
+	indexed := indexTodoItemsForSearch(ctx, keys, items)
+	switch (*indexed).(type) {
+	case Ok:
+	default:
+		done.Errors = append(done.Errors, RowError{first, fmt.Sprintf("imported this batch, but couldn't index it for search: %v", *indexed)})
+		return done
+	}
+	if !remind {
+		return done
+	}
+	var tasks []*taskqueue.Task
+	for i, k := range keys {
+		if items[i].State == "completed" {
+			continue
+		}
+		blob := reminderToJson(Reminder{items[i], k.Encode()})
+		switch (*blob).(type) {
+		case Blob:
+			tasks = append(tasks, reminderTask((*blob).(Blob), items[i]))
+		default:
+			done.Errors = append(done.Errors, RowError{first, fmt.Sprintf("imported this batch, but couldn't queue its reminders: %v", *blob)})
+			return done
+		}
+	}
+	if len(tasks) > 0 {
+		if _, err := taskqueue.AddMulti(ctx, tasks, "reminders"); err != nil {
+			done.Errors = append(done.Errors, RowError{first, "imported this batch, but couldn't queue its reminders: " + err.Error()})
+		}
+	}
+	return done
+}
+
+// Writes the rows that didn't get imported, if there are any
+func writeRowErrors(w http.ResponseWriter, errors []RowError) {
+	if len(errors) == 0 {
+		return
+	}
+	fmt.Fprint(w, "<ul>\n")
+	for _, e := range errors {
+		fmt.Fprintf(w, "<li>Row %d: %s</li>\n", e.Row, template.HTMLEscapeString(e.Message))
+	}
+	fmt.Fprint(w, "</ul>\n")
+}
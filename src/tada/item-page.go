@@ -0,0 +1,327 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/todo/", itemPageHandler)
+	http.HandleFunc("/updateNotes", updateNotesHandler)
+}
+
+// Everything the item page shows. This is also what you get from
+// /todo/{id} if you ask for JSON.
+type ItemDetail struct {
+	ID         int64
+	Item       TodoItem
+	Comments   Comments
+	Activities Activities
+	CanEdit    bool `json:"-"`
+}
+
+func (d ItemDetail) isMaybeError() {}
+
+const itemPageTemplate = `<html><h1>{{.Item.Description}}</h1>
+<p>Due on <b>{{FmtDate .Item.DueDate}}</b>, {{.Item.State}}{{if .Item.Assignee}}, assigned to {{.Item.Assignee}}{{end}}</p>
+<p>Created by {{.Item.OwnerEmail}}</p>
+{{if .CanEdit}}
+ <form action="/updateTask" method="post">
+<p style="border-style:groove;border-width:3px;border-color:pink">
+   <textarea name="description">{{.Item.Description}}</textarea>
+   <input type="date" name="dueDate" value="{{FmtDate .Item.DueDate}}">
+   <input hidden=true name="state" value="off">
+   <input type="checkbox" name="state" {{if Equal .Item.State "completed"}}checked{{end}}>
+   <input hidden=true name="id" value="{{.ID}}">
+   <input hidden=true name="list" value="{{.Item.ListID}}">
+   <input hidden=true name="version" value="{{.Item.Version}}">
+   <input type="submit" value="Save Todo Item">
+</p>
+ </form>
+ <form action="/bulk" method="post">
+   <input hidden=true name="id" value="{{.ID}}">
+   <input hidden=true name="list" value="{{.Item.ListID}}">
+   <input hidden=true name="action" value="delete">
+   <input type="submit" value="Move to Trash">
+ </form>
+{{end}}
+<h2>Notes</h2>
+{{if .CanEdit}}
+ <form action="/updateNotes" method="post">
+   <textarea name="notes" rows="6" cols="80">{{.Item.Notes}}</textarea>
+   <input hidden=true name="id" value="{{.ID}}">
+   <input hidden=true name="version" value="{{.Item.Version}}">
+   <input type="submit" value="Save Notes">
+ </form>
+{{else}}
+<pre>{{.Item.Notes}}</pre>
+{{end}}
+<h2>Comments</h2>
+<ul>
+{{range .Comments}}<li><b>{{.AuthorEmail}}</b> ({{FmtTime .Created}}): {{.Body}}</li>
+{{end}}</ul>
+ <form action="/addComment" method="post">
+   <textarea name="body" rows="3" cols="80"></textarea>
+   <input hidden=true name="id" value="{{.ID}}">
+   <input type="submit" value="Add Comment">
+ </form>
+<h2>History</h2>
+<a href="/history?id={{.ID}}">Every version, with what changed</a>
+<ul>
+{{range .Activities}}<li>{{FmtTime .Created}}: {{.ActorEmail}} {{.Kind}}{{if .Detail}} ({{.Detail}}){{end}}</li>
+{{end}}</ul>
+<a href="/?list={{.Item.ListID}}">Back to the list</a>
+</html>
+`
+
+var itemPageT = template.Must(template.New("itemPage").Funcs(template.FuncMap{
+	"Equal":   func(a, b string) bool { return a == b },
+	"FmtDate": func(d time.Time) string { return d.Format("2006-01-02") },
+	"FmtTime": func(d time.Time) string { return d.Format("2006-01-02 15:04") },
+}).Parse(itemPageTemplate))
+
+// Returns the item with ID id along with its comments and history,
+// if email is allowed to see it
+func readItemDetail(ctx context.Context, email string, id int64) *MaybeError {
+	k := todoItemKey(ctx, id)
+	var detail = ItemDetail{ID: id}
+	item := readTodoItemAs(ctx, email, TodoID(*k))
+	switch (*item).(type) {
+	case TodoItem:
+		detail.Item = (*item).(TodoItem)
+		detail.CanEdit = canEdit(itemRole(ctx, email, detail.Item))
+	default:
+		return item
+	}
+	comments := listComments(ctx, *k)
+	switch (*comments).(type) {
+	case Comments:
+		detail.Comments = (*comments).(Comments)
+	default:
+		return comments
+	}
+	activities := listActivities(ctx, *k)
+	switch (*activities).(type) {
+	case Activities:
+		detail.Activities = (*activities).(Activities)
+	default:
+		return activities
+	}
+	var result = new(MaybeError)
+	*result = detail
+	return result
+}
+
+// Changes just the notes on the item with ID id. version works the same as
+// for updateTodoItem.
+func updateNotes(ctx context.Context, email string, id int64, notes string, version int64) *MaybeError {
+	return patchTodoItem(ctx, email, id, ItemPatch{Notes: &notes}, version)
+}
+
+// Returns true if the client would rather have JSON than HTML, either
+// because it said so in the Accept header or because of a format=json parameter
+func wantsJson(r *http.Request) bool {
+	if f := r.FormValue("format"); f != "" {
+		return f == "json"
+	}
+	var jsonQ, htmlQ float64 = -1, -1
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				q = f
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case "text/html", "text/*", "*/*":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// Writes the item with ID id as either an HTML page or JSON, depending on
+// what the client asked for
+func writeItemDetail(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	detail := readItemDetail(ctx, u.Email, id)
+	w.Header().Add("Vary", "Accept")
+	switch (*detail).(type) {
+	case ItemDetail:
+		w.Header().Set("ETag", itemETag((*detail).(ItemDetail).Item))
+		if wantsJson(r) {
+			blob := itemDetailToJson((*detail).(ItemDetail))
+			switch (*blob).(type) {
+			case Blob:
+				w.Header().Set("Content-Type", "application/json")
+				w.Write((*blob).(Blob))
+			default:
+				respondWith(w, *blob)
+			}
+		} else {
+			handleError(w, itemPageT.Execute(w, (*detail).(ItemDetail)))
+		}
+	case E:
+		// n.b. this is also what you get for items that don't exist
+		http.Error(w, string((*detail).(E)), http.StatusNotFound)
+	default:
+		respondWith(w, *detail)
+	}
+}
+
+// Shows the item in the URL, e.g. /todo/1234, with its notes, comments and
+// history. API clients can use their API token; see apiUser. PUTting JSON
+// there changes the item's description, due date and state; PATCHing it
+// changes just the fields in the JSON (see jsonToItemPatch).
+func itemPageHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/todo/")
+	i, err := todoIDFromString(id)
+	if err != nil {
+		http.Error(w, "You asked for a todo item that isn't a valid ID: "+id, 400)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		writeItemDetail(w, r, *i)
+	case "PUT":
+		putItemHandler(w, r, *i)
+	case "PATCH":
+		patchItemHandler(w, r, *i)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH")
+		http.Error(w, r.Method+" isn't something you can do to an item", http.StatusMethodNotAllowed)
+	}
+}
+
+// Expects a TodoItem as JSON, and preferably an If-Match header with the
+// item's ETag. Answers with the item as it is afterwards, or a 409 with the
+// item as it is now if somebody else changed it first.
+func putItemHandler(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	email := u.Email
+	version, err := versionFromRequest(r)
+	if err != nil {
+		http.Error(w, "That doesn't look like an ETag to me!", 400)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if handleError(w, err) {
+		return
+	}
+	maybeItem := jsonToTodoItem(body)
+	switch (*maybeItem).(type) {
+	case TodoItem:
+	default:
+		http.Error(w, "That doesn't look like a todo item to me!", 400)
+		return
+	}
+	mine := (*maybeItem).(TodoItem)
+	result := updateTodoItem(ctx, email, mine.Description, mine.DueDate, mine.State == "completed", id, version)
+	switch (*result).(type) {
+	case Ok:
+		// JSON is what a PUT client wants back, whatever it said in Accept
+		r.Header.Set("Accept", "application/json")
+		writeItemDetail(w, r, id)
+	case Conflict:
+		r.Header.Set("Accept", "application/json")
+		writeConflict(w, r, id, mine, (*result).(Conflict), "")
+	default:
+		respondWith(w, *result)
+	}
+}
+
+// Expects "id" and "notes" parameters
+func updateNotesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	version, err1 := versionFromRequest(r)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+	} else if err1 != nil {
+		http.Error(w, "That doesn't look like an item version to me!", 400)
+	} else {
+		notes := r.FormValue("notes")
+		result := updateNotes(ctx, email, itemID, notes, version)
+		switch (*result).(type) {
+		case Ok:
+			http.Redirect(w, r, fmt.Sprintf("/todo/%d", itemID), http.StatusSeeOther)
+		case Conflict:
+			conflict := (*result).(Conflict)
+			mine := conflict.Current
+			mine.Notes = notes
+			writeConflict(w, r, itemID, mine, conflict, "/updateNotes")
+		default:
+			respondWith(w, *result)
+		}
+	}
+}
+
+// The same as putItemHandler, but only the fields in the JSON change
+func patchItemHandler(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	email := u.Email
+	version, err := versionFromRequest(r)
+	if err != nil {
+		http.Error(w, "That doesn't look like an ETag to me!", 400)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if handleError(w, err) {
+		return
+	}
+	patch := jsonToItemPatch(body)
+	switch (*patch).(type) {
+	case ItemPatch:
+	default:
+		http.Error(w, "That doesn't look like a change to a todo item to me!", 400)
+		return
+	}
+	result := patchTodoItem(ctx, email, id, (*patch).(ItemPatch), version)
+	r.Header.Set("Accept", "application/json")
+	switch (*result).(type) {
+	case Ok:
+		writeItemDetail(w, r, id)
+	case Conflict:
+		conflict := (*result).(Conflict)
+		mine := conflict.Current
+		(*patch).(ItemPatch).apply(&mine)
+		writeConflict(w, r, id, mine, conflict, "")
+	default:
+		respondWith(w, *result)
+	}
+}
@@ -0,0 +1,507 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/newList", newListHandler)
+	http.HandleFunc("/updateList", updateListHandler)
+	http.HandleFunc("/moveTask", moveTaskHandler)
+}
+
+// A named list of todo items (a project). Every todo item belongs to exactly one list.
+type TodoList struct {
+	OwnerEmail string // email address of the user who created this list
+	Name       string // e.g. "Inbox", "Groceries"
+	Color      string // HTML color the list name is shown in
+	Archived   bool   // archived lists aren't shown in the list switcher
+	SortOrder  int64  // lists are shown in increasing SortOrder
+}
+
+type TodoListID datastore.Key // database key / unique ID for a todo list
+
+// Used for returning stuff from listTodoLists, like Match
+type TodoListMatch struct {
+	Key   *datastore.Key
+	Value TodoList
+}
+type TodoLists []TodoListMatch
+type Count int
+
+func (l TodoList) isMaybeError()   {}
+func (l TodoListID) isMaybeError() {}
+func (l TodoLists) isMaybeError()  {}
+func (c Count) isMaybeError()      {}
+
+// Name of the list that's created for every user the first time they log in.
+// Items created before lists existed get moved into it.
+const inboxName = "Inbox"
+const defaultListColor = "green"
+
+func todoListKey(ctx context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, "TodoList", "", id, nil)
+}
+
+// Creates a new, empty list owned by u, returns its ID
+func writeTodoList(ctx context.Context, u *user.User, name string, color string, sortOrder int64) *MaybeError {
+	list := TodoList{
+		OwnerEmail: u.Email,
+		Name:       name,
+		Color:      color,
+		SortOrder:  sortOrder,
+	}
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "TodoList", nil), &list)
+	var result = new(MaybeError)
+	if err != nil {
+		log("writeTodoList error: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		log("writeTodoList succeeded " + key.String())
+		*result = TodoListID(*key)
+	}
+	return result
+}
+
+// Takes a list ID, returns a todo list
+func readTodoList(ctx context.Context, id int64) *MaybeError {
+	// n.b. doesn't check the owner
+	list := new(TodoList)
+	var result = new(MaybeError)
+	if err := datastore.Get(ctx, todoListKey(ctx, id), list); err != nil {
+		log("readTodoList failed: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		*result = *list
+	}
+	return result
+}
+
+// Changes the name, color, archived flag and sort order of a list that email owns
+func updateTodoList(ctx context.Context, email string, id int64, name string, color string, archived bool, sortOrder int64) *MaybeError {
+	var result = new(MaybeError)
+	old := readTodoList(ctx, id)
+	switch (*old).(type) {
+	case TodoList:
+		if listRole(ctx, email, id) != roleOwner {
+			*result = E("you don't own that list")
+			return result
+		}
+	case E:
+		return old
+	default:
+		*result = E("weird answer from readTodoList")
+		return result
+	}
+	list := TodoList{
+		OwnerEmail: (*old).(TodoList).OwnerEmail,
+		Name:       name,
+		Color:      color,
+		Archived:   archived,
+		SortOrder:  sortOrder,
+	}
+	if _, err := datastore.Put(ctx, todoListKey(ctx, id), &list); err != nil {
+		log("updateTodoList error: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		*result = Ok{}
+	}
+	return result
+}
+
+// Returns all of the lists that u owns, including archived ones, in sort order
+func listTodoLists(ctx context.Context, u *user.User) *MaybeError {
+	var result = new(MaybeError)
+	var lists = make([]TodoList, 0)
+	q := datastore.NewQuery("TodoList").Filter("OwnerEmail=", u.Email).Order("SortOrder")
+	keys, err := q.GetAll(ctx, &lists)
+	if err != nil {
+		log("listTodoLists error: " + err.Error())
+		*result = E(err.Error())
+		return result
+	}
+	var matches = make([]TodoListMatch, 0, len(keys))
+	for i, k := range keys {
+		matches = append(matches, TodoListMatch{k, lists[i]})
+	}
+	*result = TodoLists(matches)
+	return result
+}
+
+// Remembers which list was made as somebody's Inbox, keyed by their email
+// address, so two requests at once can't both make one. n.b. the query in
+// listTodoLists might not see a list that's only just been written, but a
+// Get by key always does.
+type InboxPointer struct {
+	ListID int64
+}
+
+const inboxPointerKind = "InboxPointer"
+
+// Returns the ID of u's default list (the first one in sort order),
+// creating an Inbox if u doesn't have any lists yet
+func ensureInbox(ctx context.Context, u *user.User) *MaybeError {
+	var result = new(MaybeError)
+	lists := listTodoLists(ctx, u)
+	switch (*lists).(type) {
+	case TodoLists:
+		ls := ([]TodoListMatch)((*lists).(TodoLists))
+		if len(ls) > 0 {
+			*result = TodoListID(*ls[0].Key)
+			return result
+		}
+	default:
+		return lists
+	}
+	var inboxKey *datastore.Key
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		pk := datastore.NewKey(ctx, inboxPointerKind, u.Email, 0, nil)
+		var p InboxPointer
+		err := datastore.Get(ctx, pk, &p)
+		if err == nil {
+			inboxKey = todoListKey(ctx, p.ListID)
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		list := TodoList{
+			OwnerEmail: u.Email,
+			Name:       inboxName,
+			Color:      defaultListColor,
+		}
+		inboxKey, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "TodoList", nil), &list)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(ctx, pk, &InboxPointer{inboxKey.IntID()})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log("ensureInbox error: " + err.Error())
+		*result = E(err.Error())
+		return result
+	}
+	*result = TodoListID(*inboxKey)
+	return result
+}
+
+// Items written before lists existed don't have a ListID at all, so they
+// come back from the datastore with ListID 0; this moves all of u's items
+// like that into the list with ID inboxID. n.b. it can't just query for
+// ListID=0, since entities without the property aren't in that index.
+// Items from before we kept track of Created are missing from the Created
+// index the same way, so they'd never show up sorted newest first; writing
+// them back with a zero Created fixes that too. See migrateToInboxOnce.
+func migrateToInbox(ctx context.Context, u *user.User, inboxID int64) *MaybeError {
+	var result = new(MaybeError)
+	var all = make([]TodoItem, 0)
+	q := datastore.NewQuery("TodoItem").Filter("OwnerEmail=", u.Email)
+	allKeys, err := q.GetAll(ctx, &all)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var keys []*datastore.Key
+	var items []TodoItem
+	for i, item := range all {
+		if item.ListID == 0 || item.Created.IsZero() {
+			keys = append(keys, allKeys[i])
+			items = append(items, item)
+		}
+	}
+	if len(keys) == 0 {
+		*result = Ok{}
+		return result
+	}
+	log(fmt.Sprintf("migrating %d items for %s into list %d", len(keys), u.Email, inboxID))
+	for i := range items {
+		if items[i].ListID == 0 {
+			items[i].ListID = inboxID
+		}
+		items[i].Version++
+		items[i].UpdatedAt = time.Now()
+	}
+	var src = make([]interface{}, len(items))
+	for i := range items {
+		src[i] = &items[i]
+	}
+	if err := putInBatches(ctx, keys, src); err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	// same reason as in updateTodoItem: otherwise listTodoItems could see the old versions
+	for i, k := range keys {
+		updateCache(ctx, *k, items[i])
+	}
+	*result = Ok{}
+	return result
+}
+
+// Remembers that somebody's old items have been moved into their Inbox, so
+// it only happens once. Keyed by their email address.
+type InboxMigration struct {
+	Migrated time.Time
+}
+
+const inboxMigrationKind = "InboxMigration"
+
+// Runs migrateToInbox for u the first time they show up, and then never
+// again once it's worked
+func migrateToInboxOnce(ctx context.Context, u *user.User, inboxID int64) *MaybeError {
+	var result = new(MaybeError)
+	k := datastore.NewKey(ctx, inboxMigrationKind, u.Email, 0, nil)
+	var m InboxMigration
+	err := datastore.Get(ctx, k, &m)
+	if err == nil {
+		*result = Ok{}
+		return result
+	}
+	if err != datastore.ErrNoSuchEntity {
+		*result = E(err.Error())
+		return result
+	}
+	migrated := migrateToInbox(ctx, u, inboxID)
+	switch (*migrated).(type) {
+	case Ok:
+	default:
+		// it gets another go next time
+		return migrated
+	}
+	if _, err := datastore.Put(ctx, k, &InboxMigration{time.Now()}); err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	return migrated
+}
+
+// Moves the item with ID id into the list with ID listID. email has to be able
+// to edit both.
+func moveTodoItem(ctx context.Context, email string, id int64, listID int64) *MaybeError {
+	var result = new(MaybeError)
+	if !canEdit(listRole(ctx, email, listID)) {
+		*result = E("you can't add items to that list")
+		return result
+	}
+	k := datastore.NewKey(ctx, "TodoItem", "", id, nil)
+	maybeItem := readTodoItem(ctx, TodoID(*k))
+	switch (*maybeItem).(type) {
+	case TodoItem:
+		item := (*maybeItem).(TodoItem)
+		if !canEdit(itemRole(ctx, email, item)) {
+			*result = E("you can't change that item")
+			return result
+		}
+		changed := changeTodoItem(ctx, email, k, anyVersion, func(item *TodoItem) {
+			item.ListID = listID
+		})
+		switch (*changed).(type) {
+		case Change:
+			*result = Ok{}
+		default:
+			return changed
+		}
+	case E:
+		return maybeItem
+	default:
+		*result = E("weird answer from readTodoItem in moveTodoItem")
+	}
+	return result
+}
+
+// Returns the number of incomplete items in the list with ID listID,
+// no matter who created them, not counting the ones in the trash.
+// n.b. that's all of them minus the trashed ones, since older items don't
+// have a DeletedAt for a DeletedAt=zero filter to match (see trashQuery)
+func countTodoItems(ctx context.Context, listID int64) *MaybeError {
+	var result = new(MaybeError)
+	n, err := datastore.NewQuery("TodoItem").
+		Filter("ListID=", listID).
+		Filter("State=", "incomplete").
+		KeysOnly().
+		Count(ctx)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	trashed, err := trashQuery().
+		Filter("ListID=", listID).
+		Filter("State=", "incomplete").
+		KeysOnly().
+		Count(ctx)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	*result = Count(n - trashed)
+	return result
+}
+
+// Returns the list the request asked for with the "list" parameter,
+// or the user's default list if there wasn't one
+func currentListID(ctx context.Context, r *http.Request, u *user.User) *MaybeError {
+	var result = new(MaybeError)
+	if s := r.FormValue("list"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			*result = E(s + " doesn't look like a list ID to me!")
+		} else if !canView(listRole(ctx, u.Email, id)) {
+			*result = E("you can't see that list")
+		} else {
+			*result = TodoListID(*todoListKey(ctx, id))
+		}
+		return result
+	}
+	return ensureInbox(ctx, u)
+}
+
+// writes the list switcher, with the number of incomplete items in each list
+func writeListSwitcher(w http.ResponseWriter, ctx context.Context, u *user.User, lists TodoLists, current int64) {
+	fmt.Fprint(w, `<div>`)
+	var archived = make([]TodoListMatch, 0)
+	for _, l := range lists {
+		if l.Value.Archived {
+			archived = append(archived, l)
+			continue
+		}
+		writeListLink(w, ctx, u, l, current)
+	}
+	fmt.Fprint(w, ` | <a href="/?view=assigned">Assigned to me</a>`)
+	if len(archived) > 0 {
+		fmt.Fprint(w, ` | Archived: `)
+		for _, l := range archived {
+			writeListLink(w, ctx, u, l, current)
+		}
+	}
+	fmt.Fprint(w, `</div>`)
+}
+
+func writeListLink(w http.ResponseWriter, ctx context.Context, u *user.User, l TodoListMatch, current int64) {
+	count := "?"
+	n := countTodoItems(ctx, l.Key.IntID())
+	switch (*n).(type) {
+	case Count:
+		count = strconv.Itoa(int((*n).(Count)))
+	default:
+		// just show "?" if counting failed
+	}
+	name := template.HTMLEscapeString(l.Value.Name)
+	if l.Value.OwnerEmail != u.Email {
+		name = name + " (" + template.HTMLEscapeString(l.Value.OwnerEmail) + ")"
+	}
+	if l.Key.IntID() == current {
+		name = "<b>" + name + "</b>"
+	}
+	fmt.Fprintf(w, ` <a href="/?list=%d"><font color="%s">%s</font></a> (%s) `,
+		l.Key.IntID(), template.HTMLEscapeString(l.Value.Color), name, count)
+}
+
+// writes the forms for creating a new list and for editing the current one
+func makeListForms(w http.ResponseWriter, current TodoListMatch) {
+	var checked = ""
+	if current.Value.Archived {
+		checked = "checked"
+	}
+	fmt.Fprintf(w, `
+ <form action="/updateList" method="post">
+   <input type="text" name="name" value="%s">
+   <input type="text" name="color" value="%s">
+   archived: <input type="checkbox" name="archived" %s>
+   order: <input type="number" name="sortOrder" value="%d">
+   <input hidden=true name="list" value="%d">
+   <input type="submit" value="Save List">
+ </form>
+ <form action="/newList" method="post">
+   <input type="text" name="name">
+   <input type="text" name="color" value="%s">
+   <input type="submit" value="Add List">
+ </form>
+`, template.HTMLEscapeString(current.Value.Name), template.HTMLEscapeString(current.Value.Color),
+		checked, current.Value.SortOrder, current.Key.IntID(), defaultListColor)
+}
+
+func newListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := user.Current(ctx)
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "A list needs a name", 400)
+		return
+	}
+	color := r.FormValue("color")
+	if color == "" {
+		color = defaultListColor
+	}
+	// put the new list at the end of the user's own lists
+	var sortOrder int64 = 0
+	lists := listTodoLists(ctx, u)
+	switch (*lists).(type) {
+	case TodoLists:
+		for _, l := range (*lists).(TodoLists) {
+			if l.Value.SortOrder >= sortOrder {
+				sortOrder = l.Value.SortOrder + 1
+			}
+		}
+	case E:
+		respondWith(w, *lists)
+		return
+	}
+	id := writeTodoList(ctx, u, name, color, sortOrder)
+	switch (*id).(type) {
+	case TodoListID:
+		k := datastore.Key((*id).(TodoListID))
+		http.Redirect(w, r, fmt.Sprintf("/?list=%d", k.IntID()), http.StatusSeeOther)
+	default:
+		respondWith(w, *id)
+	}
+}
+
+func updateListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("list")
+	listID, err := strconv.ParseInt(id, 10, 64)
+	sortOrder, err1 := strconv.ParseInt(r.FormValue("sortOrder"), 10, 64)
+	if err != nil {
+		http.Error(w, id+" doesn't look like a list ID to me!", 400)
+	} else if err1 != nil {
+		http.Error(w, r.FormValue("sortOrder")+" doesn't look like a number to me!", 400)
+	} else {
+		respondWith(w, *(updateTodoList(ctx,
+			email,
+			listID,
+			r.FormValue("name"),
+			r.FormValue("color"),
+			r.FormValue("archived") == "on",
+			sortOrder)))
+		rootHandler(w, r)
+	}
+}
+
+// Expects "id" (the item) and "list" (where to move it) parameters
+func moveTaskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	list := r.FormValue("list")
+	listID, err1 := strconv.ParseInt(list, 10, 64)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+	} else if err1 != nil {
+		http.Error(w, list+" doesn't look like a list ID to me!", 400)
+	} else {
+		respondWith(w, *(moveTodoItem(ctx, email, itemID, listID)))
+		rootHandler(w, r)
+	}
+}
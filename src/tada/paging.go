@@ -0,0 +1,141 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+const defaultPageSize = 50
+const maxPageSize = 500
+
+// One page of todo items, for big lists.
+type Page struct {
+	Items Matches
+	Next  string // pass this back as the "next" parameter to get the next page; "" if this is the last one
+}
+
+func (p Page) isMaybeError() {}
+
+// Gets the "pageSize" and "next" parameters from the request.
+// pageSize defaults to defaultPageSize and can't be more than maxPageSize.
+func pageParams(r *http.Request) (int, string, error) {
+	var pageSize = defaultPageSize
+	if s := r.FormValue("pageSize"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, "", fmt.Errorf("%s doesn't look like a page size to me!", s)
+		}
+		pageSize = n
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return pageSize, r.FormValue("next"), nil
+}
+
+// Returns up to pageSize of the items q finds, filtered and sorted by f,
+// starting where the page with next token token left off ("" for the first page).
+// If f has to be sorted in memory, the page is everything q finds instead,
+// since pages sorted one at a time wouldn't add up to the right order.
+// Date ranges are usually short enough for that to be fine.
+func pageOfTodoItems(ctx context.Context, u *user.User, q *datastore.Query, f ItemFilter, pageSize int, token string) *MaybeError {
+	var result = new(MaybeError)
+	unpaged := f.sortsInMemory()
+	q = applyFilter(q, f).KeysOnly()
+	if !unpaged {
+		q = q.Limit(pageSize)
+	}
+	if token != "" {
+		cursor, err := datastore.DecodeCursor(token)
+		if err != nil {
+			*result = E(token + " doesn't look like a page token to me!")
+			return result
+		}
+		q = q.Start(cursor)
+	}
+	var keys = make([]*datastore.Key, 0, pageSize)
+	iter := q.Run(ctx)
+	for {
+		k, err := iter.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			*result = E(err.Error())
+			return result
+		}
+		keys = append(keys, k)
+	}
+	log(fmt.Sprintf("got a page of %d items for %s", len(keys), u.Email))
+	var next = ""
+	// if the page isn't full, there's nothing after it
+	if !unpaged && len(keys) == pageSize {
+		if cursor, err := iter.Cursor(); err == nil {
+			next = cursor.String()
+		}
+	}
+	items := readTodoItems(ctx, keys)
+	switch (*items).(type) {
+	case Matches:
+		matches := (*items).(Matches)
+		sortMatches(matches, f)
+		*result = Page{matches, next}
+	default:
+		return items
+	}
+	return result
+}
+
+// The same as listTodoItemsInList, one page at a time, filtered by f
+func listTodoItemsInListPage(ctx context.Context, u *user.User, listID int64, f ItemFilter, pageSize int, token string) *MaybeError {
+	if !canView(listRole(ctx, u.Email, listID)) {
+		var result = new(MaybeError)
+		*result = E("you can't see that list")
+		return result
+	}
+	return pageOfTodoItems(ctx, u, inListQuery(listID), f, pageSize, token)
+}
+
+// The same as listAssignedTodoItems, one page at a time, filtered by f
+func listAssignedTodoItemsPage(ctx context.Context, u *user.User, f ItemFilter, pageSize int, token string) *MaybeError {
+	return pageOfTodoItems(ctx, u, assignedQuery(u), f, pageSize, token)
+}
+
+// Returns the items on page, or the error if there was one instead
+func pageItems(page *MaybeError) *MaybeError {
+	switch (*page).(type) {
+	case Page:
+		var result = new(MaybeError)
+		*result = (*page).(Page).Items
+		return result
+	default:
+		return page
+	}
+}
+
+// writes a link to the page after page, keeping the rest of the
+// parameters (like which list) from r
+func writeNextPageLink(w http.ResponseWriter, r *http.Request, path string, page *MaybeError, keep ...string) {
+	switch (*page).(type) {
+	case Page:
+		next := (*page).(Page).Next
+		if next == "" {
+			return
+		}
+		v := url.Values{}
+		for _, p := range append(keep, "pageSize") {
+			if s := r.FormValue(p); s != "" {
+				v.Set(p, s)
+			}
+		}
+		v.Set("next", next)
+		fmt.Fprintf(w, `<p><a href="%s?%s">Next page</a></p>`, path, v.Encode())
+	}
+}
@@ -0,0 +1,90 @@
+// +build !appengine
+package tada
+
+import (
+	"net/http"
+	"time"
+)
+
+// A change to some of a todo item's fields. nil fields stay the way they are,
+// so a form or API client only has to send what it's changing.
+type ItemPatch struct {
+	Description *string
+	DueDate     *time.Time
+	State       *string // "completed" or "incomplete"
+	Notes       *string
+	Tags        *[]string
+}
+
+func (p ItemPatch) isMaybeError() {}
+
+func (p ItemPatch) apply(item *TodoItem) {
+	if p.Description != nil {
+		item.Description = *p.Description
+	}
+	if p.DueDate != nil {
+		item.DueDate = *p.DueDate
+	}
+	if p.State != nil {
+		item.State = *p.State
+	}
+	if p.Notes != nil {
+		item.Notes = *p.Notes
+	}
+	if p.Tags != nil {
+		item.Tags = *p.Tags
+	}
+}
+
+// Accepts "completed"/"incomplete" as well as what a checkbox sends
+func parseState(s string) (string, bool) {
+	switch s {
+	case "completed", "on", "true":
+		return "completed", true
+	case "incomplete", "off", "false", "":
+		return "incomplete", true
+	}
+	return "", false
+}
+
+// Due dates can be just a date, the way forms send them, or a full timestamp
+func parseDueDate(s string) (time.Time, error) {
+	if d, err := time.Parse("2006-01-02", s); err == nil {
+		return d, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Makes a patch out of whichever of the "description", "dueDate", "state"
+// and "notes" parameters are in r. Checkboxes don't send anything when
+// they're unchecked, so forms with a state checkbox put a hidden "state=off"
+// in front of it; the last "state" value wins.
+func patchFromForm(r *http.Request) *MaybeError {
+	var result = new(MaybeError)
+	r.ParseForm()
+	var patch ItemPatch
+	if vs, ok := r.Form["description"]; ok {
+		patch.Description = &vs[0]
+	}
+	if vs, ok := r.Form["dueDate"]; ok {
+		d, err := parseDueDate(vs[0])
+		if err != nil {
+			*result = E(vs[0] + " doesn't look like a valid date to me!")
+			return result
+		}
+		patch.DueDate = &d
+	}
+	if vs, ok := r.Form["state"]; ok {
+		state, ok := parseState(vs[len(vs)-1])
+		if !ok {
+			*result = E(vs[len(vs)-1] + " isn't a state a todo item can be in")
+			return result
+		}
+		patch.State = &state
+	}
+	if vs, ok := r.Form["notes"]; ok {
+		patch.Notes = &vs[0]
+	}
+	*result = patch
+	return result
+}
@@ -0,0 +1,224 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/restoreRevision", restoreRevisionHandler)
+}
+
+// A todo item the way it was before somebody changed it. Stored with the
+// item as its parent; changeTodoItem writes one for every change.
+type Revision struct {
+	Item        TodoItem  // what it looked like before
+	EditorEmail string    // who changed it
+	Saved       time.Time // when they changed it
+}
+
+// One thing that's different between two versions of an item
+type FieldChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// A revision along with what changed between it and the next newer version
+type RevisionMatch struct {
+	ID       int64
+	Revision Revision
+	Changes  []FieldChange
+}
+
+type Revisions []RevisionMatch
+
+func (r Revisions) isMaybeError() {}
+
+// Returns what's different between before and after, in the fields people
+// care about
+func diffItems(before TodoItem, after TodoItem) []FieldChange {
+	var changes []FieldChange
+	add := func(field, b, a string) {
+		if b != a {
+			changes = append(changes, FieldChange{field, b, a})
+		}
+	}
+	add("Description", before.Description, after.Description)
+	add("Due", before.DueDate.Format("2006-01-02"), after.DueDate.Format("2006-01-02"))
+	add("State", before.State, after.State)
+	add("Priority", before.Priority, after.Priority)
+	add("Notes", before.Notes, after.Notes)
+	add("Assigned to", reminderRecipient(before), reminderRecipient(after))
+	add("List", strconv.FormatInt(before.ListID, 10), strconv.FormatInt(after.ListID, 10))
+	add("Tags", strings.Join(before.Tags, ", "), strings.Join(after.Tags, ", "))
+	return changes
+}
+
+// Returns the revisions of the item with ID id, newest first, each with what
+// changed in the edit that replaced it. email has to be able to see the item.
+func listRevisions(ctx context.Context, email string, id int64) *MaybeError {
+	var result = new(MaybeError)
+	k := todoItemKey(ctx, id)
+	maybeItem := readTodoItemAs(ctx, email, TodoID(*k))
+	switch (*maybeItem).(type) {
+	case TodoItem:
+	default:
+		return maybeItem
+	}
+	var revisions []Revision
+	keys, err := datastore.NewQuery("Revision").Ancestor(k).Order("-Saved").GetAll(ctx, &revisions)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var matches = make([]RevisionMatch, len(revisions))
+	newer := (*maybeItem).(TodoItem)
+	for i, rev := range revisions {
+		matches[i] = RevisionMatch{keys[i].IntID(), rev, diffItems(rev.Item, newer)}
+		newer = rev.Item
+	}
+	*result = Revisions(matches)
+	return result
+}
+
+// Puts the item with ID id back the way it was in the revision with ID
+// revisionID. That's a change like any other, so it gets a revision of its
+// own and can be undone the same way. version works the same as for
+// updateTodoItem.
+func restoreRevision(ctx context.Context, email string, id int64, revisionID int64, version int64) *MaybeError {
+	var result = new(MaybeError)
+	k := todoItemKey(ctx, id)
+	maybeItem := readTodoItem(ctx, TodoID(*k))
+	switch (*maybeItem).(type) {
+	case TodoItem:
+		if !canEdit(itemRole(ctx, email, (*maybeItem).(TodoItem))) {
+			*result = E("you can't change that item")
+			return result
+		}
+	default:
+		return maybeItem
+	}
+	var rev Revision
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, "Revision", "", revisionID, k), &rev); err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	changed := changeTodoItem(ctx, email, k, version, func(item *TodoItem) {
+		// not the owner, list or assignee: moving and assigning have their own
+		// permission checks, and the old list might not even be there any more
+		item.Description = rev.Item.Description
+		item.DueDate = rev.Item.DueDate
+		item.State = rev.Item.State
+		item.Priority = rev.Item.Priority
+		item.Notes = rev.Item.Notes
+		item.Tags = rev.Item.Tags
+	})
+	switch (*changed).(type) {
+	case Change:
+	default:
+		return changed
+	}
+	change := (*changed).(Change)
+	recordChanges(ctx, *k, email, change.Before, change.After)
+	return indexCommentForSearch(ctx, TodoID(*k))
+}
+
+const historyPageTemplate = `<html><h1>History of {{.Item.Description}}</h1>
+<ol>
+{{range .Revisions}}<li>{{FmtTime .Revision.Saved}}: {{.Revision.EditorEmail}} changed
+<table border="1">
+<tr><th></th><th>Before</th><th>After</th></tr>
+{{range .Changes}}<tr><td>{{.Field}}</td><td><pre>{{.Before}}</pre></td><td><pre>{{.After}}</pre></td></tr>
+{{end}}</table>
+{{if $.CanEdit}} <form action="/restoreRevision" method="post">
+   <input hidden=true name="id" value="{{$.ID}}">
+   <input hidden=true name="revision" value="{{.ID}}">
+   <input hidden=true name="version" value="{{$.Item.Version}}">
+   <input type="submit" value="Restore this version">
+ </form>
+{{end}}</li>
+{{end}}</ol>
+<a href="/todo/{{.ID}}">Back to the item</a>
+</html>
+`
+
+var historyPageT = template.Must(template.New("historyPage").Funcs(template.FuncMap{
+	"FmtTime": func(d time.Time) string { return d.Format("2006-01-02 15:04") },
+}).Parse(historyPageTemplate))
+
+// Expects an "id" parameter
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+		return
+	}
+	revisions := listRevisions(ctx, email, itemID)
+	switch (*revisions).(type) {
+	case Revisions:
+	default:
+		respondWith(w, *revisions)
+		return
+	}
+	// listRevisions already checked that email can see it, but it might
+	// have gone in the trash since
+	maybeItem := readTodoItem(ctx, TodoID(*todoItemKey(ctx, itemID)))
+	var item TodoItem
+	switch (*maybeItem).(type) {
+	case TodoItem:
+		item = (*maybeItem).(TodoItem)
+	default:
+		respondWith(w, *maybeItem)
+		return
+	}
+	handleError(w, historyPageT.Execute(w, struct {
+		ID        int64
+		Item      TodoItem
+		Revisions Revisions
+		CanEdit   bool
+	}{itemID, item, (*revisions).(Revisions), canEdit(itemRole(ctx, email, item))}))
+}
+
+// Expects "id", "revision" and "version" parameters
+func restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	id := r.FormValue("id")
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	revision := r.FormValue("revision")
+	revisionID, err1 := strconv.ParseInt(revision, 10, 64)
+	version, err2 := versionFromRequest(r)
+	if err != nil {
+		http.Error(w, id+" doesn't look like an item ID to me!", 400)
+	} else if err1 != nil {
+		http.Error(w, revision+" doesn't look like a revision ID to me!", 400)
+	} else if err2 != nil {
+		http.Error(w, "That doesn't look like an item version to me!", 400)
+	} else {
+		result := restoreRevision(ctx, email, itemID, revisionID, version)
+		switch (*result).(type) {
+		case Ok:
+			http.Redirect(w, r, fmt.Sprintf("/todo/%d", itemID), http.StatusSeeOther)
+		case Conflict:
+			// the history they were looking at is out of date, so show them the new one
+			http.Redirect(w, r, fmt.Sprintf("/history?id=%d", itemID), http.StatusSeeOther)
+		default:
+			respondWith(w, *result)
+		}
+	}
+}
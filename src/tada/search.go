@@ -0,0 +1,144 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/search"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/search", searchHandler)
+}
+
+// Searches the descriptions of todo items for query, one page at a time,
+// and only returns items u can see. Pages can have fewer than pageSize items in them because
+// of that, but Next is still "" only on the last one.
+func searchTodoItemsPage(ctx context.Context, u *user.User, query string, pageSize int, token string) *MaybeError {
+	var result = new(MaybeError)
+	index, err := search.Open("tada")
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var keys = make([]*datastore.Key, 0, pageSize)
+	// IDsOnly, because we read the items themselves with readTodoItems
+	// anyway, to get the newest versions and to check who can see them
+	opts := &search.SearchOptions{Limit: pageSize, IDsOnly: true, Cursor: search.Cursor(token)}
+	iter := index.Search(ctx, "Description:"+query, opts)
+	var next = ""
+	var n = 0
+	for {
+		id, err := iter.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			*result = E(err.Error())
+			return result
+		}
+		if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+			keys = append(keys, todoItemKey(ctx, i))
+		}
+		// documents from before they had IDs can't be looked up; skip them
+		n++
+		if n == pageSize {
+			// if the page is full there might be more after it
+			next = string(iter.Cursor())
+			break
+		}
+	}
+	items := readTodoItems(ctx, keys)
+	switch (*items).(type) {
+	case Matches:
+		var visible = make([]Match, 0, len(keys))
+		for _, m := range (*items).(Matches) {
+			if canView(itemRole(ctx, u.Email, m.Value)) {
+				visible = append(visible, m)
+			}
+		}
+		*result = Page{Matches(visible), next}
+	default:
+		return items
+	}
+	return result
+}
+
+// writes the search box
+func makeSearchForm(w http.ResponseWriter) {
+	const form = `
+ <form action="/search" method="get">
+   <input type="search" name="q">
+   <input type="submit" value="Search">
+ </form>
+`
+	fmt.Fprint(w, form)
+}
+
+const searchPageTemplate = `<html><h1>Results for {{.Query}}</h1>
+<ol>
+{{range .Page.Items}}<li><a href="/todo/{{.Key.IntID}}">{{.Value.Description}}</a>, due on {{FmtDate .Value.DueDate}}{{if Equal .Value.State "completed"}} (completed){{end}}</li>
+{{end}}</ol>
+`
+
+var searchPageT = template.Must(template.New("searchPage").Funcs(template.FuncMap{
+	"Equal":   func(a, b string) bool { return a == b },
+	"FmtDate": func(d time.Time) string { return d.Format("2006-01-02") },
+}).Parse(searchPageTemplate))
+
+// Expects a "q" parameter, plus "pageSize" and "next" for paging.
+// Returns JSON if the client asks for it, like /todo/{id}, and API clients
+// can use their API token the same way.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	u := apiUser(w, r)
+	if u == nil {
+		return
+	}
+	query := r.FormValue("q")
+	pageSize, token, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if query == "" {
+		http.Error(w, "What do you want to search for?", 400)
+		return
+	}
+	page := searchTodoItemsPage(ctx, u, query, pageSize, token)
+	w.Header().Add("Vary", "Accept")
+	switch (*page).(type) {
+	case Page:
+		if wantsJson(r) {
+			blob := pageToJson((*page).(Page))
+			switch (*blob).(type) {
+			case Blob:
+				w.Header().Set("Content-Type", "application/json")
+				w.Write((*blob).(Blob))
+			default:
+				respondWith(w, *blob)
+			}
+			return
+		}
+		err := searchPageT.Execute(w, struct {
+			Query string
+			Page  Page
+		}{query, (*page).(Page)})
+		if handleError(w, err) {
+			return
+		}
+		writeNextPageLink(w, r, "/search", page, "q")
+		makeSearchForm(w)
+		fmt.Fprint(w, `<a href="/">Back to my lists</a></html>`)
+	default:
+		respondWith(w, *page)
+	}
+}
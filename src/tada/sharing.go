@@ -0,0 +1,381 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/shareList", shareListHandler)
+	http.HandleFunc("/acceptInvite", acceptInviteHandler)
+	http.HandleFunc("/removeMember", removeMemberHandler)
+}
+
+// Somebody other than the owner who can see a list.
+// Stored with the list as its parent and the member's email as the key name,
+// so there's at most one per user per list
+type ListMember struct {
+	Email     string // email address of the collaborator
+	Role      string // roleViewer / roleEditor / roleOwner
+	Accepted  bool   // false until the collaborator accepts the invitation
+	InvitedBy string // email address of whoever sent the invitation
+}
+
+// Used for returning pending invitations from listInvitations
+type Invitation struct {
+	List   TodoListMatch
+	Member ListMember
+}
+type Invitations []Invitation
+
+func (m ListMember) isMaybeError()  {}
+func (i Invitations) isMaybeError() {}
+
+const (
+	roleViewer = "viewer" // can see the list's items
+	roleEditor = "editor" // can also add, change and move items
+	roleOwner  = "owner"  // can also rename the list and share it with other people
+)
+
+func canView(role string) bool {
+	return role == roleViewer || role == roleEditor || role == roleOwner
+}
+
+func canEdit(role string) bool {
+	return role == roleEditor || role == roleOwner
+}
+
+func listMemberKey(ctx context.Context, listID int64, email string) *datastore.Key {
+	return datastore.NewKey(ctx, "ListMember", email, 0, todoListKey(ctx, listID))
+}
+
+// Returns what email is allowed to do with the list with ID listID,
+// or "" if they can't see it at all
+func listRole(ctx context.Context, email string, listID int64) string {
+	list := readTodoList(ctx, listID)
+	switch (*list).(type) {
+	case TodoList:
+		if (*list).(TodoList).OwnerEmail == email {
+			return roleOwner
+		}
+	default:
+		return ""
+	}
+	var member ListMember
+	if err := datastore.Get(ctx, listMemberKey(ctx, listID, email), &member); err != nil {
+		return ""
+	}
+	if !member.Accepted {
+		return ""
+	}
+	return member.Role
+}
+
+// Returns what email is allowed to do with item: that's their role in the
+// item's list, except that whoever it's assigned to can edit it as long as
+// they can still see the list. n.b. whoever created it doesn't get anything
+// extra, so taking somebody out of a list takes away their items there too.
+// Old items that aren't in any list yet belong to whoever created them.
+func itemRole(ctx context.Context, email string, item TodoItem) string {
+	if item.ListID == 0 {
+		if item.OwnerEmail == email {
+			return roleOwner
+		}
+		return ""
+	}
+	role := listRole(ctx, email, item.ListID)
+	if item.Assignee == email && role == roleViewer {
+		return roleEditor
+	}
+	return role
+}
+
+// Invites inviteeEmail to the list with ID listID. Only owners can do this.
+// Re-inviting somebody who's already a member changes their role.
+func inviteMember(ctx context.Context, inviterEmail string, listID int64, inviteeEmail string, role string) *MaybeError {
+	var result = new(MaybeError)
+	if !canView(role) {
+		*result = E(role + " isn't a role I know about")
+		return result
+	}
+	if listRole(ctx, inviterEmail, listID) != roleOwner {
+		*result = E("only owners can share a list")
+		return result
+	}
+	var accepted = false
+	var old ListMember
+	if err := datastore.Get(ctx, listMemberKey(ctx, listID, inviteeEmail), &old); err == nil {
+		accepted = old.Accepted
+	}
+	member := ListMember{
+		Email:     inviteeEmail,
+		Role:      role,
+		Accepted:  accepted,
+		InvitedBy: inviterEmail,
+	}
+	if _, err := datastore.Put(ctx, listMemberKey(ctx, listID, inviteeEmail), &member); err != nil {
+		log("inviteMember error: " + err.Error())
+		*result = E(err.Error())
+		return result
+	}
+	if !accepted {
+		list := readTodoList(ctx, listID)
+		switch (*list).(type) {
+		case TodoList:
+			// ignore errors: the invitation also shows up on the invitee's home page
+			sendInvitationEmail(ctx, inviterEmail, inviteeEmail, (*list).(TodoList).Name)
+		}
+	}
+	*result = Ok{}
+	return result
+}
+
+// Accepts u's pending invitation to the list with ID listID
+func acceptInvitation(ctx context.Context, u *user.User, listID int64) *MaybeError {
+	var result = new(MaybeError)
+	k := listMemberKey(ctx, listID, u.Email)
+	var member ListMember
+	if err := datastore.Get(ctx, k, &member); err != nil {
+		*result = E("you haven't been invited to that list")
+		return result
+	}
+	member.Accepted = true
+	if _, err := datastore.Put(ctx, k, &member); err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = Ok{}
+	}
+	return result
+}
+
+// Takes memberEmail off the list with ID listID. Owners can remove anybody;
+// everybody else can only remove themselves (i.e. decline or leave).
+func removeMember(ctx context.Context, email string, listID int64, memberEmail string) *MaybeError {
+	var result = new(MaybeError)
+	if email != memberEmail && listRole(ctx, email, listID) != roleOwner {
+		*result = E("only owners can remove other people from a list")
+		return result
+	}
+	if err := datastore.Delete(ctx, listMemberKey(ctx, listID, memberEmail)); err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = Ok{}
+	}
+	return result
+}
+
+// Returns everybody who's been invited to the list with ID listID, including
+// people who haven't accepted yet
+func listMembers(ctx context.Context, listID int64) ([]ListMember, error) {
+	var members = make([]ListMember, 0)
+	q := datastore.NewQuery("ListMember").Ancestor(todoListKey(ctx, listID))
+	_, err := q.GetAll(ctx, &members)
+	return members, err
+}
+
+// Returns the lists u has been invited to, either accepted or not
+func memberLists(ctx context.Context, u *user.User, accepted bool) ([]TodoListMatch, []ListMember, error) {
+	var members = make([]ListMember, 0)
+	q := datastore.NewQuery("ListMember").Filter("Email=", u.Email).Filter("Accepted=", accepted)
+	keys, err := q.GetAll(ctx, &members)
+	if err != nil {
+		return nil, nil, err
+	}
+	var listKeys = make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		listKeys[i] = k.Parent()
+	}
+	var lists = make([]TodoList, len(keys))
+	if err := datastore.GetMulti(ctx, listKeys, lists); err != nil {
+		return nil, nil, err
+	}
+	var matches = make([]TodoListMatch, len(keys))
+	for i, k := range listKeys {
+		matches[i] = TodoListMatch{k, lists[i]}
+	}
+	return matches, members, nil
+}
+
+// Returns the lists other people have shared with u
+func sharedTodoLists(ctx context.Context, u *user.User) *MaybeError {
+	var result = new(MaybeError)
+	lists, _, err := memberLists(ctx, u, true)
+	if err != nil {
+		log("sharedTodoLists error: " + err.Error())
+		*result = E(err.Error())
+	} else {
+		*result = TodoLists(lists)
+	}
+	return result
+}
+
+// Returns the invitations u hasn't accepted yet
+func listInvitations(ctx context.Context, u *user.User) *MaybeError {
+	var result = new(MaybeError)
+	lists, members, err := memberLists(ctx, u, false)
+	if err != nil {
+		*result = E(err.Error())
+		return result
+	}
+	var invitations = make([]Invitation, len(lists))
+	for i := range lists {
+		invitations[i] = Invitation{lists[i], members[i]}
+	}
+	*result = Invitations(invitations)
+	return result
+}
+
+// Returns u's own lists followed by the lists shared with u
+func visibleTodoLists(ctx context.Context, u *user.User) *MaybeError {
+	owned := listTodoLists(ctx, u)
+	switch (*owned).(type) {
+	case TodoLists:
+	default:
+		return owned
+	}
+	shared := sharedTodoLists(ctx, u)
+	switch (*shared).(type) {
+	case TodoLists:
+	default:
+		return shared
+	}
+	var result = new(MaybeError)
+	*result = append((*owned).(TodoLists), (*shared).(TodoLists)...)
+	return result
+}
+
+func sendInvitationEmail(ctx context.Context, inviterEmail string, inviteeEmail string, listName string) bool {
+	// the invitation shows up on the home page, not on the list's own page,
+	// since they can't see the list until they accept
+	url := fmt.Sprintf("https://%s/", appengine.DefaultVersionHostname(ctx))
+	msg := &mail.Message{
+		Sender:  "Tada <tada@tada-1202.appspotmail.com>",
+		To:      []string{inviteeEmail},
+		Subject: fmt.Sprintf("[Tada] %s shared the list %s with you", inviterEmail, listName),
+		Body: fmt.Sprintf(`%s wants to share the todo list "%s" with you.
+Sign in to Tada to accept: %s
+`, inviterEmail, listName, url),
+	}
+	return (mail.Send(ctx, msg) == nil)
+}
+
+// writes u's pending invitations, with buttons to accept or decline them
+func writeInvitations(w http.ResponseWriter, ctx context.Context, u *user.User) {
+	invitations := listInvitations(ctx, u)
+	switch (*invitations).(type) {
+	case Invitations:
+		for _, i := range (*invitations).(Invitations) {
+			fmt.Fprintf(w, `<div>%s invited you to <b>%s</b> as %s
+ <form action="/acceptInvite" method="post" style="display:inline">
+   <input hidden=true name="list" value="%d">
+   <input type="submit" value="Accept">
+ </form>
+ <form action="/removeMember" method="post" style="display:inline">
+   <input hidden=true name="list" value="%d">
+   <input hidden=true name="email" value="%s">
+   <input type="submit" value="Decline">
+ </form>
+</div>
+`, template.HTMLEscapeString(i.Member.InvitedBy), template.HTMLEscapeString(i.List.Value.Name),
+				i.Member.Role, i.List.Key.IntID(), i.List.Key.IntID(), template.HTMLEscapeString(u.Email))
+		}
+	default:
+		// not being able to show invitations shouldn't break the rest of the page
+	}
+}
+
+// writes the people the list with ID listID is shared with and, for owners,
+// the form for inviting somebody else
+func writeMembers(w http.ResponseWriter, ctx context.Context, listID int64, role string) {
+	members, err := listMembers(ctx, listID)
+	if err != nil {
+		return
+	}
+	fmt.Fprint(w, `<div>Shared with:<ul>`)
+	for _, m := range members {
+		var pending = ""
+		if !m.Accepted {
+			pending = " (invited)"
+		}
+		fmt.Fprintf(w, `<li>%s, %s%s`, template.HTMLEscapeString(m.Email), m.Role, pending)
+		if role == roleOwner {
+			fmt.Fprintf(w, `
+ <form action="/removeMember" method="post" style="display:inline">
+   <input hidden=true name="list" value="%d">
+   <input hidden=true name="email" value="%s">
+   <input type="submit" value="Remove">
+ </form>`, listID, template.HTMLEscapeString(m.Email))
+		}
+		fmt.Fprint(w, `</li>`)
+	}
+	fmt.Fprint(w, `</ul></div>`)
+	if role == roleOwner {
+		fmt.Fprintf(w, `
+ <form action="/shareList" method="post">
+   <input type="email" name="email">
+   <select name="role">
+     <option value="%s">viewer</option>
+     <option value="%s" selected>editor</option>
+     <option value="%s">owner</option>
+   </select>
+   <input hidden=true name="list" value="%d">
+   <input type="submit" value="Share List">
+ </form>
+`, roleViewer, roleEditor, roleOwner, listID)
+	}
+}
+
+// Expects "list", "email" and "role" parameters
+func shareListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	list := r.FormValue("list")
+	listID, err := strconv.ParseInt(list, 10, 64)
+	invitee := r.FormValue("email")
+	if err != nil {
+		http.Error(w, list+" doesn't look like a list ID to me!", 400)
+	} else if invitee == "" {
+		http.Error(w, "Who do you want to share the list with?", 400)
+	} else {
+		respondWith(w, *(inviteMember(ctx, email, listID, invitee, r.FormValue("role"))))
+		rootHandler(w, r)
+	}
+}
+
+// Expects a "list" parameter
+func acceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	list := r.FormValue("list")
+	listID, err := strconv.ParseInt(list, 10, 64)
+	if err != nil {
+		http.Error(w, list+" doesn't look like a list ID to me!", 400)
+	} else {
+		respondWith(w, *(acceptInvitation(ctx, user.Current(ctx), listID)))
+		rootHandler(w, r)
+	}
+}
+
+// Expects "list" and "email" parameters
+func removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	list := r.FormValue("list")
+	listID, err := strconv.ParseInt(list, 10, 64)
+	if err != nil {
+		http.Error(w, list+" doesn't look like a list ID to me!", 400)
+	} else {
+		respondWith(w, *(removeMember(ctx, email, listID, r.FormValue("email"))))
+		// they might not be able to see the list any more
+		r.Form.Del("list")
+		rootHandler(w, r)
+	}
+}
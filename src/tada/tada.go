@@ -4,6 +4,7 @@ package tada
 import (
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -12,7 +13,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/search"
 	"google.golang.org/appengine/taskqueue"
 	"google.golang.org/appengine/user"
@@ -30,6 +30,24 @@ type TodoItem struct {
 	Description string    // Short description of this task -- 1 sentence or less
 	DueDate     time.Time // Task due date
 	State       string    // "completed" / "incomplete". this is kind of silly but makes it easier to search for completed tasks
+	ListID      int64     `search:"-"` // ID of the TodoList this item is in; 0 for items from before there were lists
+	Assignee    string    // email address of the user who's supposed to do this; "" means the owner
+	Notes       string    `datastore:",noindex"` // longer free-form text, shown on the item's own page
+	Created     time.Time `search:"-"`           // when the item was written; zero for items from before we kept track (see migrateToInbox)
+	Version     int64     `search:"-"`           // goes up by one every time the item is written; see updateCache
+	UpdatedAt   time.Time `search:"-"`           // when Version last went up; zero for items from before we kept track
+	Tags        []string  `search:"-"`           // e.g. "errands"; set with /bulk
+	DeletedAt   time.Time `search:"-"`           // when it went in the trash; zero if it isn't there
+	ICalUID     string    `search:"-"`           // the UID a calendar client gave it, if one made it; see caldav.go
+	DAVName     string    `search:"-"`           // the name a CalDAV client PUT it as, without ".ics"
+	Priority    string    `search:"-"`           // "A" (most important) to "Z", like todo.txt; "" if it doesn't have one
+	ImportID    string    `search:"-"`           // where it came from if it was imported from another app, e.g. "gtasks:<id>"; see importers.go
+}
+
+// Items in the trash are left out of lists and searches, and readTodoItem
+// acts like they aren't there; see trash.go
+func (item TodoItem) InTrash() bool {
+	return !item.DeletedAt.IsZero()
 }
 
 type TodoID datastore.Key // database key / unique ID for a todo item
@@ -49,7 +67,6 @@ type Match struct {
 	Value TodoItem
 }
 type Matches []Match
-type SearchResults []TodoItem
 type Blob []byte
 
 func (err E) isMaybeError()              {}
@@ -57,8 +74,8 @@ func (ok Ok) isMaybeError()              {}
 func (c CacheMiss) isMaybeError()        {}
 func (t_item TodoItem) isMaybeError()    {}
 func (t_id TodoID) isMaybeError()        {}
+func (t_id Match) isMaybeError()         {}
 func (t_id Matches) isMaybeError()       {}
-func (t_id SearchResults) isMaybeError() {}
 func (t_id Blob) isMaybeError()          {}
 
 func log(s string) {
@@ -72,17 +89,48 @@ func log(s string) {
 // user is a separate argument for testing reasons
 // Adds a reminder iff remind is true
 func writeTodoItem(ctx context.Context, description string, dueDate time.Time, state bool, u *user.User, remind bool) *MaybeError {
+	return writeTodoItemInList(ctx, description, dueDate, state, u, remind, 0)
+}
+
+// The same as writeTodoItem, but puts the new item in the list with ID listID.
+// u has to be able to edit that list.
+func writeTodoItemInList(ctx context.Context, description string, dueDate time.Time, state bool, u *user.User, remind bool, listID int64) *MaybeError {
 	var taskState = "incomplete"
 	if state {
 		taskState = "completed"
 	}
-	item := TodoItem{
+	return writeNewTodoItem(ctx, TodoItem{
 		Description: description,
 		DueDate:     dueDate,
 		State:       taskState,
-		OwnerEmail:  u.Email,
+		ListID:      listID,
+	}, u, remind)
+}
+
+// Saves item as a new item owned by u, for when there's more to it than
+// writeTodoItemInList takes, like notes and tags. u has to be able to edit
+// item's list.
+func writeNewTodoItem(ctx context.Context, item TodoItem, u *user.User, remind bool) *MaybeError {
+	return writeNewTodoItemWithKey(ctx, datastore.NewIncompleteKey(ctx, "TodoItem", nil), item, u, remind)
+}
+
+// The same as writeNewTodoItem, but saves it under key, which can be
+// incomplete. See runImportBatch.
+func writeNewTodoItemWithKey(ctx context.Context, key *datastore.Key, item TodoItem, u *user.User, remind bool) *MaybeError {
+	if item.ListID != 0 && !canEdit(listRole(ctx, u.Email, item.ListID)) {
+		var result = new(MaybeError)
+		*result = E("you can't add items to that list")
+		return result
+	}
+	now := time.Now()
+	item.OwnerEmail = u.Email
+	// imported items can say when they were created
+	if item.Created.IsZero() {
+		item.Created = now
 	}
-	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "TodoItem", nil), &item)
+	item.Version = 1
+	item.UpdatedAt = now
+	key, err := datastore.Put(ctx, key, &item)
 	log(fmt.Sprintf("WRITE: key = %s", key))
 	var result = new(MaybeError)
 	if err != nil {
@@ -93,6 +141,7 @@ func writeTodoItem(ctx context.Context, description string, dueDate time.Time, s
 		k := TodoID(*key)
 		// FIXME: should check the results of invalidate calls
 		invalidateCache(ctx, *key)
+		recordActivity(ctx, *key, u.Email, activityCreated, "")
 		*result = k
 		indexResult := indexCommentForSearch(ctx, k)
 		switch (*indexResult).(type) {
@@ -103,8 +152,8 @@ func writeTodoItem(ctx context.Context, description string, dueDate time.Time, s
 		case TodoID, Matches, TodoItem:
 			*result = E("weird answer from indexCommentForSearch")
 		}
-		if !state && remind {
-			queueResult := addReminder(ctx, item)
+		if item.State != "completed" && remind {
+			queueResult := addReminder(ctx, *key, item)
 			switch (*queueResult).(type) {
 			case E:
 				return queueResult
@@ -119,44 +168,108 @@ func writeTodoItem(ctx context.Context, description string, dueDate time.Time, s
 }
 
 // Takes a task description and a due date, along with an id, returns OK or an error
-func updateTodoItem(ctx context.Context, email string, description string, dueDate time.Time, state bool, id int64) *MaybeError {
+// email is the user making the change, who has to be able to edit the item
+// version is the Version of the item the change is based on; if somebody else
+// has changed the item since, this returns a Conflict instead of overwriting
+// their change. Pass anyVersion to overwrite whatever's there.
+func updateTodoItem(ctx context.Context, email string, description string, dueDate time.Time, state bool, id int64, version int64) *MaybeError {
 	var taskState = "incomplete"
 	if state {
 		taskState = "completed"
 	}
-	item := TodoItem{
-		OwnerEmail:  email,
-		Description: description,
-		DueDate:     dueDate,
-		State:       taskState,
-	}
+	return patchTodoItem(ctx, email, id, ItemPatch{
+		Description: &description,
+		DueDate:     &dueDate,
+		State:       &taskState,
+	}, version)
+}
+
+// The same as updateTodoItem, but only changes the fields patch has in it
+func patchTodoItem(ctx context.Context, email string, id int64, patch ItemPatch, version int64) *MaybeError {
 	k := datastore.NewKey(ctx,
 		"TodoItem",
 		"",
 		id,
 		nil)
-	key, err := datastore.Put(ctx, k, &item)
-	log(fmt.Sprintf("UPDATE: key = %s", key))
 	var result = new(MaybeError)
-	if err != nil {
-		log("update error: " + err.Error())
-		*result = E(err.Error())
-	} else {
-		log("update succeeded " + key.String())
+	old := readTodoItem(ctx, TodoID(*k))
+	switch (*old).(type) {
+	case TodoItem:
+		if !canEdit(itemRole(ctx, email, (*old).(TodoItem))) {
+			*result = E("you can't change that item")
+			return result
+		}
+	case E:
+		return old
+	}
+	changed := changeTodoItem(ctx, email, k, version, patch.apply)
+	switch (*changed).(type) {
+	case Change:
+	default:
+		return changed
+	}
+	change := (*changed).(Change)
+	log("update succeeded " + k.String())
+	recordChanges(ctx, *k, email, change.Before, change.After)
+	indexResult := indexCommentForSearch(ctx, TodoID(*k))
+	switch (*indexResult).(type) {
+	case E:
+		result = indexResult
+	case Ok:
+		*result = Ok{}
+		break
+	case TodoID, Matches, TodoItem:
+		*result = E("weird answer from indexCommentForSearch")
+	}
+	return result
+}
+
+// Reads the item with key k, calls change on it and writes it back, all in
+// one transaction, so nobody else's write can land in between. The old
+// version gets saved as a Revision by email, and if the item left its list
+// a DAVTombstone goes in the old list (hence the cross-group transaction). If version
+// isn't anyVersion and the item isn't at that version any more, nothing gets
+// written and the result is a Conflict holding the item as it is now.
+// Otherwise it's a Change. Either way the cache gets the newest version.
+func changeTodoItem(ctx context.Context, email string, k *datastore.Key, version int64, change func(*TodoItem)) *MaybeError {
+	var result = new(MaybeError)
+	var before, after TodoItem
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, k, &before); err != nil {
+			return err
+		}
+		if version != anyVersion && before.Version != version {
+			return errConflict
+		}
+		after = before
+		change(&after)
+		after.Version = before.Version + 1
+		after.UpdatedAt = time.Now()
+		if _, err := datastore.Put(tc, k, &after); err != nil {
+			return err
+		}
+		revision := Revision{before, email, after.UpdatedAt}
+		if _, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, "Revision", k), &revision); err != nil {
+			return err
+		}
+		if after.ListID != before.ListID {
+			return putDAVTombstone(tc, Match{k, before}, after.UpdatedAt)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	switch err {
+	case nil:
 		// n.b. This updateCache call is necessary for consistency
 		// because otherwise, a successive call to listTodoItems might not be
 		// consistent with the results of this call to update
-		updateCache(ctx, *key, item)
-		indexResult := indexCommentForSearch(ctx, TodoID(*key))
-		switch (*indexResult).(type) {
-		case E:
-			result = indexResult
-		case Ok:
-			*result = Ok{}
-			break
-		case TodoID, Matches, TodoItem:
-			*result = E("weird answer from indexCommentForSearch")
-		}
+		updateCache(ctx, *k, after)
+		*result = Change{before, after}
+	case errConflict:
+		updateCache(ctx, *k, before)
+		*result = Conflict{before}
+	default:
+		log("update error: " + err.Error())
+		*result = E(err.Error())
 	}
 	return result
 }
@@ -176,7 +289,10 @@ func indexCommentForSearch(ctx context.Context, itemID TodoID) *MaybeError {
 		case TodoItem:
 			log(fmt.Sprintf("Putting: %s of kind %s and %s", *item, v.Kind(), v.Elem().Kind()))
 			titem := (*item).(TodoItem)
-			_, err2 := index.Put(ctx, "", &titem)
+			// use the item's ID as the document ID, so updates replace
+			// the old document and search results can find the item
+			key := datastore.Key(itemID)
+			_, err2 := index.Put(ctx, strconv.FormatInt(key.IntID(), 10), &titem)
 			if err2 != nil {
 				*result = E(err2.Error())
 			} else {
@@ -189,8 +305,22 @@ func indexCommentForSearch(ctx context.Context, itemID TodoID) *MaybeError {
 	return result
 }
 
-// Takes a todo item ID, returns a todo item
+// Takes a todo item ID, returns a todo item, or an error if it's in the trash
 func readTodoItem(ctx context.Context, itemID TodoID) *MaybeError {
+	item := readTodoItemWithTrash(ctx, itemID)
+	switch (*item).(type) {
+	case TodoItem:
+		if (*item).(TodoItem).InTrash() {
+			var result = new(MaybeError)
+			*result = E("that item is in the trash")
+			return result
+		}
+	}
+	return item
+}
+
+// The same as readTodoItem, but items in the trash are fine too
+func readTodoItemWithTrash(ctx context.Context, itemID TodoID) *MaybeError {
 	// n.b. doesn't check the owner
 	item := new(TodoItem)
 	var err error
@@ -210,98 +340,221 @@ func readTodoItem(ctx context.Context, itemID TodoID) *MaybeError {
 	} else {
 		log("read succeeded with " + item.Description)
 		*result = *item
+		// only cache things that are really there
+		updateCache(ctx, *key, *item)
 	}
-	updateCache(ctx, *key, *item)
 	return (result)
 }
 
-// Returns an array of all todo items
-func listTodoItems(ctx context.Context, u *user.User) *MaybeError {
+// The same as calling readTodoItem on each key, but with one round trip to
+// memcache and at most one to the datastore, for whatever wasn't cached.
+// Keys for items that don't exist any more or are in the trash are left out
+// of the results; the rest stay in the same order as keys.
+func readTodoItems(ctx context.Context, keys []*datastore.Key) *MaybeError {
+	items := readTodoItemsWithTrash(ctx, keys)
+	switch (*items).(type) {
+	case Matches:
+		var live = make([]Match, 0, len(keys))
+		for _, m := range (*items).(Matches) {
+			if !m.Value.InTrash() {
+				live = append(live, m)
+			}
+		}
+		var result = new(MaybeError)
+		*result = Matches(live)
+		return result
+	}
+	return items
+}
+
+// The same as readTodoItems, but leaves in the items that are in the trash
+func readTodoItemsWithTrash(ctx context.Context, keys []*datastore.Key) *MaybeError {
 	var result = new(MaybeError)
-	var resultList = make([]TodoItem, 0)
+	var items = make([]TodoItem, len(keys))
+	var found = make([]bool, len(keys))
+	cached, deleted := lookupCacheMulti(ctx, keys)
+	var missKeys = make([]*datastore.Key, 0)
+	var missIndices = make([]int, 0)
+	for i, k := range keys {
+		if item, ok := cached[k.String()]; ok {
+			items[i] = item
+			found[i] = true
+		} else if !deleted[k.String()] { // tombstones get left out, like ErrNoSuchEntity below
+			missKeys = append(missKeys, k)
+			missIndices = append(missIndices, i)
+		}
+	}
+	log(fmt.Sprintf("readTodoItems: %d cached, %d to read", len(keys)-len(missKeys), len(missKeys)))
+	if len(missKeys) > 0 {
+		var missItems = make([]TodoItem, len(missKeys))
+		err := datastore.GetMulti(ctx, missKeys, missItems)
+		var errs appengine.MultiError
+		if err != nil {
+			var isMulti bool
+			if errs, isMulti = err.(appengine.MultiError); !isMulti {
+				*result = E(err.Error())
+				return result
+			}
+		}
+		var fillKeys = make([]*datastore.Key, 0, len(missKeys))
+		var fillItems = make([]TodoItem, 0, len(missKeys))
+		for j, k := range missKeys {
+			if errs != nil && errs[j] != nil {
+				if errs[j] == datastore.ErrNoSuchEntity {
+					// deleted since the query ran
+					continue
+				}
+				*result = E(errs[j].Error())
+				return result
+			}
+			items[missIndices[j]] = missItems[j]
+			found[missIndices[j]] = true
+			fillKeys = append(fillKeys, k)
+			fillItems = append(fillItems, missItems[j])
+		}
+		updateCacheMulti(ctx, fillKeys, fillItems)
+	}
+	var matches = make([]Match, 0, len(keys))
+	for i, k := range keys {
+		if found[i] {
+			matches = append(matches, Match{k, items[i]})
+		}
+	}
+	*result = Matches(matches)
+	return result
+}
+
+// The same as readTodoItem, but returns an error unless email is allowed to
+// see the item (because they created it or it's in a list shared with them)
+func readTodoItemAs(ctx context.Context, email string, itemID TodoID) *MaybeError {
+	item := readTodoItem(ctx, itemID)
+	switch (*item).(type) {
+	case TodoItem:
+		if !canView(itemRole(ctx, email, (*item).(TodoItem))) {
+			var result = new(MaybeError)
+			*result = E("you can't see that item")
+			return result
+		}
+	}
+	return item
+}
+
+// Returns an array of all todo items: the ones u created, plus the ones in
+// u's lists (collaborators can add to those) and in lists other people have
+// shared with u
+func listTodoItems(ctx context.Context, u *user.User) *MaybeError {
+	return listTodoItemsFiltered(ctx, u, ItemFilter{})
+}
+
+// The same as listTodoItems, filtered and sorted by f
+func listTodoItemsFiltered(ctx context.Context, u *user.User, f ItemFilter) *MaybeError {
 	// filter by user
 	log(fmt.Sprintf("Making query, email = %s", u.Email))
 
-	q := datastore.NewQuery("TodoItem").Filter("OwnerEmail=", u.Email).Order("DueDate")
-	keys, err := q.GetAll(ctx, &resultList)
-	if err != nil {
-		log(fmt.Sprintf("listTodoItems got %d keys err = %s", len(keys), err.Error()))
-		*result = E(err.Error())
-	} else {
-		log(fmt.Sprintf("got %d items %s [%s] / [%s]\n", len(keys), u.Email, keys, resultList))
-		// *assuming* these are going to be in the same order...
-		var matches = make([]Match, 0)
-		// this is a bit silly since we already did the database query, but...
-		// if we call readTodoItem we get the more-recent item in the cache
-		for _, k := range keys {
-			anItem := readTodoItem(ctx, TodoID(*k))
-			switch (*anItem).(type) {
-			case TodoItem:
-				matches = append(matches, Match{k, (*anItem).(TodoItem)})
-			default:
-				*result = (E("readTodoItem returned weird result in listTodoItems"))
-				return result
+	q := applyFilter(datastore.NewQuery("TodoItem").Filter("OwnerEmail=", u.Email), f)
+	owned := listTodoItemsForQuery(ctx, u, q)
+	switch (*owned).(type) {
+	case Matches:
+	default:
+		return owned
+	}
+	lists := visibleTodoLists(ctx, u)
+	switch (*lists).(type) {
+	case TodoLists:
+	default:
+		return lists
+	}
+	var visible = make(map[int64]bool)
+	for _, l := range (*lists).(TodoLists) {
+		visible[l.Key.IntID()] = true
+	}
+	var matches = make([]Match, 0)
+	var seen = make(map[int64]bool)
+	for _, m := range (*owned).(Matches) {
+		// n.b. u might not be in the item's list any more
+		if m.Value.ListID == 0 || visible[m.Value.ListID] {
+			seen[m.Key.IntID()] = true
+			matches = append(matches, m)
+		}
+	}
+	for _, l := range (*lists).(TodoLists) {
+		inList := listTodoItemsForQuery(ctx, u, applyFilter(inListQuery(l.Key.IntID()), f))
+		switch (*inList).(type) {
+		case Matches:
+			for _, m := range (*inList).(Matches) {
+				// u created most of the items in their own lists
+				if !seen[m.Key.IntID()] {
+					seen[m.Key.IntID()] = true
+					matches = append(matches, m)
+				}
 			}
+		default:
+			return inList
 		}
-		*result = Matches(matches)
 	}
+	sortAllMatches(matches, f)
+	var result = new(MaybeError)
+	*result = Matches(matches)
 	return result
 }
 
-// Searches for the string s in *comments* (not short descriptions, for the time being,)
-// returns an array of all matching todo items
-// note: it would probably be more useful to be able to go to the actual todo item
-// so you can edit it, but ignoring that for now
-func searchTodoItems(ctx context.Context, query string) *MaybeError {
+type byDueDate []Match
+
+func (m byDueDate) Len() int           { return len(m) }
+func (m byDueDate) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byDueDate) Less(i, j int) bool { return m[i].Value.DueDate.Before(m[j].Value.DueDate) }
+
+// Returns an array of the todo items in the list with ID listID,
+// including ones other people put there if the list is shared
+func listTodoItemsInList(ctx context.Context, u *user.User, listID int64) *MaybeError {
+	if !canView(listRole(ctx, u.Email, listID)) {
+		var result = new(MaybeError)
+		*result = E("you can't see that list")
+		return result
+	}
+	return listTodoItemsForQuery(ctx, u, inListQuery(listID).Order("DueDate"))
+}
+
+// n.b. unordered, so applyFilter can add the order
+func inListQuery(listID int64) *datastore.Query {
+	return datastore.NewQuery("TodoItem").Filter("ListID=", listID)
+}
+
+func listTodoItemsForQuery(ctx context.Context, u *user.User, q *datastore.Query) *MaybeError {
 	var result = new(MaybeError)
-	index, err := search.Open("tada")
-	log("Opened the index")
+	// only get the keys: the query's copies of the items might be older
+	// than what's in the cache, so we read them with readTodoItems instead
+	keys, err := q.KeysOnly().GetAll(ctx, nil)
 	if err != nil {
-		log("Got an error")
+		log(fmt.Sprintf("listTodoItems got %d keys err = %s", len(keys), err.Error()))
 		*result = E(err.Error())
 	} else {
-		log("Got an Index")
-		var array = make([]TodoItem, 0, 10)
-		log(fmt.Sprintf("array len: %d", len(array)))
-		log("About to do search")
-		for iter := index.Search(ctx, "Description:"+query, nil); ; {
-			log("at head of loop")
-			var item TodoItem
-			_, err := iter.Next(&item)
-			if err == search.Done {
-				log("done.")
-				break
-			}
-			if err != nil {
-				log("some kind of error")
-				*result = E(err.Error())
-				return result
-			} else {
-				array = append(array, item)
-				log(fmt.Sprintf("an item! %s", array))
-
-			}
-		}
-		a := make([]TodoItem, len(array))
-		copy(a, array)
-		*result = SearchResults(a)
+		log(fmt.Sprintf("got %d items %s [%s]\n", len(keys), u.Email, keys))
+		result = readTodoItems(ctx, keys)
 	}
 	return result
 }
 
+// The pull task for item's reminder; payload is the encoded Reminder
+func reminderTask(payload []byte, item TodoItem) *taskqueue.Task {
+	return &taskqueue.Task{
+		Payload: payload,
+		Method:  "PULL",
+		// so deleteAccount can find them
+		Tag: item.OwnerEmail,
+	}
+}
+
 // Adds a reminder with the given text and due date to the pull queue.
 // A reminder will be sent half an hour before the due date
-func addReminder(ctx context.Context, item TodoItem) *MaybeError {
-	maybeBlob := itemToJson(item)
+// key is the item's key, so the sender can look up who it's assigned to by then
+func addReminder(ctx context.Context, key datastore.Key, item TodoItem) *MaybeError {
+	maybeBlob := reminderToJson(Reminder{item, key.Encode()})
 	switch (*maybeBlob).(type) {
 	case Blob:
 		{
 			item1 := ([]byte)((*maybeBlob).(Blob))
-			t := &taskqueue.Task{
-				Payload: []byte(item1),
-				Method:  "PULL",
-			}
-			_, err := taskqueue.Add(ctx, t, "reminders")
+			_, err := taskqueue.Add(ctx, reminderTask(item1, item), "reminders")
 			if err != nil {
 				var result = new(MaybeError)
 				*result = E(err.Error())
@@ -334,28 +587,60 @@ func handleError(w http.ResponseWriter, err error) bool {
 }
 
 // writes the list of existing to-do list arguments
-func writeItems(w http.ResponseWriter, r *http.Request, u *user.User) {
+// items is the result of listTodoItemsInList or listAssignedTodoItems
+// lists is all of u's lists, for the "move to" menu
+// canEdit is false for people who can only look at the list
+func writeItems(w http.ResponseWriter, r *http.Request, u *user.User, items *MaybeError, lists TodoLists, canEdit bool) {
 	var (
 		funcMap = template.FuncMap{
 			"Equal":   func(a, b string) bool { return a == b },
 			"FmtDate": func(d time.Time) string { return d.Format("2006-01-02") },
-			"FmtKey":  func(k datastore.Key) int64 { return k.IntID() },
+			"FmtKey":  func(k *datastore.Key) int64 { return k.IntID() },
+			"Equal64": func(a, b int64) bool { return a == b },
 		}
 	)
 
-	const todoItem = `<li>{{if Equal .Value.State "completed"}}<strike>{{else}}{{end}}
-<font color="green">{{.Value.Description}}</font>,
+	const todoItem = `<li>{{if .CanEdit}}<input type="checkbox" name="id" value="{{FmtKey .Key}}" form="bulk"> {{end}}{{if Equal .Value.State "completed"}}<strike>{{else}}{{end}}
+{{if .Value.Priority}}({{.Value.Priority}}) {{end}}<a href="/todo/{{FmtKey .Key}}"><font color="green">{{.Value.Description}}</font></a>,
 due on <b><i>{{.Value.DueDate}}</i></b>
+{{if .Value.Assignee}}, assigned to {{.Value.Assignee}}{{end}}
+{{range .Value.Tags}} <i>#{{.}}</i>{{end}}
 {{if Equal .Value.State "completed"}}</strike>{{else}}{{end}}
+{{if .CanEdit}}
  <form action="/updateTask" method="post">
 <p style="border-style:groove;border-width:3px;border-color:pink">
    <textarea name="description">{{.Value.Description}}</textarea>
    <input type="date" name="dueDate" value="{{FmtDate .Value.DueDate}}">
+   <input hidden=true name="state" value="off">
    <input type="checkbox" name="state" {{if Equal .Value.State "completed"}}checked{{else}}{{end}}>
    <input hidden=true name="id" value={{FmtKey .Key}}>
+   <input hidden=true name="list" value={{.Value.ListID}}>
+   <input hidden=true name="version" value={{.Value.Version}}>
    <input type="submit" value="Save Todo Item">
 </p>
  </form>
+ <form action="/updateTask" method="post">
+   <input hidden=true name="id" value={{FmtKey .Key}}>
+   <input hidden=true name="list" value={{.Value.ListID}}>
+   <input hidden=true name="version" value={{.Value.Version}}>
+{{if Equal .Value.State "completed"}}   <input hidden=true name="state" value="incomplete">
+   <input type="submit" value="Reopen">
+{{else}}   <input hidden=true name="state" value="completed">
+   <input type="submit" value="Mark Done">
+{{end}} </form>
+ <form action="/moveTask" method="post">
+   <input hidden=true name="id" value={{FmtKey .Key}}>
+   <select name="list">
+{{range .Lists}}     <option value="{{FmtKey .Key}}"{{if Equal64 (FmtKey .Key) $.Value.ListID}} selected{{end}}>{{.Value.Name}}</option>
+{{end}}   </select>
+   <input type="submit" value="Move">
+ </form>
+ <form action="/assignTask" method="post">
+   <input hidden=true name="id" value={{FmtKey .Key}}>
+   <input type="email" name="assignee" value="{{.Value.Assignee}}">
+   <input type="submit" value="Assign">
+ </form>
+{{end}}
 </li>
 ` // However, the record has no ItemId field...
 
@@ -364,10 +649,6 @@ due on <b><i>{{.Value.DueDate}}</i></b>
 	todoItemT, err := template.New("todoItem").Funcs(funcMap).Parse(todoItem)
 	if !handleError(w, err) {
 		//		fmt.Fprintf(w, "Created template")
-		// create AppEngine context
-		ctx := appengine.NewContext(r)
-
-		items := listTodoItems(ctx, user.Current(ctx))
 		//		fmt.Fprintf(w, "Called listTodoItems")
 		switch (*items).(type) {
 		case Matches:
@@ -376,7 +657,11 @@ due on <b><i>{{.Value.DueDate}}</i></b>
 				//				fmt.Fprintf(w, "Got %d items\n", len(itemList))
 				for _, r := range itemList {
 					//					fmt.Fprintf(w, "Item: %", r)
-					err = todoItemT.Execute(w, r)
+					err = todoItemT.Execute(w, struct {
+						Match
+						Lists   TodoLists
+						CanEdit bool
+					}{r, lists, canEdit})
 					// ignore the return value: if there's an error
 					// rendering one item, we still try to render the
 					// others
@@ -397,16 +682,17 @@ due on <b><i>{{.Value.DueDate}}</i></b>
 	}
 }
 
-// writes the form for creating a new todo list item
-func makeNewItemForm(w http.ResponseWriter) {
+// writes the form for creating a new todo list item in the list with ID listID
+func makeNewItemForm(w http.ResponseWriter, listID int64) {
 	const form = `
  <form action="/putTodo" method="post">
       <div><textarea name="description" rows="1" cols="100"></textarea></div>
       <div><input type="date" name="dueDate"></div>
+      <input hidden=true name="list" value="%d">
       <div><input type="submit" value="Add Todo Item"></div>
     </form>
 `
-	fmt.Fprint(w, form)
+	fmt.Fprintf(w, form, listID)
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -418,22 +704,105 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	maybeListID := currentListID(ctx, r, u)
+	var listKey datastore.Key
+	switch (*maybeListID).(type) {
+	case TodoListID:
+		listKey = datastore.Key((*maybeListID).(TodoListID))
+	default:
+		respondWith(w, *maybeListID)
+		return
+	}
+	maybeInbox := ensureInbox(ctx, u)
+	switch (*maybeInbox).(type) {
+	case TodoListID:
+		inboxKey := datastore.Key((*maybeInbox).(TodoListID))
+		// ignore errors: the old items just stay out of sight until next time
+		migrateToInboxOnce(ctx, u, inboxKey.IntID())
+	}
+	maybeLists := visibleTodoLists(ctx, u)
+	var lists TodoLists
+	switch (*maybeLists).(type) {
+	case TodoLists:
+		lists = (*maybeLists).(TodoLists)
+	default:
+		respondWith(w, *maybeLists)
+		return
+	}
+	var current = TodoListMatch{&listKey, TodoList{}}
+	for _, l := range lists {
+		if l.Key.IntID() == listKey.IntID() {
+			current = l
+		}
+	}
+
+	role := listRole(ctx, u.Email, listKey.IntID())
+	pageSize, token, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	filter, err := filterFromRequest(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	fmt.Fprint(w, `<html><h1>Hi! Welcome to Tada</h1>`)
 
+	writeInvitations(w, ctx, u)
+	writeListSwitcher(w, ctx, u, lists, listKey.IntID())
+
 	fmt.Fprint(w, "<!-- About to call writeItems -->")
 
-	fmt.Fprint(w, `<ol>`)
-	writeItems(w, r, u)
-	fmt.Fprint(w, `</ol>`)
+	makeFilterForm(w, r)
+	var page *MaybeError
+	switch r.FormValue("view") {
+	case "trash":
+		writeTrash(w, listTrash(ctx, u, listKey.IntID()), listKey.IntID(), canEdit(role))
+		writeViewLinks(w, r, listKey.IntID())
+	case "assigned":
+		fmt.Fprint(w, `<h2>Assigned to me</h2><ol>`)
+		page = listAssignedTodoItemsPage(ctx, u, filter, pageSize, token)
+		// whoever an item's assigned to can edit it, whichever list it's in
+		writeItems(w, r, u, pageItems(page), lists, true)
+		fmt.Fprint(w, `</ol>`)
+		writeBulkForm(w, listKey.IntID(), lists)
+		writeViewLinks(w, r, 0)
+	default:
+		fmt.Fprint(w, `<ol>`)
+		page = listTodoItemsInListPage(ctx, u, listKey.IntID(), filter, pageSize, token)
+		writeItems(w, r, u, pageItems(page), lists, canEdit(role))
+		fmt.Fprint(w, `</ol>`)
+		if canEdit(role) {
+			writeBulkForm(w, listKey.IntID(), lists)
+		}
+		fmt.Fprintf(w, `<a href="/?list=%d&view=trash">Trash</a> <a href="/export.csv?list=%d">Export CSV</a>`, listKey.IntID(), listKey.IntID())
+		if canEdit(role) {
+			fmt.Fprintf(w, ` <a href="/importCSV?list=%d">Import CSV</a> <a href="/importFrom?list=%d">Import from another app</a>`, listKey.IntID(), listKey.IntID())
+		}
+		writeViewLinks(w, r, listKey.IntID())
+		writeTodoTxtForm(w, listKey.IntID(), canEdit(role))
+	}
+	if page != nil {
+		writeNextPageLink(w, r, "/", page, append([]string{"list", "view"}, filterParams...)...)
+	}
+	makeSearchForm(w)
 
 	fmt.Fprint(w, "<!-- Called writeItems -->")
 
 	url, _ := user.LogoutURL(ctx, "/")
-	fmt.Fprintf(w, `Welcome, %s! (<a href="%s">sign out</a>)`, u, url)
+	fmt.Fprintf(w, `Welcome, %s! (<a href="%s">sign out</a>) <a href="/calendarFeed">Calendar feed</a> <a href="/apiToken">API token</a> <a href="/exportAccount">Download my data</a> <a href="/deleteAccount">Delete my account</a>`, u, url)
 
 	fmt.Fprint(w, `</html>`)
 
-	makeNewItemForm(w)
+	if canEdit(role) {
+		makeNewItemForm(w, listKey.IntID())
+	}
+	if role == roleOwner {
+		makeListForms(w, current)
+	}
+	writeMembers(w, ctx, listKey.IntID(), role)
 }
 
 func todoIDFromString(s string) (*int64, error) {
@@ -448,10 +817,8 @@ func todoIDFromString(s string) (*int64, error) {
 
 }
 
+// The same as /todo/{id}, but with the ID as a parameter
 func getTodoHandler(w http.ResponseWriter, r *http.Request) {
-	// create AppEngine context
-	ctx := appengine.NewContext(r)
-
 	// get id from request
 	id := r.FormValue("id")
 	// read a TodoItem from Datastore
@@ -460,9 +827,7 @@ func getTodoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "You asked for a todo item that isn't a valid ID: "+id,
 			400)
 	} else {
-		k := datastore.NewKey(ctx, "Entity", "intID", *i, nil)
-		item := readTodoItem(ctx, TodoID(*k))
-		respondWith(w, *item)
+		writeItemDetail(w, r, *i)
 	}
 }
 
@@ -475,45 +840,56 @@ func putTodoHandler(w http.ResponseWriter, r *http.Request) {
 	// get due date from request
 	dueDate := r.FormValue("dueDate")
 	d, err := time.Parse("2006-01-02", dueDate)
+	// get list ID from request; the new item form always has one
+	list := r.FormValue("list")
+	listID, err1 := strconv.ParseInt(list, 10, 64)
 	if err != nil {
 		http.Error(w, dueDate+" doesn't look like a valid date to me!",
 			400)
+	} else if err1 != nil {
+		http.Error(w, list+" doesn't look like a list ID to me!",
+			400)
 	} else {
-		id := writeTodoItem(ctx, description, d, false, user.Current(ctx), true)
+		id := writeTodoItemInList(ctx, description, d, false, user.Current(ctx), true, listID)
 		respondWith(w, *id)
 	}
 }
 
-// The same as putTodoHandler, but it expects there to be an "id" parameter.
-// It then writes a new record with that id, overwriting the old one.
+// Changes the item in the "id" parameter. Only the fields that are in the
+// request change (see patchFromForm), so e.g. the "mark done" button doesn't
+// have to send the description and due date as well.
 func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	// create AppEngine context
 	ctx := appengine.NewContext(r)
 
-	// get description from request
-	description := r.FormValue("description")
-	// get due date from request
-	dueDate := r.FormValue("dueDate")
-	d, err := time.Parse("2006-01-02", dueDate)
+	// get whichever fields are changing from the request
+	patch := patchFromForm(r)
 	// get item ID from request
 	id := r.FormValue("id")
 	itemID, err1 := strconv.ParseInt(id, 10, 64)
+	// get the version the edit started from, so we don't clobber anybody
+	version, err2 := versionFromRequest(r)
 	// get user from logged-in user
 	email := user.Current(ctx).Email
-	if err != nil {
-		http.Error(w, dueDate+" doesn't look like a valid date to me!",
-			400)
+	if e, ok := (*patch).(E); ok {
+		http.Error(w, string(e), 400)
 	} else if err1 != nil {
 		http.Error(w, id+" doesn't look like an item ID to me!",
 			400)
+	} else if err2 != nil {
+		http.Error(w, "That doesn't look like an item version to me!",
+			400)
 	} else {
-		state := r.FormValue("state")
-		respondWith(w, *(updateTodoItem(ctx,
-			email,
-			description,
-			d,
-			state == "on",
-			itemID)))
+		result := patchTodoItem(ctx, email, itemID, (*patch).(ItemPatch), version)
+		switch (*result).(type) {
+		case Conflict:
+			conflict := (*result).(Conflict)
+			mine := conflict.Current
+			(*patch).(ItemPatch).apply(&mine)
+			writeConflict(w, r, itemID, mine, conflict, "/updateTask")
+			return
+		}
+		respondWith(w, *result)
 		rootHandler(w, r)
 	}
 }
@@ -523,13 +899,15 @@ func respondWith(w http.ResponseWriter, result MaybeError) {
 	case E:
 		// error
 		http.Error(w, string(result.(E)), 500)
+	case Conflict:
+		http.Error(w, errConflict.Error(), http.StatusConflict)
 	case TodoID:
 		// we successfully wrote the item
 		fmt.Fprintf(w, "Successfully saved to-do item!")
 	case TodoItem:
 		// show the looked-up item
 		item := result.(TodoItem)
-		fmt.Fprintf(w, "item: %s due %d", item.Description, item.DueDate)
+		fmt.Fprintf(w, "item: %s due %s", item.Description, item.DueDate.Format("2006-01-02"))
 	}
 }
 
@@ -539,9 +917,18 @@ have to fetch the todo entries individually, but this was awkward since when one
 item changes, the cached list would have to be modified
 */
 
+// Bump this whenever TodoItem's JSON changes shape, so entries written by
+// older versions of the app just look like misses instead of confusing
+// jsonToTodoItem
+const cacheSchemaVersion = 8
+
+func cacheKey(key datastore.Key) string {
+	return fmt.Sprintf("v%d:%s", cacheSchemaVersion, key.String())
+}
+
 func invalidateCache(ctx context.Context, key datastore.Key) *MaybeError {
-	// delete key from memcache
-	err := memcache.Delete(ctx, key.String())
+	// delete key from the cache
+	err := itemCache.Delete(ctx, cacheKey(key))
 	var result = new(MaybeError)
 	if err != nil {
 		*result = E(err.Error())
@@ -551,27 +938,88 @@ func invalidateCache(ctx context.Context, key datastore.Key) *MaybeError {
 	return result
 }
 
+// What deleteTodoItems caches in place of an item that's gone for good: no
+// value, and a version newer than any real one, so a reader that got the
+// item from the datastore just before it was deleted can't cache it again
+const deletedVersion = math.MaxInt64
+
+// Leaves a tombstone for key in the cache. See deletedVersion.
+func markDeletedInCache(ctx context.Context, key datastore.Key) {
+	itemCache.Set(ctx, cacheKey(key), nil, deletedVersion) // ignore errors, like updateCache
+}
+
 func lookupCache(ctx context.Context, key datastore.Key) *MaybeError {
-	maybeItem, err := memcache.Get(ctx, key.String())
+	value, err := itemCache.Get(ctx, cacheKey(key))
 	var result = new(MaybeError)
-	if err != nil { // treat all errors as "cache miss"
+	if err != nil { // treat all errors as "cache miss"; itemCache counts the ones that aren't
 		*result = CacheMiss{}
+	} else if len(value) == 0 {
+		// a tombstone: the same as the datastore would say
+		*result = E(datastore.ErrNoSuchEntity.Error())
 	} else {
-		result = jsonToTodoItem(maybeItem.Value)
+		result = jsonToTodoItem(value)
 	}
 	return result
 }
 
+// The same as lookupCache for several keys at once. Returns the items that
+// were cached, by key.String(), and the keys that have tombstones; anything
+// missing from both maps was a miss.
+func lookupCacheMulti(ctx context.Context, keys []*datastore.Key) (map[string]TodoItem, map[string]bool) {
+	var result = make(map[string]TodoItem)
+	var deleted = make(map[string]bool)
+	var cacheKeys = make([]string, len(keys))
+	var byCacheKey = make(map[string]string, len(keys))
+	for i, k := range keys {
+		cacheKeys[i] = cacheKey(*k)
+		byCacheKey[cacheKeys[i]] = k.String()
+	}
+	cached, err := itemCache.GetMulti(ctx, cacheKeys)
+	if err != nil { // treat all errors as "cache miss"
+		return result, deleted
+	}
+	for k, v := range cached {
+		if len(v) == 0 {
+			deleted[byCacheKey[k]] = true
+			continue
+		}
+		maybeItem := jsonToTodoItem(v)
+		switch (*maybeItem).(type) {
+		case TodoItem:
+			result[byCacheKey[k]] = (*maybeItem).(TodoItem)
+		default:
+			// can't decode it, so pretend it wasn't there
+		}
+	}
+	return result, deleted
+}
+
+// The same as updateCache for several items at once
+func updateCacheMulti(ctx context.Context, keys []*datastore.Key, items []TodoItem) {
+	var entries = make(map[string]CacheEntry, len(keys))
+	for i, k := range keys {
+		blob := itemToJson(items[i])
+		switch (*blob).(type) {
+		case Blob:
+			entries[cacheKey(*k)] = CacheEntry{([]byte)((*blob).(Blob)), items[i].Version}
+		default:
+			break
+		}
+	}
+	if len(entries) > 0 {
+		itemCache.SetMulti(ctx, entries) // ignore errors, like updateCache
+	}
+}
+
+// Caches item, unless the cache already has the same or a newer version of it:
+// so if two updates race, or a read races with an update, whatever's cached
+// afterwards is never older than what's in the datastore.
 func updateCache(ctx context.Context, key datastore.Key, item TodoItem) {
 	var result = itemToJson(item)
 	switch (*result).(type) {
 	case Blob:
 		blob := ([]byte)((*result).(Blob))
-		item := memcache.Item{
-			Key:   key.String(),
-			Value: blob,
-		}
-		memcache.Set(ctx, &item) // ignore errors... worst that can happen is we get a cache miss later
+		itemCache.Set(ctx, cacheKey(key), blob, item.Version) // ignore errors... worst that can happen is we get a cache miss later
 	default:
 		break
 	}
@@ -1,10 +1,19 @@
 package tada
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	//	"google.golang.org/appengine/taskqueue"
@@ -84,16 +93,16 @@ func TestTextSearch(t *testing.T) {
 	writeTodoItem(ctx, "phone up my friend", dueDate, false, &testUser, false)
 	writeTodoItem(ctx, "buy a new phone", dueDate, false, &testUser, false)
 	writeTodoItem(ctx, "feed the fish", dueDate, false, &testUser, false)
-	queryResults := searchTodoItems(ctx, "phone")
+	queryResults := searchTodoItemsPage(ctx, &testUser, "phone", maxPageSize, "")
 	switch (*queryResults).(type) {
-	case SearchResults:
-		items := ([]TodoItem)((*queryResults).(SearchResults))
+	case Page:
+		items := (*queryResults).(Page).Items
 		assert(t, len(items) == 2, "wrong number of search results")
 		// order is *not* deterministic
-		assert(t, items[0].Description == "buy a new phone" || items[1].Description == "buy a new phone", "neither task had description 'buy a new phone'")
-		assert(t, items[0].Description == "phone up my friend" || items[1].Description == "phone up my friend", "neither task had description 'phone up my friend'")
-	case E, TodoID, TodoItem, Matches:
-		t.Fatal("Didn't get a SearchResults result from a search")
+		assert(t, items[0].Value.Description == "buy a new phone" || items[1].Value.Description == "buy a new phone", "neither task had description 'buy a new phone'")
+		assert(t, items[0].Value.Description == "phone up my friend" || items[1].Value.Description == "phone up my friend", "neither task had description 'phone up my friend'")
+	default:
+		t.Fatal("Didn't get a Page result from a search")
 	}
 
 	defer done()
@@ -180,7 +189,7 @@ func TestListUpdateList(t *testing.T) {
 		case Matches:
 			items := ([]Match)((*listResults).(Matches))
 			assert(t, len(items) == 1, fmt.Sprintf("wrong number of todo items: expected 1, saw %d", len(items)))
-			result := updateTodoItem(ctx, testUser.Email, "phone up my friend", dueDate, true, k.IntID())
+			result := updateTodoItem(ctx, testUser.Email, "phone up my friend", dueDate, true, k.IntID(), anyVersion)
 			assert(t, *result == Ok{}, fmt.Sprintf("error updating item: %s", *result))
 			_, err := memcache.Get(ctx, testUser.Email)
 			assert(t, err == memcache.ErrCacheMiss, "user's todo list was still cached after updating an item")
@@ -215,7 +224,7 @@ func TestUpdate(t *testing.T) {
 	switch (*id).(type) {
 	case TodoID:
 		id1 := ((datastore.Key)((*id).(TodoID)))
-		result := updateTodoItem(ctx, testUser.Email, "phone up my friend", dueDate, true, id1.IntID())
+		result := updateTodoItem(ctx, testUser.Email, "phone up my friend", dueDate, true, id1.IntID(), anyVersion)
 		switch (*result).(type) {
 		case Ok:
 		case Matches, E, TodoID, TodoItem:
@@ -322,15 +331,20 @@ func TestMemcacheRead(t *testing.T) {
 		case TodoItem:
 			read_item := (*item).(TodoItem)
 			k := datastore.Key(id1)
-			cache_item, err := memcache.Get(ctx, k.String())
+			cache_item, err := memcache.Get(ctx, cacheKey(k))
 			if err != nil {
 				t.Fatal("memcache error")
 			}
-			cache_value := jsonToTodoItem(cache_item.Value)
+			entry, err := decodeCacheEntry(cache_item.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, entry.Version == read_item.Version, "cache entry has the wrong version")
+			cache_value := jsonToTodoItem(entry.Value)
 			switch (*cache_value).(type) {
 			case TodoItem:
 				cached_item := (*cache_value).(TodoItem)
-				assert(t, read_item == cached_item, "Cached todo item differs from the original item")
+				assert(t, reflect.DeepEqual(read_item, cached_item), "Cached todo item differs from the original item")
 			default:
 				t.Fatal("memcache.Get returned a weird result")
 			}
@@ -361,12 +375,16 @@ func TestMemcacheUpdate(t *testing.T) {
 		switch (*item).(type) {
 		case TodoItem:
 			int_id := datastore.Key(id1)
-			updateTodoItem(ctx, testUser.Email, "Brush my teeth", dueDate1, false, int_id.IntID())
-			cached_value, err := memcache.Get(ctx, int_id.String())
+			updateTodoItem(ctx, testUser.Email, "Brush my teeth", dueDate1, false, int_id.IntID(), anyVersion)
+			cached_value, err := memcache.Get(ctx, cacheKey(int_id))
 			if err != nil {
 				t.Fatal("memcache.Get returned a weird result")
 			}
-			parsed_value := jsonToTodoItem(cached_value.Value)
+			entry, err := decodeCacheEntry(cached_value.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed_value := jsonToTodoItem(entry.Value)
 			switch (*parsed_value).(type) {
 			case TodoItem:
 				cached_item := (*parsed_value).(TodoItem)
@@ -385,3 +403,1076 @@ func TestMemcacheUpdate(t *testing.T) {
 
 	defer done()
 }
+
+// items from before there were lists don't have a ListID property at all,
+// not even 0; they should end up in the Inbox too, just the once
+func TestMigrateLegacyItems(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	legacy := &datastore.PropertyList{
+		{Name: "OwnerEmail", Value: testUser.Email},
+		{Name: "Description", Value: "water my cactus"},
+		{Name: "DueDate", Value: time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)},
+		{Name: "State", Value: "incomplete"},
+	}
+	k, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "TodoItem", nil), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := ensureInbox(ctx, &testUser)
+	inboxKey := datastore.Key((*inbox).(TodoListID))
+	result := migrateToInboxOnce(ctx, &testUser, inboxKey.IntID())
+	assert(t, *result == Ok{}, fmt.Sprintf("error migrating: %v", *result))
+	item := (*readTodoItem(ctx, TodoID(*k))).(TodoItem)
+	assert(t, item.ListID == inboxKey.IntID(), fmt.Sprintf("the item's in list %d", item.ListID))
+	newest := assertList(t, *listTodoItemsFiltered(ctx, &testUser, ItemFilter{Sort: sortByCreated}))
+	assert(t, len(newest) == 1, fmt.Sprintf("sorting by Created found %d items", len(newest)))
+
+	// and not again: this one stays where it is
+	k1, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "TodoItem", nil), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrateToInboxOnce(ctx, &testUser, inboxKey.IntID())
+	item = (*readTodoItem(ctx, TodoID(*k1))).(TodoItem)
+	assert(t, item.ListID == 0, "migrated twice")
+}
+
+// write an item before there are any lists; it should end up in the Inbox.
+// then make a second list and move the item into it
+func TestInboxAndMove(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	id := writeTodoItem(ctx, "water my cactus", dueDate, false, &testUser, false)
+	inbox := ensureInbox(ctx, &testUser)
+	switch (*inbox).(type) {
+	case TodoListID:
+		inboxKey := datastore.Key((*inbox).(TodoListID))
+		// asking again mustn't make a second one
+		again := datastore.Key((*ensureInbox(ctx, &testUser)).(TodoListID))
+		assert(t, again.IntID() == inboxKey.IntID(), "made two Inboxes")
+		migrateToInbox(ctx, &testUser, inboxKey.IntID())
+		inboxItems := assertList(t, *listTodoItemsInList(ctx, &testUser, inboxKey.IntID()))
+		assert(t, len(inboxItems) == 1, fmt.Sprintf("wrong number of items in the Inbox: %d", len(inboxItems)))
+		plants := writeTodoList(ctx, &testUser, "Plants", "green", 1)
+		switch (*plants).(type) {
+		case TodoListID:
+			plantsKey := datastore.Key((*plants).(TodoListID))
+			itemKey := datastore.Key((*id).(TodoID))
+			result := moveTodoItem(ctx, testUser.Email, itemKey.IntID(), plantsKey.IntID())
+			assert(t, *result == Ok{}, fmt.Sprintf("error moving item: %s", *result))
+			plantsItems := assertList(t, *listTodoItemsInList(ctx, &testUser, plantsKey.IntID()))
+			assert(t, len(plantsItems) == 1, fmt.Sprintf("wrong number of items in Plants: %d", len(plantsItems)))
+			// moving it into someone else's list shouldn't work
+			result1 := moveTodoItem(ctx, testUser1.Email, itemKey.IntID(), plantsKey.IntID())
+			assert(t, *result1 != Ok{}, "moved an item into a list the user doesn't own")
+		default:
+			t.Fatal("writeTodoList returned a weird result")
+		}
+	default:
+		t.Fatal("ensureInbox returned a weird result")
+	}
+	defer done()
+}
+
+// Alice shares a list with Bob, first as a viewer and then as an editor
+func TestSharedList(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	list := writeTodoList(ctx, &testUser, "Chores", "green", 0)
+	listKey := datastore.Key((*list).(TodoListID))
+	id := writeTodoItemInList(ctx, "take out the trash", dueDate, false, &testUser, false, listKey.IntID())
+	itemKey := datastore.Key((*id).(TodoID))
+
+	invite := inviteMember(ctx, testUser.Email, listKey.IntID(), testUser1.Email, roleViewer)
+	assert(t, *invite == Ok{}, fmt.Sprintf("error inviting Bob: %s", *invite))
+	_, isErr := (*listTodoItemsInList(ctx, &testUser1, listKey.IntID())).(E)
+	assert(t, isErr, "Bob could see the list before accepting the invitation")
+
+	accept := acceptInvitation(ctx, &testUser1, listKey.IntID())
+	assert(t, *accept == Ok{}, fmt.Sprintf("error accepting invitation: %s", *accept))
+	bobItems := assertList(t, *listTodoItemsInList(ctx, &testUser1, listKey.IntID()))
+	assert(t, len(bobItems) == 1, fmt.Sprintf("Bob sees the wrong number of items: %d", len(bobItems)))
+	allBobItems := assertList(t, *listTodoItems(ctx, &testUser1))
+	assert(t, len(allBobItems) == 1, fmt.Sprintf("Bob's todolist has the wrong length: %d", len(allBobItems)))
+	update := updateTodoItem(ctx, testUser1.Email, "take out the trash", dueDate, true, itemKey.IntID(), anyVersion)
+	assert(t, *update != Ok{}, "a viewer was able to change an item")
+
+	inviteMember(ctx, testUser.Email, listKey.IntID(), testUser1.Email, roleEditor)
+	update1 := updateTodoItem(ctx, testUser1.Email, "take out the trash", dueDate, true, itemKey.IntID(), anyVersion)
+	assert(t, *update1 == Ok{}, fmt.Sprintf("an editor couldn't change an item: %s", *update1))
+	item := readTodoItemAs(ctx, testUser.Email, TodoID(itemKey))
+	switch (*item).(type) {
+	case TodoItem:
+		assert(t, (*item).(TodoItem).State == "completed", "Bob's change didn't stick")
+		assert(t, (*item).(TodoItem).OwnerEmail == testUser.Email, "Bob's change made him the owner")
+	default:
+		t.Fatal("readTodoItemAs returned a weird result")
+	}
+
+	// Bob adds something to Alice's list, and she sees it along with her own
+	bobID := writeTodoItemInList(ctx, "sweep the yard", dueDate, false, &testUser1, false, listKey.IntID())
+	aliceItems := assertList(t, *listTodoItems(ctx, &testUser))
+	assert(t, len(aliceItems) == 2, fmt.Sprintf("Alice doesn't see Bob's item: %d items", len(aliceItems)))
+
+	// once Bob's out of the list, the item he wrote there isn't his any more
+	removed := removeMember(ctx, testUser.Email, listKey.IntID(), testUser1.Email)
+	assert(t, *removed == Ok{}, fmt.Sprintf("error removing Bob: %s", *removed))
+	allBobItems = assertList(t, *listTodoItems(ctx, &testUser1))
+	assert(t, len(allBobItems) == 0, fmt.Sprintf("Bob still sees %d items", len(allBobItems)))
+	bobKey := datastore.Key((*bobID).(TodoID))
+	update2 := updateTodoItem(ctx, testUser1.Email, "sweep the yard", dueDate, true, bobKey.IntID(), anyVersion)
+	assert(t, *update2 != Ok{}, "Bob changed an item in a list he was taken out of")
+	defer done()
+}
+
+// Alice assigns an item in a shared list to Bob
+func TestAssign(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	list := writeTodoList(ctx, &testUser, "Chores", "green", 0)
+	listKey := datastore.Key((*list).(TodoListID))
+	id := writeTodoItemInList(ctx, "mow the lawn", dueDate, false, &testUser, false, listKey.IntID())
+	itemKey := datastore.Key((*id).(TodoID))
+
+	result := assignTodoItem(ctx, testUser.Email, itemKey.IntID(), testUser1.Email)
+	assert(t, *result != Ok{}, "assigned an item to somebody who can't see it")
+
+	inviteMember(ctx, testUser.Email, listKey.IntID(), testUser1.Email, roleViewer)
+	acceptInvitation(ctx, &testUser1, listKey.IntID())
+	result1 := assignTodoItem(ctx, testUser.Email, itemKey.IntID(), testUser1.Email)
+	assert(t, *result1 == Ok{}, fmt.Sprintf("error assigning item: %s", *result1))
+
+	assigned := assertList(t, *listAssignedTodoItems(ctx, &testUser1))
+	assert(t, len(assigned) == 1, fmt.Sprintf("wrong number of items assigned to Bob: %d", len(assigned)))
+	if len(assigned) == 1 {
+		assertEquals(t, testUser1.Email, reminderRecipient(assigned[0].Value))
+	}
+	// Bob is only a viewer, but he can still finish the task he was given
+	update := updateTodoItem(ctx, testUser1.Email, "mow the lawn", dueDate, true, itemKey.IntID(), anyVersion)
+	assert(t, *update == Ok{}, fmt.Sprintf("the assignee couldn't change the item: %s", *update))
+	defer done()
+}
+
+// writing and updating an item should fill in its history; comments go with the item
+func TestCommentsAndActivity(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	dueDate1 := time.Date(2016, 3, 12, 13, 0, 0, 0, time.UTC)
+
+	id := writeTodoItem(ctx, "file my taxes", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	updateTodoItem(ctx, testUser.Email, "file my taxes", dueDate1, true, k.IntID(), anyVersion)
+	activities := listActivities(ctx, k)
+	switch (*activities).(type) {
+	case Activities:
+		as := (*activities).(Activities)
+		assert(t, len(as) == 3, fmt.Sprintf("wrong number of activities: %d", len(as)))
+		if len(as) == 3 {
+			assertEquals(t, activityCreated, as[0].Kind)
+			assert(t, as[1].Kind == activityDueDateChanged || as[2].Kind == activityDueDateChanged, "due date change wasn't logged")
+			assert(t, as[1].Kind == activityCompleted || as[2].Kind == activityCompleted, "completion wasn't logged")
+		}
+	default:
+		t.Fatal("listActivities returned a weird result")
+	}
+
+	result := addComment(ctx, testUser.Email, k.IntID(), "finally!")
+	assert(t, *result == Ok{}, fmt.Sprintf("error adding comment: %s", *result))
+	result1 := addComment(ctx, testUser1.Email, k.IntID(), "let me see")
+	assert(t, *result1 != Ok{}, "somebody who can't see the item commented on it")
+	comments := listComments(ctx, k)
+	switch (*comments).(type) {
+	case Comments:
+		cs := (*comments).(Comments)
+		assert(t, len(cs) == 1, fmt.Sprintf("wrong number of comments: %d", len(cs)))
+	default:
+		t.Fatal("listComments returned a weird result")
+	}
+	defer done()
+}
+
+func TestWantsJson(t *testing.T) {
+	cases := []struct {
+		accept string
+		format string
+		json   bool
+	}{
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "", false},
+		{"application/json", "", true},
+		{"application/json;q=0.5, text/html", "", false},
+		{"text/html;q=0.5, application/json", "", true},
+		{"", "", false},
+		{"text/html", "json", true},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/todo/1?format="+c.format, nil)
+		r.Header.Set("Accept", c.accept)
+		assert(t, wantsJson(r) == c.json, fmt.Sprintf("wrong answer for Accept: %q, format=%q", c.accept, c.format))
+	}
+}
+
+// listing items should leave all of them in the cache, and see updates
+// that are only in the cache so far
+func TestMemcacheBatchRead(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	id := writeTodoItem(ctx, "phone up my friend", dueDate, false, &testUser, false)
+	writeTodoItem(ctx, "buy a new phone", dueDate, false, &testUser, false)
+	// one cached, one not
+	readTodoItem(ctx, (*id).(TodoID))
+	items := assertList(t, *listTodoItems(ctx, &testUser))
+	assert(t, len(items) == 2, fmt.Sprintf("wrong number of todo items: %d", len(items)))
+	for _, m := range items {
+		_, err := memcache.Get(ctx, cacheKey(*m.Key))
+		assert(t, err == nil, fmt.Sprintf("item %s wasn't cached after listing", m.Key))
+	}
+
+	k := datastore.Key((*id).(TodoID))
+	updated := TodoItem{OwnerEmail: testUser.Email, Description: "phone up my friend", DueDate: dueDate, State: "completed", Version: 2}
+	updateCache(ctx, k, updated)
+	items1 := assertList(t, *listTodoItems(ctx, &testUser))
+	for _, m := range items1 {
+		if m.Key.IntID() == k.IntID() {
+			assert(t, m.Value.State == "completed", "listTodoItems didn't use the cached copy")
+		}
+	}
+	defer done()
+}
+
+// three items, two to a page
+func TestPaging(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	list := writeTodoList(ctx, &testUser, "Phone", "green", 0)
+	listKey := datastore.Key((*list).(TodoListID))
+	writeTodoItemInList(ctx, "phone up my friend", dueDate, false, &testUser, false, listKey.IntID())
+	writeTodoItemInList(ctx, "buy a new phone", dueDate, false, &testUser, false, listKey.IntID())
+	writeTodoItemInList(ctx, "sell my old phone", dueDate, false, &testUser, false, listKey.IntID())
+
+	page := listTodoItemsInListPage(ctx, &testUser, listKey.IntID(), ItemFilter{}, 2, "")
+	switch (*page).(type) {
+	case Page:
+		p := (*page).(Page)
+		assert(t, len(p.Items) == 2, fmt.Sprintf("wrong number of items on the first page: %d", len(p.Items)))
+		assert(t, p.Next != "", "no next page token after a full page")
+		page1 := listTodoItemsInListPage(ctx, &testUser, listKey.IntID(), ItemFilter{}, 2, p.Next)
+		switch (*page1).(type) {
+		case Page:
+			p1 := (*page1).(Page)
+			assert(t, len(p1.Items) == 1, fmt.Sprintf("wrong number of items on the second page: %d", len(p1.Items)))
+			assert(t, p1.Next == "", "got a next page token on the last page")
+		default:
+			t.Fatal(fmt.Sprintf("weird result from the second page: %s", *page1))
+		}
+	default:
+		t.Fatal(fmt.Sprintf("weird result from the first page: %s", *page))
+	}
+
+	searchPage := searchTodoItemsPage(ctx, &testUser, "phone", 2, "")
+	switch (*searchPage).(type) {
+	case Page:
+		p := (*searchPage).(Page)
+		assert(t, len(p.Items) == 2, fmt.Sprintf("wrong number of search results on the first page: %d", len(p.Items)))
+		assert(t, p.Next != "", "no next search page token after a full page")
+	default:
+		t.Fatal(fmt.Sprintf("weird result from searchTodoItemsPage: %s", *searchPage))
+	}
+	otherPage := searchTodoItemsPage(ctx, &testUser1, "phone", 10, "")
+	switch (*otherPage).(type) {
+	case Page:
+		assert(t, len((*otherPage).(Page).Items) == 0, "Bob can see Alice's items in search results")
+	default:
+		t.Fatal(fmt.Sprintf("weird result from searchTodoItemsPage: %s", *otherPage))
+	}
+	defer done()
+}
+
+func TestFilterFromRequest(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2016, 3, 2, 15, 0, 0, 0, time.UTC)
+	r, _ := http.NewRequest("GET", "/?due=week&sort=created", nil)
+	f, err := filterFromRequest(r, now)
+	assert(t, err == nil, "error parsing a good filter")
+	assertEquals(t, "2016-02-29", f.DueAfter.Format("2006-01-02"))
+	assertEquals(t, "2016-03-07", f.DueBefore.Format("2006-01-02"))
+	assertEquals(t, sortByCreated, f.Sort)
+	assert(t, f.sortsInMemory(), "the datastore can't sort a week's items by Created")
+
+	r1, _ := http.NewRequest("GET", "/?due=overdue", nil)
+	f1, _ := filterFromRequest(r1, now)
+	assert(t, f1.HideCompleted, "overdue items shouldn't include completed ones")
+	assert(t, f1.DueBefore.Equal(now), "overdue items should be due before now")
+
+	r2, _ := http.NewRequest("GET", "/?due=range&from=2016-03-01&to=2016-03-01", nil)
+	f2, _ := filterFromRequest(r2, now)
+	assertEquals(t, "2016-03-01", f2.DueAfter.Format("2006-01-02"))
+	assertEquals(t, "2016-03-02", f2.DueBefore.Format("2006-01-02"))
+	assert(t, !f2.sortsInMemory(), "the datastore can sort a date range by due date")
+
+	r3, _ := http.NewRequest("GET", "/?sort=colour", nil)
+	_, err3 := filterFromRequest(r3, now)
+	assert(t, err3 != nil, "no error for a sort order that doesn't exist")
+}
+
+// incomplete items due on one day, sorted by description
+func TestFilteredList(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	dueDate1 := time.Date(2016, 3, 12, 13, 0, 0, 0, time.UTC)
+
+	list := writeTodoList(ctx, &testUser, "Errands", "green", 0)
+	listKey := datastore.Key((*list).(TodoListID))
+	listID := listKey.IntID()
+	writeTodoItemInList(ctx, "walk the dog", dueDate, false, &testUser, false, listID)
+	writeTodoItemInList(ctx, "buy milk", dueDate, false, &testUser, false, listID)
+	writeTodoItemInList(ctx, "pay rent", dueDate, true, &testUser, false, listID)
+	writeTodoItemInList(ctx, "call mum", dueDate1, false, &testUser, false, listID)
+
+	f := ItemFilter{
+		HideCompleted: true,
+		DueAfter:      time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC),
+		DueBefore:     time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC),
+		Sort:          sortByDescription,
+	}
+	page := listTodoItemsInListPage(ctx, &testUser, listID, f, 10, "")
+	switch (*page).(type) {
+	case Page:
+		items := (*page).(Page).Items
+		assert(t, len(items) == 2, fmt.Sprintf("wrong number of filtered items: %d", len(items)))
+		if len(items) == 2 {
+			assertEquals(t, "buy milk", items[0].Value.Description)
+			assertEquals(t, "walk the dog", items[1].Value.Description)
+		}
+	default:
+		t.Fatal(fmt.Sprintf("weird result from listTodoItemsInListPage: %s", *page))
+	}
+	defer done()
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	c := newLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Set(nil, "a", []byte("1"), 1)
+	c.Set(nil, "b", []byte("2"), 1)
+	c.Get(nil, "a") // so b is the least recently used
+	c.Set(nil, "c", []byte("3"), 1)
+	_, err := c.Get(nil, "b")
+	assert(t, err == errCacheMiss, "least recently used entry should have been evicted")
+	v, err := c.Get(nil, "a")
+	assert(t, err == nil && string(v) == "1", "a should still be cached")
+	got, _ := c.GetMulti(nil, []string{"a", "b", "c"})
+	assert(t, len(got) == 2, fmt.Sprintf("expected 2 entries, got %d", len(got)))
+
+	now = now.Add(2 * time.Minute)
+	_, err = c.Get(nil, "a")
+	assert(t, err == errCacheMiss, "entries should expire after the TTL")
+	assert(t, c.Delete(nil, "c") == errCacheMiss, "expired entries shouldn't be deletable either")
+}
+
+func TestCountingCache(t *testing.T) {
+	c := newCountingCache(newLRUCache(10, time.Hour))
+	c.Set(nil, "a", []byte("1"), 1)
+	c.Get(nil, "a")
+	c.Get(nil, "b")
+	c.GetMulti(nil, []string{"a", "b", "c"})
+	stats := c.stats()
+	assert(t, stats.Hits == 2, fmt.Sprintf("expected 2 hits, got %d", stats.Hits))
+	assert(t, stats.Misses == 3, fmt.Sprintf("expected 3 misses, got %d", stats.Misses))
+	assert(t, stats.Errors == 0, fmt.Sprintf("expected no errors, got %d", stats.Errors))
+
+	n := newCountingCache(noCache{})
+	n.Set(nil, "a", []byte("1"), 1)
+	_, err := n.Get(nil, "a")
+	assert(t, err == errCacheMiss, "noCache should never have anything")
+	assert(t, n.stats().Misses == 1, "noCache lookups should count as misses")
+}
+
+// an older version of an item shouldn't replace a newer one in the cache
+func TestCacheVersions(t *testing.T) {
+	entry, err := decodeCacheEntry(encodeCacheEntry(CacheEntry{[]byte("hello"), 42}))
+	assert(t, err == nil && entry.Version == 42 && string(entry.Value) == "hello", "cache entry didn't round-trip")
+
+	c := newLRUCache(10, time.Hour)
+	c.Set(nil, "a", []byte("new"), 2)
+	c.Set(nil, "a", []byte("old"), 1)
+	v, _ := c.Get(nil, "a")
+	assertEquals(t, "new", string(v))
+	c.SetMulti(nil, map[string]CacheEntry{"a": {[]byte("newer"), 3}})
+	v, _ = c.Get(nil, "a")
+	assertEquals(t, "newer", string(v))
+
+	// once it's been deleted, a reader that's behind can't put it back
+	c.Set(nil, "a", nil, deletedVersion)
+	c.Set(nil, "a", []byte("stale"), 3)
+	v, err = c.Get(nil, "a")
+	assert(t, err == nil && len(v) == 0, fmt.Sprintf("the tombstone got replaced with %q", v))
+}
+
+func TestMemcacheVersions(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	c := memcacheCache{}
+	assert(t, c.Set(ctx, "a", []byte("new"), 2) == nil, "couldn't add to memcache")
+	assert(t, c.Set(ctx, "a", []byte("old"), 1) == nil, "couldn't skip an old version")
+	v, _ := c.Get(ctx, "a")
+	assertEquals(t, "new", string(v))
+	c.SetMulti(ctx, map[string]CacheEntry{"a": {[]byte("newer"), 3}, "b": {[]byte("b"), 1}})
+	got, _ := c.GetMulti(ctx, []string{"a", "b"})
+	assertEquals(t, "newer", string(got["a"]))
+	assertEquals(t, "b", string(got["b"]))
+}
+
+// two edits based on the same version: the second one should lose
+func TestConflict(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	id := writeTodoItem(ctx, "paint the fence", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	first := updateTodoItem(ctx, testUser.Email, "paint the fence red", dueDate, false, k.IntID(), 1)
+	_, ok := (*first).(Ok)
+	assert(t, ok, fmt.Sprintf("first update failed: %v", *first))
+	second := updateTodoItem(ctx, testUser.Email, "paint the fence blue", dueDate, false, k.IntID(), 1)
+	switch (*second).(type) {
+	case Conflict:
+		current := (*second).(Conflict).Current
+		assertEquals(t, "paint the fence red", current.Description)
+		assert(t, current.Version == 2, fmt.Sprintf("expected version 2, got %d", current.Version))
+	default:
+		t.Fatal("expected a conflict, got ", *second)
+	}
+	item := (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	assertEquals(t, "paint the fence red", item.Description)
+	assert(t, !item.UpdatedAt.IsZero(), "UpdatedAt wasn't set")
+}
+
+func TestVersionFromRequest(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/todo/1?version=3", nil)
+	v, err := versionFromRequest(r)
+	assert(t, err == nil && v == 3, "didn't get the version from the form")
+	r.Header.Set("If-Match", `W/"7"`)
+	v, err = versionFromRequest(r)
+	assert(t, err == nil && v == 7, "If-Match should win over the form")
+	r.Header.Set("If-Match", "*")
+	v, err = versionFromRequest(r)
+	assert(t, err == nil && v == anyVersion, "If-Match: * should match any version")
+	r, _ = http.NewRequest("POST", "/updateTask", nil)
+	v, err = versionFromRequest(r)
+	assert(t, err == nil && v == anyVersion, "no version should mean any version")
+}
+
+// a patch should only change the fields that are in it
+func TestPatch(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	id := writeTodoItem(ctx, "water the plants", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	updateNotes(ctx, testUser.Email, k.IntID(), "the ferns too", anyVersion)
+	completed := "completed"
+	patchTodoItem(ctx, testUser.Email, k.IntID(), ItemPatch{State: &completed}, anyVersion)
+	item := (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	assertEquals(t, "completed", item.State)
+	assertEquals(t, "water the plants", item.Description)
+	assertEquals(t, "the ferns too", item.Notes)
+	assert(t, item.DueDate.Equal(dueDate), "patching the state changed the due date")
+}
+
+func TestPatchFromForm(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/updateTask?id=1&state=off&state=on", nil)
+	patch := (*patchFromForm(r)).(ItemPatch)
+	assert(t, patch.Description == nil && patch.DueDate == nil, "fields that weren't sent shouldn't change")
+	assertEquals(t, "completed", *patch.State)
+	r, _ = http.NewRequest("POST", "/updateTask?state=off&dueDate=2016-03-01", nil)
+	patch = (*patchFromForm(r)).(ItemPatch)
+	assertEquals(t, "incomplete", *patch.State)
+	assertEquals(t, "2016-03-01", patch.DueDate.Format("2006-01-02"))
+	r, _ = http.NewRequest("POST", "/updateTask?dueDate=tomorrow", nil)
+	_, ok := (*patchFromForm(r)).(E)
+	assert(t, ok, "a bad date should be an error")
+
+	p := (*jsonToItemPatch([]byte(`{"State": "completed", "DueDate": "2016-03-01T13:00:00Z"}`))).(ItemPatch)
+	assert(t, p.Description == nil, "JSON patch shouldn't have a description")
+	assertEquals(t, "completed", *p.State)
+}
+
+func TestBulk(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	var ids []int64
+	for _, d := range []string{"rake the leaves", "clean the gutters", "fix the fence"} {
+		id := writeTodoItem(ctx, d, dueDate, false, &testUser, false)
+		k := datastore.Key((*id).(TodoID))
+		ids = append(ids, k.IntID())
+	}
+	result := bulkUpdate(ctx, testUser.Email, ids[:2], BulkAction{Action: bulkComplete})
+	assert(t, (*result).(BulkResult).Changed == 2, "should have completed two items")
+	bulkUpdate(ctx, testUser.Email, ids, BulkAction{Action: bulkShift, Days: 3})
+	bulkUpdate(ctx, testUser.Email, ids, BulkAction{Action: bulkRetag, Tags: []string{"outside"}})
+	skipped := bulkUpdate(ctx, testUser1.Email, ids, BulkAction{Action: bulkDelete})
+	assert(t, len((*skipped).(BulkResult).Skipped) == 3, "bob shouldn't be able to delete alice's items")
+	bulkUpdate(ctx, testUser.Email, ids[2:], BulkAction{Action: bulkDelete})
+	_, unknown := (*bulkUpdate(ctx, testUser1.Email, ids, BulkAction{Action: "frobnicate"})).(E)
+	assert(t, unknown, "an action that doesn't exist worked, since there was nothing Bob could change")
+
+	item := (*readTodoItem(ctx, TodoID(*todoItemKey(ctx, ids[0])))).(TodoItem)
+	assertEquals(t, "completed", item.State)
+	assertEquals(t, "2016-03-03", item.DueDate.Format("2006-01-02"))
+	assert(t, len(item.Tags) == 1 && item.Tags[0] == "outside", "item wasn't retagged")
+	revisions := (*listRevisions(ctx, testUser.Email, ids[0])).(Revisions)
+	assert(t, len(revisions) == 3, fmt.Sprintf("each change should have a revision; got %d", len(revisions)))
+	_, gone := (*readTodoItem(ctx, TodoID(*todoItemKey(ctx, ids[2])))).(E)
+	assert(t, gone, "deleted item is still there")
+}
+
+func TestParseTags(t *testing.T) {
+	tags := parseTags(" errands, ,home ")
+	assert(t, len(tags) == 2 && tags[0] == "errands" && tags[1] == "home", fmt.Sprintf("wrong tags: %v", tags))
+	assert(t, parseTags("") == nil, "no tags should be nil")
+}
+
+// moving an item out of a list leaves a tombstone there for CalDAV clients,
+// and counts as a change to the list
+func TestDAVTombstones(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	from := datastore.Key((*writeTodoList(ctx, &testUser, "Garden", "green", 0)).(TodoListID))
+	to := datastore.Key((*writeTodoList(ctx, &testUser, "House", "blue", 1)).(TodoListID))
+	id := datastore.Key((*writeTodoItemInList(ctx, "prune the roses", dueDate, false, &testUser, false, from.IntID())).(TodoID))
+	before, err := listUpdatedAt(ctx, from.IntID())
+	assert(t, err == nil, fmt.Sprintf("error getting the list's sync token: %v", err))
+
+	moved := moveTodoItem(ctx, testUser.Email, id.IntID(), to.IntID())
+	assert(t, *moved == Ok{}, fmt.Sprintf("error moving the item: %v", *moved))
+	var tombstones []DAVTombstone
+	datastore.NewQuery(davTombstoneKind).Ancestor(&from).GetAll(ctx, &tombstones)
+	assert(t, len(tombstones) == 1 && tombstones[0].DAVName == strconv.FormatInt(id.IntID(), 10),
+		fmt.Sprintf("wrong tombstones: %v", tombstones))
+	after, _ := listUpdatedAt(ctx, from.IntID())
+	assert(t, after.After(before), "the sync token didn't change when the item left")
+	assert(t, strings.HasSuffix(syncToken(time.Time{}), "/sync/0"), "an empty list's token isn't 0")
+}
+
+// things in the trash don't show up until they're restored, and purging
+// gets rid of them for good
+func TestTrash(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	id := writeTodoItem(ctx, "sweep the porch", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	item := (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	bulkUpdate(ctx, testUser.Email, []int64{k.IntID()}, BulkAction{Action: bulkDelete})
+	assert(t, len(assertList(t, *listTodoItems(ctx, &testUser))) == 0, "trashed item is still listed")
+	trash := (*listTrash(ctx, &testUser, item.ListID)).(Matches)
+	assert(t, len(trash) == 1, fmt.Sprintf("expected 1 item in the trash, got %d", len(trash)))
+	assert(t, *countTodoItems(ctx, item.ListID) == Count(0), "trashed item is still counted")
+
+	bulkUpdate(ctx, testUser.Email, []int64{k.IntID()}, BulkAction{Action: bulkRestore})
+	assert(t, len(assertList(t, *listTodoItems(ctx, &testUser))) == 1, "restored item isn't listed")
+
+	bulkUpdate(ctx, testUser.Email, []int64{k.IntID()}, BulkAction{Action: bulkDelete})
+	n, err := purgeTrash(ctx, time.Now().Add(time.Hour))
+	assert(t, err == nil && n == 1, fmt.Sprintf("expected to purge 1 item, purged %d (%v)", n, err))
+	_, gone := (*readTodoItemWithTrash(ctx, TodoID(k))).(E)
+	assert(t, gone, "purged item is still there")
+}
+
+// every change leaves a revision behind, and restoring one puts the old
+// fields back
+func TestRevisions(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	dueDate1 := time.Date(2016, 3, 12, 13, 0, 0, 0, time.UTC)
+	id := writeTodoItem(ctx, "buy milk", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	updateTodoItem(ctx, testUser.Email, "buy oat milk", dueDate1, false, k.IntID(), anyVersion)
+	updateNotes(ctx, testUser.Email, k.IntID(), "the big carton", anyVersion)
+
+	revisions := (*listRevisions(ctx, testUser.Email, k.IntID())).(Revisions)
+	assert(t, len(revisions) == 2, fmt.Sprintf("expected 2 revisions, got %d", len(revisions)))
+	oldest := revisions[len(revisions)-1]
+	assertEquals(t, "buy milk", oldest.Revision.Item.Description)
+	assert(t, len(oldest.Changes) == 2, fmt.Sprintf("expected description and due date changes, got %v", oldest.Changes))
+
+	item := (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	result := restoreRevision(ctx, testUser.Email, k.IntID(), oldest.ID, item.Version)
+	_, ok := (*result).(Ok)
+	assert(t, ok, fmt.Sprintf("restoreRevision failed: %v", *result))
+	item = (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	assertEquals(t, "buy milk", item.Description)
+	assertEquals(t, "", item.Notes)
+	assert(t, item.DueDate.Equal(dueDate), "due date wasn't restored")
+}
+
+func TestDiffItems(t *testing.T) {
+	before := TodoItem{Description: "a", State: "incomplete", OwnerEmail: testUser.Email}
+	after := before
+	after.State = "completed"
+	after.Tags = []string{"x"}
+	changes := diffItems(before, after)
+	assert(t, len(changes) == 2, fmt.Sprintf("expected 2 changes, got %v", changes))
+	assertEquals(t, "State", changes[0].Field)
+	assertEquals(t, "completed", changes[0].After)
+}
+
+func TestICal(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	items := Matches{
+		{&datastore.Key{}, TodoItem{Description: "pay rent, again", DueDate: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), State: "incomplete"}},
+		{&datastore.Key{}, TodoItem{Description: "dentist", DueDate: time.Date(2026, 11, 2, 15, 30, 0, 0, time.UTC), State: "completed", Version: 3}},
+	}
+	b := new(bytes.Buffer)
+	writeICal(b, items, now, false)
+	ics := b.String()
+	for _, want := range []string{
+		"BEGIN:VTODO\r\n", "SUMMARY:pay rent\\, again\r\n", "DUE;VALUE=DATE:20261101\r\n",
+		"STATUS:NEEDS-ACTION\r\n", "TRIGGER;RELATED=END:-PT60M\r\n",
+		"BEGIN:VEVENT\r\n", "DTSTART:20261102T153000Z\r\n", "SEQUENCE:3\r\n",
+	} {
+		assert(t, strings.Contains(ics, want), "feed is missing "+want)
+	}
+	assert(t, strings.Count(ics, "BEGIN:VALARM") == 1, "only the incomplete item should have an alarm")
+
+	long := new(bytes.Buffer)
+	writeICalLine(long, "SUMMARY:"+strings.Repeat("é", 50))
+	for _, l := range strings.Split(strings.TrimSuffix(long.String(), "\r\n"), "\r\n") {
+		assert(t, len(l) <= 75, fmt.Sprintf("line is %d octets long", len(l)))
+	}
+}
+
+func TestParseVTODO(t *testing.T) {
+	due := time.Date(2026, 11, 2, 15, 30, 0, 0, time.UTC)
+	item := TodoItem{Description: "call mum; bring cake", DueDate: due, State: "completed", Notes: "she likes\nlemon", Tags: []string{"family", "a,b"}}
+	b := new(bytes.Buffer)
+	writeICal(b, Matches{{&datastore.Key{}, item}}, due, true)
+	parsed := parseVTODO(b.String())
+	todo, ok := (*parsed).(ICalTodo)
+	assert(t, ok, fmt.Sprintf("parseVTODO failed: %v", *parsed))
+	assertEquals(t, item.Description, *todo.Description)
+	assertEquals(t, item.Notes, *todo.Notes)
+	assertEquals(t, "completed", *todo.State)
+	assert(t, todo.DueDate.Equal(due), fmt.Sprintf("due date came back as %v", todo.DueDate))
+	assert(t, reflect.DeepEqual(item.Tags, todo.Tags), fmt.Sprintf("tags came back as %v", todo.Tags))
+
+	parsed = parseVTODO("BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:x\nEND:VEVENT\nEND:VCALENDAR\n")
+	_, ok = (*parsed).(E)
+	assert(t, ok, "a calendar without a VTODO should be an error")
+}
+
+func TestSyncToken(t *testing.T) {
+	updated := time.Date(2026, 10, 19, 12, 0, 0, 123, time.UTC)
+	since, err := parseSyncToken(syncToken(updated))
+	assert(t, err == nil && since.Equal(updated), fmt.Sprintf("sync token came back as %v, %v", since, err))
+	_, err = parseSyncToken("https://example.com/sync/yesterday")
+	assert(t, err != nil, "a bad sync token should be an error")
+}
+
+func TestCSV(t *testing.T) {
+	due := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+	items := Matches{
+		{&datastore.Key{}, TodoItem{Description: `say "hi", loudly`, DueDate: due, State: "completed", Notes: "two\nlines", Tags: []string{"a", "b"}}},
+	}
+	b := new(bytes.Buffer)
+	assert(t, writeItemsCSV(b, items) == nil, "writeItemsCSV failed")
+	parsed, errors := parseCSVItems(b, time.Now())
+	assert(t, len(errors) == 0, fmt.Sprintf("exported CSV didn't import: %v", errors))
+	assert(t, len(parsed) == 1, fmt.Sprintf("expected 1 item, got %d", len(parsed)))
+	item := parsed[0].Item
+	assertEquals(t, items[0].Value.Description, item.Description)
+	assertEquals(t, items[0].Value.Notes, item.Notes)
+	assertEquals(t, "completed", item.State)
+	assert(t, item.DueDate.Equal(due), fmt.Sprintf("due date came back as %v", item.DueDate))
+	assert(t, reflect.DeepEqual(items[0].Value.Tags, item.Tags), fmt.Sprintf("tags came back as %v", item.Tags))
+
+	b.Reset()
+	writeItemsCSV(b, Matches{{&datastore.Key{}, TodoItem{Description: "=HYPERLINK(\"http://example.com\")", Notes: "-1", DueDate: due}}})
+	assert(t, strings.Contains(b.String(), `'=HYPERLINK`) && strings.Contains(b.String(), ",'-1,"), fmt.Sprintf("formulas weren't escaped:\n%s", b))
+	parsed, _ = parseCSVItems(b, time.Now())
+	assertEquals(t, "=HYPERLINK(\"http://example.com\")", parsed[0].Item.Description)
+
+	today := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	parsed, errors = parseCSVItems(strings.NewReader("Due,Description,Status\n,no date,\n2026-13-01,bad date,\n2026-10-20,,\n,,\n2026-10-20,bad state,maybe\n"), today)
+	assert(t, len(parsed) == 1, fmt.Sprintf("expected 1 good row, got %v", parsed))
+	assert(t, parsed[0].Item.DueDate.Equal(startOfDay(today)), "an item without a due date should be due today")
+	assert(t, len(errors) == 3, fmt.Sprintf("expected 3 bad rows, got %v", errors))
+	assert(t, errors[0].Row == 3 && errors[2].Row == 6, fmt.Sprintf("wrong rows: %v", errors))
+
+	_, errors = parseCSVItems(strings.NewReader("Name,Due\nx,2026-10-20\n"), today)
+	assert(t, len(errors) == 1 && errors[0].Row == 1, "a file without a Description column should be an error")
+}
+
+func TestTodoTxt(t *testing.T) {
+	today := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	for _, line := range []string{
+		"(A) 2026-10-01 call mum +Family @phone @weekend due:2026-10-20",
+		"x 2026-10-19 2026-10-01 pay rent +Home pri:B due:2026-11-01",
+		"water plants due:2026-10-21",
+		"x 2026-10-19 renew passport due:2026-10-19",
+		"(A) 2026-10-01 \\+1 for \\@sam's idea, \\due:friday \\\\o/ +Work due:2026-10-20",
+		"\\x marks the spot due:2026-10-20",
+		"\\(A) grade in maths due:2026-10-20",
+		"x 2026-10-19 \\2026-10-01 retro due:2026-10-19",
+	} {
+		task, err := parseTodoTxtLine(line, today)
+		assert(t, err == nil, fmt.Sprintf("couldn't parse %q: %v", line, err))
+		item := task.Item
+		// formatTodoTxt gets the completion date from UpdatedAt
+		item.UpdatedAt = task.Completed
+		assertEquals(t, line, formatTodoTxt(item, task.Project))
+	}
+
+	// descriptions that look like todo.txt come back the way they went out
+	due := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	for _, description := range []string{"x marks the spot", "(A) grade", "2026-10-01 retro", "+1 @sam due:friday pri:A", "\\o/ \\"} {
+		item := TodoItem{Description: description, DueDate: due, State: "incomplete"}
+		task, err := parseTodoTxtLine(formatTodoTxt(item, ""), today)
+		assert(t, err == nil, fmt.Sprintf("couldn't parse %q back: %v", description, err))
+		assert(t, reflect.DeepEqual(item, task.Item), fmt.Sprintf("%q came back as %+v", description, task.Item))
+	}
+
+	task, _ := parseTodoTxtLine("(B) +Work +Side write report @desk", today)
+	assertEquals(t, "B", task.Item.Priority)
+	assertEquals(t, "Work", task.Project)
+	assertEquals(t, "+Side write report", task.Item.Description)
+	assert(t, reflect.DeepEqual([]string{"desk"}, task.Item.Tags), fmt.Sprintf("tags came back as %v", task.Item.Tags))
+	assert(t, task.Item.DueDate.Equal(startOfDay(today)), "an item without due: should be due today")
+	assertEquals(t, "incomplete", task.Item.State)
+
+	tasks, errors := parseTodoTxt(strings.NewReader("a\n\nb due:tomorrow\n+Work\nc\n"), today)
+	assert(t, len(tasks) == 2, fmt.Sprintf("expected 2 tasks, got %v", tasks))
+	assert(t, tasks[1].Row == 5, fmt.Sprintf("c is on line 5, not %d", tasks[1].Row))
+	assert(t, len(errors) == 2 && errors[0].Row == 3 && errors[1].Row == 4, fmt.Sprintf("wrong errors: %v", errors))
+}
+
+func TestImporters(t *testing.T) {
+	today := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+
+	gtasks := `{"kind": "tasks#taskLists", "items": [{"title": "Errands", "items": [
+  {"id": "abc", "title": "buy milk", "notes": "oat", "status": "needsAction", "due": "2026-10-20T00:00:00.000Z", "created": "2026-10-01T09:00:00.000Z"},
+  {"id": "def", "title": "old thing", "status": "completed", "deleted": true},
+  {"id": "ghi", "title": "", "status": "needsAction"}]}]}`
+	items, errors := parseGoogleTasks(strings.NewReader(gtasks), today)
+	assert(t, len(items) == 1, fmt.Sprintf("expected 1 Google task, got %v", items))
+	assert(t, len(errors) == 1 && errors[0].Row == 3, fmt.Sprintf("wrong errors: %v", errors))
+	assertEquals(t, "buy milk", items[0].Item.Description)
+	assertEquals(t, "Errands", items[0].Project)
+	assertEquals(t, "gtasks:abc", items[0].Item.ImportID)
+	assert(t, items[0].Item.DueDate.Equal(time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)), "wrong due date")
+
+	todoist := "TYPE,CONTENT,DESCRIPTION,PRIORITY,INDENT,AUTHOR,RESPONSIBLE,DATE,DATE_LANG,TIMEZONE\n" +
+		"section,Home,,,,,,,,\n" +
+		"task,fix sink @house,,1,1,me,,2026-10-21,en,UTC\n" +
+		"note,call plumber first,,,,,,,,\n" +
+		"task,stretch,,4,1,me,,every day,en,UTC\n"
+	items, errors = parseTodoistCSV(strings.NewReader(todoist), today)
+	assert(t, len(errors) == 0, fmt.Sprintf("Todoist errors: %v", errors))
+	assert(t, len(items) == 2, fmt.Sprintf("expected 2 Todoist tasks, got %v", items))
+	assertEquals(t, "fix sink", items[0].Item.Description)
+	assertEquals(t, "A", items[0].Item.Priority)
+	assertEquals(t, "call plumber first", items[0].Item.Notes)
+	assert(t, reflect.DeepEqual([]string{"house"}, items[0].Item.Tags), fmt.Sprintf("tags came back as %v", items[0].Item.Tags))
+	assertEquals(t, "", items[1].Item.Priority)
+	assertEquals(t, "Todoist due date: every day", items[1].Item.Notes)
+	assert(t, items[1].Item.DueDate.Equal(startOfDay(today)), "an unknown date should be today")
+	again, _ := parseTodoistCSV(strings.NewReader(todoist), today.AddDate(0, 0, 1))
+	assertEquals(t, items[1].Item.ImportID, again[1].Item.ImportID)
+	assert(t, items[0].Item.ImportID != items[1].Item.ImportID, "two Todoist tasks got the same ImportID")
+
+	taskwarrior := `[{"uuid": "u1", "description": "file taxes", "status": "pending", "project": "Money", "priority": "H", "due": "20261030T230000Z", "tags": ["urgent"], "annotations": [{"description": "use the new form"}]},
+{"uuid": "u2", "description": "gone", "status": "deleted"},
+{"uuid": "u3", "description": "done already", "status": "completed"}]`
+	items, errors = parseTaskwarrior(strings.NewReader(taskwarrior), today)
+	assert(t, len(errors) == 0, fmt.Sprintf("Taskwarrior errors: %v", errors))
+	assert(t, len(items) == 2, fmt.Sprintf("expected 2 Taskwarrior tasks, got %v", items))
+	assertEquals(t, "Money", items[0].Project)
+	assertEquals(t, "A", items[0].Item.Priority)
+	assertEquals(t, "use the new form", items[0].Item.Notes)
+	assertEquals(t, "taskwarrior:u1", items[0].Item.ImportID)
+	assertEquals(t, "completed", items[1].Item.State)
+	// older versions put one task on each line
+	items, errors = parseTaskwarrior(strings.NewReader("{\"uuid\": \"a\", \"description\": \"x\"}\n{\"uuid\": \"b\", \"description\": \"y\"}\n"), today)
+	assert(t, len(items) == 2 && len(errors) == 0, fmt.Sprintf("line-per-task export: %v %v", items, errors))
+
+	dup := []ImportedItem{
+		{Row: 1, Item: TodoItem{Description: "a", DueDate: today}},
+		{Row: 2, Item: TodoItem{Description: "A", DueDate: today}},
+		{Row: 3, Item: TodoItem{Description: "a", DueDate: today, ListID: 2}},
+		{Row: 4, Item: TodoItem{Description: "b", ImportID: "x:1"}},
+		{Row: 5, Item: TodoItem{Description: "c", ImportID: "x:1"}},
+	}
+	rest, skipped := dedupeImports(dup)
+	assert(t, skipped == 2 && len(rest) == 3, fmt.Sprintf("expected 2 duplicates, got %d: %v", skipped, rest))
+}
+
+// if an import batch runs again after saving its items but before saving
+// how far it got, it doesn't save them again
+func TestImportRetry(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	inbox := datastore.Key((*ensureInbox(ctx, &testUser)).(TodoListID))
+	items := []ImportedItem{
+		{Row: 1, Item: TodoItem{Description: "buy milk", DueDate: dueDate, State: "incomplete", ImportID: "test:1"}},
+		{Row: 2, Item: TodoItem{Description: "buy eggs", DueDate: dueDate, State: "incomplete", ImportID: "test:2"}},
+	}
+	started := startImportJob(ctx, &testUser, "test", inbox.IntID(), items, nil, false)
+	jobID := int64((*started).(ImportJobID))
+	assert(t, runImportBatch(ctx, jobID) == nil, "the import failed")
+
+	k := datastore.NewKey(ctx, "ImportJob", "", jobID, nil)
+	var job ImportJob
+	if err := datastore.Get(ctx, k, &job); err != nil {
+		t.Fatal(err)
+	}
+	job.Next, job.Created, job.Finished = 0, 0, time.Time{}
+	if _, err := datastore.Put(ctx, k, &job); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, runImportBatch(ctx, jobID) == nil, "the retry failed")
+	datastore.Get(ctx, k, &job)
+	assert(t, job.Created == 2 && job.Duplicates == 0, fmt.Sprintf("the retry made %d and skipped %d", job.Created, job.Duplicates))
+	saved := assertList(t, *listTodoItemsInList(ctx, &testUser, inbox.IntID()))
+	assert(t, len(saved) == 2, fmt.Sprintf("expected 2 items, got %d", len(saved)))
+}
+
+// deleting an account takes everything of theirs with it, but leaves other
+// people's items alone except for unassigning them
+func TestDeleteAccount(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	dueDate := time.Date(2016, 2, 29, 13, 0, 0, 0, time.UTC)
+	id := writeTodoItem(ctx, "call the bank", dueDate, false, &testUser, false)
+	k := datastore.Key((*id).(TodoID))
+	addComment(ctx, testUser.Email, k.IntID(), "about the mortgage")
+	id1 := writeNewTodoItem(ctx, TodoItem{Description: "mow the lawn", DueDate: dueDate, State: "incomplete", Assignee: testUser.Email}, &testUser1, false)
+	k1 := datastore.Key((*id1).(TodoID))
+	// Alice finishes Bob's item, then he reopens it
+	updateTodoItem(ctx, testUser.Email, "mow the lawn", dueDate, true, k1.IntID(), anyVersion)
+	updateTodoItem(ctx, testUser1.Email, "mow the lawn", dueDate, false, k1.IntID(), anyVersion)
+
+	archive := (*accountArchive(ctx, testUser.Email)).(AccountArchive)
+	assert(t, len(archive.Items) == 1, fmt.Sprintf("expected 1 item in the archive, got %d", len(archive.Items)))
+	assert(t, len(archive.Items[0].Comments) == 1, "the comment isn't in the archive")
+	_, ok := (*accountArchiveToJson(archive)).(Blob)
+	assert(t, ok, "couldn't encode the archive")
+
+	result := deleteAccount(ctx, testUser.Email)
+	_, ok = (*result).(Ok)
+	assert(t, ok, fmt.Sprintf("deleteAccount failed: %v", *result))
+	_, gone := (*readTodoItemWithTrash(ctx, TodoID(k))).(E)
+	assert(t, gone, "their item is still there")
+	other := (*readTodoItem(ctx, TodoID(k1))).(TodoItem)
+	assertEquals(t, "", other.Assignee)
+	for _, rev := range (*listRevisions(ctx, testUser1.Email, k1.IntID())).(Revisions) {
+		assert(t, rev.Revision.EditorEmail != testUser.Email && rev.Revision.Item.Assignee != testUser.Email,
+			fmt.Sprintf("a revision still mentions Alice: %+v", rev.Revision))
+	}
+	for _, a := range (*listActivities(ctx, k1)).(Activities) {
+		assert(t, a.ActorEmail != testUser.Email && !strings.Contains(a.Detail, testUser.Email),
+			fmt.Sprintf("an activity still mentions Alice: %+v", a))
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	items := Matches{
+		{&datastore.Key{}, TodoItem{Description: "buy milk", DueDate: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), State: "incomplete"}},
+		{&datastore.Key{}, TodoItem{Description: "fix *all* the [bugs]", DueDate: time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC), State: "completed"}},
+	}
+	b := new(bytes.Buffer)
+	writeMarkdown(b, "Groceries", items)
+	assertEquals(t, "# Groceries\n\n"+
+		"- [ ] buy milk (due 2026-10-20)\n"+
+		"- [x] fix \\*all\\* the \\[bugs\\] (due 2026-10-19 09:30)\n", b.String())
+}
+
+func TestSortAllMatches(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	matches := Matches{
+		{&datastore.Key{}, TodoItem{Description: "b", DueDate: day(3), Created: day(1)}},
+		{&datastore.Key{}, TodoItem{Description: "C", DueDate: day(1), Created: day(2)}},
+		{&datastore.Key{}, TodoItem{Description: "a", DueDate: day(2), Created: day(3)}},
+	}
+	order := func() string {
+		var s string
+		for _, m := range matches {
+			s += m.Value.Description
+		}
+		return s
+	}
+	sortAllMatches(matches, ItemFilter{})
+	assertEquals(t, "Cab", order())
+	sortAllMatches(matches, ItemFilter{Sort: sortByDescription})
+	assertEquals(t, "abC", order())
+	sortAllMatches(matches, ItemFilter{Sort: sortByCreated})
+	assertEquals(t, "aCb", order())
+}
+
+func TestDueDateFromText(t *testing.T) {
+	// a Monday
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	for body, want := range map[string]time.Time{
+		"due: 2026-10-25":            day(25),
+		"Due tomorrow please":        day(20),
+		"it's due by friday":         day(23),
+		"due Mon":                    day(26),
+		"see you on 2026-10-30":      day(30),
+		"it's overdue, so due today": day(19),
+	} {
+		d, ok := dueDateFromText(body, now)
+		assert(t, ok, "no due date in "+body)
+		assert(t, want.Equal(d), fmt.Sprintf("%s: wanted %v, got %v", body, want, d))
+	}
+	_, ok := dueDateFromText("nothing here, not even an overdue", now)
+	assert(t, !ok, "found a due date that isn't there")
+}
+
+func TestMailMessage(t *testing.T) {
+	assertEquals(t, "buy milk", mailSubject("Re: Fwd:  buy milk "))
+	assertEquals(t, "café", mailSubject("=?utf-8?q?caf=C3=A9?="))
+	token, listID := parseItemMailAddress(itemMailAddress("abc", 123))
+	assert(t, token == "abc" && listID == 123, fmt.Sprintf("wrong token %q or list ID %d", token, listID))
+	token, listID = parseItemMailAddress("todo+abc@example.com")
+	assert(t, token == "abc" && listID == 0, fmt.Sprintf("wrong token %q or list ID %d", token, listID))
+	token, _ = parseItemMailAddress("todo@example.com")
+	assertEquals(t, "", token)
+	assertEquals(t, "a@example.com", mailPath("FROM:<a@example.com> SIZE=100", "FROM:"))
+	assertEquals(t, "b@example.com", mailPath("to:b@example.com", "TO:"))
+
+	raw := "From: Alice <Alice@example.com>\r\n" +
+		"Subject: buy milk\r\n" +
+		"Content-Type: multipart/alternative; boundary=xyz\r\n\r\n" +
+		"--xyz\r\nContent-Type: text/html\r\n\r\n<p>nope</p>\r\n" +
+		"--xyz\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		"ZHVlIHRvbW9ycm93\r\n--xyz--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	assert(t, err == nil, fmt.Sprintf("couldn't read the message: %v", err))
+	assertEquals(t, "due tomorrow", plainTextBody(textproto.MIMEHeader(msg.Header), msg.Body))
+}
+
+// A connection to serveMailConn that's already had everything in it sent
+type testMailConn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *testMailConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *testMailConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *testMailConn) Close() error                { return nil }
+
+// bad commands and messages that are too big get errors, and don't stop
+// the server understanding what comes after them
+func TestMailServer(t *testing.T) {
+	big := strings.Repeat("x", maxMailBytes) + "\r\n"
+	conn := &testMailConn{in: strings.NewReader("EHLO example.com\r\nMAIL FROM:\r\nRCPT TO:\r\n" +
+		"RCPT TO:<todo@example.com>\r\nDATA\r\nSubject: big\r\n\r\n" + big + "NOOP\r\n.\r\nNOOP\r\nQUIT\r\n")}
+	serveMailConn(context.Background(), conn, false, time.Now)
+	replies := strings.Split(strings.TrimSpace(conn.out.String()), "\r\n")
+	var codes []string
+	for _, r := range replies {
+		codes = append(codes, r[:3])
+	}
+	want := []string{"220", "250", "250", "250", "250", "501", "250", "354", "552", "250", "221"}
+	assert(t, reflect.DeepEqual(want, codes), fmt.Sprintf("wrong replies %v:\n%s", codes, conn.out.String()))
+}
+
+// mail only makes items for the person whose secret address it was sent
+// to, whatever the From header says
+func TestMailToken(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	message := func() *mail.Message {
+		msg, _ := mail.ReadMessage(strings.NewReader("From: " + testUser1.Email + "\r\nSubject: buy milk\r\n\r\ndue tomorrow\r\n"))
+		return msg
+	}
+	_, isErr := (*createItemFromMail(ctx, message(), "todo@example.com", now)).(E)
+	assert(t, isErr, "mail without a token made an item")
+	_, isErr = (*createItemFromMail(ctx, message(), "todo+guess@example.com", now)).(E)
+	assert(t, isErr, "mail with the wrong token made an item")
+
+	token := (*secretToken(ctx, mailTokenKind, testUser.Email, false)).(SecretToken)
+	id := createItemFromMail(ctx, message(), itemMailAddress(token.Token, 0), now)
+	k := datastore.Key((*id).(TodoID))
+	item := (*readTodoItem(ctx, TodoID(k))).(TodoItem)
+	assertEquals(t, testUser.Email, item.OwnerEmail)
+	assertEquals(t, "2026-10-20", item.DueDate.Format("2006-01-02"))
+}
+
+func TestJsonToNewItem(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	item := jsonToNewItem([]byte(`{"Description": "buy milk", "ListID": 5, "Tags": ["errands"]}`), now)
+	assert(t, reflect.DeepEqual(TodoItem{Description: "buy milk", DueDate: startOfDay(now), State: "incomplete",
+		ListID: 5, Tags: []string{"errands"}}, (*item).(TodoItem)), fmt.Sprintf("wrong item %v", *item))
+	item = jsonToNewItem([]byte(`{"Description": "call mum", "DueDate": "2026-11-01T09:30:00Z"}`), now)
+	assert(t, (*item).(TodoItem).DueDate.Equal(time.Date(2026, 11, 1, 9, 30, 0, 0, time.UTC)), "wrong due date")
+	for _, bad := range []string{`{"Description": " "}`, `{"Description": "x", "DueDate": "soon"}`, `[]`} {
+		_, isErr := (*jsonToNewItem([]byte(bad), now)).(E)
+		assert(t, isErr, bad+" got through")
+	}
+}
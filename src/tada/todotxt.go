@@ -0,0 +1,330 @@
+// +build !appengine
+package tada
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// todo.txt (http://todotxt.org) is one item per line:
+//   x 2026-10-19 2026-10-01 (A) call mum +Family @phone due:2026-10-20
+// Here "x" and the completion date mean it's completed, (A) is Priority, the
+// other date is Created, @contexts are Tags, due: is DueDate and the first
+// +project is the list it's in. Anything else is the Description.
+// Description words that would be read as one of those get a backslash in
+// front, like \+1 or \due:friday; see escapeTodoTxt.
+
+func init() {
+	http.HandleFunc("/todo.txt", todoTxtHandler)
+}
+
+// One line of a todo.txt file
+type TodoTxtTask struct {
+	Row       int
+	Item      TodoItem
+	Project   string    // the first +project, without the "+"
+	Completed time.Time // zero if it doesn't say
+}
+
+const todoTxtDate = "2006-01-02"
+
+func isTodoTxtDate(s string) bool {
+	_, err := time.Parse(todoTxtDate, s)
+	return err == nil
+}
+
+func isTodoTxtPriority(s string) bool {
+	return len(s) == 3 && s[0] == '(' && s[1] >= 'A' && s[1] <= 'Z' && s[2] == ')'
+}
+
+// Projects and contexts can't have spaces in them
+func todoTxtWord(s string) string {
+	return strings.Join(strings.Fields(s), "-")
+}
+
+// Puts a backslash in front of any word in description that parseTodoTxtLine
+// wouldn't leave in the description, and in front of ones that start with a
+// backslash already. first says description starts the line, so its first
+// word could be taken for "x" or a priority; afterDate says the line already
+// has its creation date, so the first word can't be taken for that either.
+func escapeTodoTxt(description string, first bool, afterDate bool) string {
+	words := strings.Fields(description)
+	for i, word := range words {
+		special := word[0] == '\\' ||
+			(len(word) > 1 && (word[0] == '+' || word[0] == '@')) ||
+			strings.HasPrefix(word, "due:") || strings.HasPrefix(word, "pri:")
+		if i == 0 {
+			special = special || (first && (word == "x" || isTodoTxtPriority(word))) ||
+				(!afterDate && isTodoTxtDate(word))
+		}
+		if special {
+			words[i] = "\\" + word
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Parses one line of todo.txt. Items without a due: are due today.
+// n.b. only the first +project says which list; any more stay in the
+// description, since an item can only be in one list
+func parseTodoTxtLine(line string, today time.Time) (TodoTxtTask, error) {
+	task := TodoTxtTask{Item: TodoItem{DueDate: startOfDay(today), State: "incomplete"}}
+	words := strings.Fields(line)
+	if len(words) > 0 && words[0] == "x" {
+		task.Item.State = "completed"
+		words = words[1:]
+		if len(words) > 0 && isTodoTxtDate(words[0]) {
+			task.Completed, _ = time.Parse(todoTxtDate, words[0])
+			words = words[1:]
+		}
+	} else if len(words) > 0 && isTodoTxtPriority(words[0]) {
+		task.Item.Priority = words[0][1:2]
+		words = words[1:]
+	}
+	if len(words) > 0 && isTodoTxtDate(words[0]) {
+		task.Item.Created, _ = time.Parse(todoTxtDate, words[0])
+		words = words[1:]
+	}
+	var description []string
+	for _, word := range words {
+		switch {
+		case len(word) > 1 && word[0] == '\\':
+			// see escapeTodoTxt
+			description = append(description, word[1:])
+		case len(word) > 1 && word[0] == '+' && task.Project == "":
+			task.Project = word[1:]
+		case len(word) > 1 && word[0] == '@':
+			task.Item.Tags = append(task.Item.Tags, word[1:])
+		case strings.HasPrefix(word, "due:"):
+			d, err := time.Parse(todoTxtDate, word[len("due:"):])
+			if err != nil {
+				return task, fmt.Errorf("%q doesn't look like a due date to me (try due:YYYY-MM-DD)", word)
+			}
+			task.Item.DueDate = d
+		case strings.HasPrefix(word, "pri:") && isTodoTxtPriority("("+word[len("pri:"):]+")"):
+			// where completed items keep their priority
+			task.Item.Priority = word[len("pri:"):]
+		default:
+			description = append(description, word)
+		}
+	}
+	task.Item.Description = strings.Join(description, " ")
+	if task.Item.Description == "" {
+		return task, fmt.Errorf("there's nothing to do in %q", line)
+	}
+	return task, nil
+}
+
+// Parses a whole todo.txt file, skipping blank lines. Returns the tasks and
+// what's wrong with the lines that aren't right.
+func parseTodoTxt(r io.Reader, today time.Time) ([]TodoTxtTask, []RowError) {
+	var tasks []TodoTxtTask
+	var errors []RowError
+	scanner := bufio.NewScanner(r)
+	for row := 1; scanner.Scan(); row++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		if len(tasks)+len(errors) >= maxImportRows {
+			errors = append(errors, RowError{row, fmt.Sprintf("that's more than %d lines; split the file up", maxImportRows)})
+			break
+		}
+		task, err := parseTodoTxtLine(scanner.Text(), today)
+		if err != nil {
+			errors = append(errors, RowError{row, err.Error()})
+			continue
+		}
+		task.Row = row
+		tasks = append(tasks, task)
+	}
+	if err := scanner.Err(); err != nil {
+		errors = append(errors, RowError{len(tasks) + len(errors) + 1, err.Error()})
+	}
+	return tasks, errors
+}
+
+// Writes item as a line of todo.txt, in the list called project ("" for none).
+// Completed items' completion date is when they were last changed, which is
+// near enough. n.b. todo.txt has no times, so timed items lose theirs.
+func formatTodoTxt(item TodoItem, project string) string {
+	var words []string
+	if item.State == "completed" {
+		words = append(words, "x")
+		if !item.UpdatedAt.IsZero() {
+			words = append(words, item.UpdatedAt.Format(todoTxtDate))
+		}
+	} else if item.Priority != "" {
+		words = append(words, "("+item.Priority+")")
+	}
+	// a creation date on its own after "x" would look like a completion date
+	created := !item.Created.IsZero() && (item.State != "completed" || !item.UpdatedAt.IsZero())
+	if created {
+		words = append(words, item.Created.Format(todoTxtDate))
+	}
+	words = append(words, escapeTodoTxt(item.Description, len(words) == 0, created))
+	if project != "" {
+		words = append(words, "+"+todoTxtWord(project))
+	}
+	for _, t := range item.Tags {
+		words = append(words, "@"+todoTxtWord(t))
+	}
+	if item.State == "completed" && item.Priority != "" {
+		words = append(words, "pri:"+item.Priority)
+	}
+	words = append(words, "due:"+item.DueDate.Format(todoTxtDate))
+	return strings.Join(words, " ")
+}
+
+// Writes items as todo.txt, with the names of the lists in lists as projects
+func writeTodoTxt(w io.Writer, items Matches, lists TodoLists) {
+	names := map[int64]string{}
+	for _, l := range lists {
+		names[l.Key.IntID()] = l.Value.Name
+	}
+	for _, m := range items {
+		fmt.Fprintln(w, formatTodoTxt(m.Value, names[m.Value.ListID]))
+	}
+}
+
+// Saves tasks for u, in the list with ID listID unless they have a +project.
+// See assignProjectLists and importItems.
+func importTodoTxt(ctx context.Context, u *user.User, listID int64, tasks []TodoTxtTask, remind bool) *MaybeError {
+	var items = make([]ImportedItem, len(tasks))
+	for i, task := range tasks {
+		items[i] = ImportedItem{Row: task.Row, Item: task.Item, Project: task.Project}
+	}
+	assigned := assignProjectLists(ctx, u, items)
+	switch (*assigned).(type) {
+	case Ok:
+	default:
+		return assigned
+	}
+	return importItems(ctx, u, listID, items, remind)
+}
+
+// GET gets everything the user can see as todo.txt, or just what's in
+// "list" if there is one. POST imports a todo.txt file from "file", or the
+// whole body if it isn't a form, into "list", with reminders if "remind" is
+// set. API clients can use their API token; see requestEmail.
+func todoTxtHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := requestEmail(ctx, r)
+	if email == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Tada (use your API token as the password)"`)
+		http.Error(w, "Sign in with your email address and API token", http.StatusUnauthorized)
+		return
+	}
+	u := &user.User{Email: email}
+	var listID int64
+	if list := r.FormValue("list"); list != "" {
+		var err error
+		listID, err = strconv.ParseInt(list, 10, 64)
+		if err != nil {
+			http.Error(w, list+" doesn't look like a list ID to me!", 400)
+			return
+		}
+	}
+	if r.Method != "POST" {
+		exportTodoTxt(w, ctx, u, listID)
+		return
+	}
+	if listID == 0 {
+		http.Error(w, "Say which list to import into with a \"list\" parameter", 400)
+		return
+	}
+	if !canEdit(listRole(ctx, email, listID)) {
+		http.Error(w, "You can't add items to that list", http.StatusForbidden)
+		return
+	}
+	var in io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Pick a todo.txt file to import", 400)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+	tasks, errors := parseTodoTxt(in, time.Now())
+	var result = new(MaybeError)
+	if len(errors) > 0 {
+		// nothing gets imported, so fixing the file and trying again doesn't
+		// make duplicates
+		*result = ImportResult{Errors: errors}
+	} else {
+		result = importTodoTxt(ctx, u, listID, tasks, r.FormValue("remind") != "")
+	}
+	switch (*result).(type) {
+	case ImportResult:
+	default:
+		respondWith(w, *result)
+		return
+	}
+	done := (*result).(ImportResult)
+	if wantsJson(r) {
+		blob := importResultToJson(done)
+		switch (*blob).(type) {
+		case Blob:
+			w.Header().Set("Content-Type", "application/json")
+			if len(errors) > 0 {
+				w.WriteHeader(400)
+			}
+			w.Write((*blob).(Blob))
+		default:
+			respondWith(w, *blob)
+		}
+		return
+	}
+	fmt.Fprintf(w, "<html><h1>Import from todo.txt</h1>\n<p>Imported %d items.</p>\n", done.Created)
+	writeRowErrors(w, done.Errors)
+	fmt.Fprintf(w, `<a href="/?list=%d">Back to the list</a></html>`, listID)
+}
+
+func exportTodoTxt(w http.ResponseWriter, ctx context.Context, u *user.User, listID int64) {
+	var items *MaybeError
+	if listID != 0 {
+		items = listTodoItemsInList(ctx, u, listID)
+	} else {
+		items = listTodoItems(ctx, u)
+	}
+	lists := visibleTodoLists(ctx, u)
+	switch (*items).(type) {
+	case Matches:
+	default:
+		respondWith(w, *items)
+		return
+	}
+	switch (*lists).(type) {
+	case TodoLists:
+	default:
+		respondWith(w, *lists)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeTodoTxt(w, (*items).(Matches), (*lists).(TodoLists))
+}
+
+// The upload and download links for the root page
+func writeTodoTxtForm(w http.ResponseWriter, listID int64, canEdit bool) {
+	fmt.Fprintf(w, ` <a href="/todo.txt?list=%d">todo.txt</a>
+`, listID)
+	if canEdit {
+		fmt.Fprintf(w, ` <form action="/todo.txt" method="post" enctype="multipart/form-data">
+   Import a todo.txt file: <input type="file" name="file" accept=".txt,text/plain">
+   <input hidden=true name="list" value="%d">
+   <label><input type="checkbox" name="remind" checked> Email reminders</label>
+   <input type="submit" value="Import">
+ </form>
+`, listID)
+	}
+}
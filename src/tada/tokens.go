@@ -0,0 +1,186 @@
+// +build !appengine
+package tada
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/apiToken", apiTokenHandler)
+	http.HandleFunc("/resetApiToken", resetApiTokenHandler)
+	http.HandleFunc("/resetMailToken", resetMailTokenHandler)
+}
+
+// A secret that stands in for logging in, for things that can't do Google
+// logins. Resetting it makes a new one and the old one stops working.
+// Keyed by the user's email address; the entity kind says what it's for.
+type SecretToken struct {
+	Token   string
+	Created time.Time
+}
+
+func (t SecretToken) isMaybeError() {}
+
+const (
+	// the secret in somebody's calendar feed URL; see ical.go. Anybody who
+	// has the URL can read their items.
+	feedTokenKind = "FeedToken"
+	// what API clients like CalDAV apps send instead of logging in; see
+	// requestEmail
+	apiTokenKind = "APIToken"
+	// the secret in the address people mail items to; see email-receiver.go
+	mailTokenKind = "MailToken"
+)
+
+func newSecretToken() (SecretToken, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return SecretToken{}, err
+	}
+	return SecretToken{hex.EncodeToString(b), time.Now()}, nil
+}
+
+// Returns email's token of kind kind, making one if they don't have one yet
+// (or if reset is true, in which case the old one stops working)
+func secretToken(ctx context.Context, kind string, email string, reset bool) *MaybeError {
+	var result = new(MaybeError)
+	k := datastore.NewKey(ctx, kind, email, 0, nil)
+	var token SecretToken
+	err := datastore.Get(ctx, k, &token)
+	if err == nil && !reset {
+		*result = token
+		return result
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		*result = E(err.Error())
+		return result
+	}
+	token, err = newSecretToken()
+	if err == nil {
+		_, err = datastore.Put(ctx, k, &token)
+	}
+	if err != nil {
+		*result = E(err.Error())
+	} else {
+		*result = token
+	}
+	return result
+}
+
+// Returns the email address whose token of kind kind is token, or "" if
+// nobody's is
+func emailForToken(ctx context.Context, kind string, token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	keys, err := datastore.NewQuery(kind).Filter("Token=", token).KeysOnly().Limit(1).GetAll(ctx, nil)
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	return keys[0].StringID(), nil
+}
+
+// Returns the email address of whoever's making the request: the logged-in
+// user, or whoever's API token is in the Authorization header, either as a
+// bearer token or as the password for basic auth (the user name doesn't
+// matter). "" means nobody we know.
+func requestEmail(ctx context.Context, r *http.Request) string {
+	if u := user.Current(ctx); u != nil {
+		return u.Email
+	}
+	var token string
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	email, err := emailForToken(ctx, apiTokenKind, token)
+	if err != nil {
+		log("requestEmail error: " + err.Error())
+	}
+	return email
+}
+
+// The same as requestEmail, for handlers API clients use: answers 401 and
+// returns nil if it's nobody we know
+func apiUser(w http.ResponseWriter, r *http.Request) *user.User {
+	email := requestEmail(appengine.NewContext(r), r)
+	if email == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Tada (use your API token)"`)
+		http.Error(w, "Sign in, or send your API token", http.StatusUnauthorized)
+		return nil
+	}
+	return &user.User{Email: email}
+}
+
+// Shows the current user their API token, and the address they can mail
+// items to
+func apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	email := user.Current(ctx).Email
+	token := secretToken(ctx, apiTokenKind, email, false)
+	switch (*token).(type) {
+	case SecretToken:
+	default:
+		respondWith(w, *token)
+		return
+	}
+	mailToken := secretToken(ctx, mailTokenKind, email, false)
+	switch (*mailToken).(type) {
+	case SecretToken:
+	default:
+		respondWith(w, *mailToken)
+		return
+	}
+	fmt.Fprintf(w, `<html><h1>Your API token</h1>
+<p>Apps that can't sign in with Google, like CalDAV task apps, can use this
+as the password for your email address. Anybody who has it can change your
+items, so keep it to yourself.</p>
+<pre>%s</pre>
+<p>CalDAV address: <code>https://%s/caldav/</code></p>
+ <form action="/resetApiToken" method="post">
+   <input type="submit" value="Make a new token (the old one stops working)">
+ </form>
+<h2>Mailing yourself items</h2>
+<p>Mail sent here goes in your Inbox, with the subject as the description.
+To put it in another list, add a + and the list's number before the @.
+Anybody who has the address can add items, so keep it to yourself too.</p>
+<pre>%s</pre>
+ <form action="/resetMailToken" method="post">
+   <input type="submit" value="Make a new address (the old one stops working)">
+ </form>
+<a href="/">Back to your lists</a>
+</html>`, (*token).(SecretToken).Token, r.Host, itemMailAddress((*mailToken).(SecretToken).Token, 0))
+}
+
+func resetApiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	token := secretToken(ctx, apiTokenKind, user.Current(ctx).Email, true)
+	switch (*token).(type) {
+	case SecretToken:
+		http.Redirect(w, r, "/apiToken", http.StatusSeeOther)
+	default:
+		respondWith(w, *token)
+	}
+}
+
+func resetMailTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	token := secretToken(ctx, mailTokenKind, user.Current(ctx).Email, true)
+	switch (*token).(type) {
+	case SecretToken:
+		http.Redirect(w, r, "/apiToken", http.StatusSeeOther)
+	default:
+		respondWith(w, *token)
+	}
+}
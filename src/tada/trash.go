@@ -0,0 +1,148 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func init() {
+	http.HandleFunc("/admin/purgeTrash", purgeTrashHandler)
+}
+
+// How long things stay in the trash before purgeTrash deletes them for good.
+// Set TADA_TRASH_RETENTION (e.g. "720h") to change it.
+var trashRetention = retentionFromEnv()
+
+func retentionFromEnv() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("TADA_TRASH_RETENTION"))
+	if err != nil || d <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return d
+}
+
+// n.b. items that have never been in the trash have a zero DeletedAt, and
+// items from before there was a trash don't have one at all; the "DeletedAt>"
+// filter leaves both of them out
+func trashQuery() *datastore.Query {
+	return datastore.NewQuery("TodoItem").Filter("DeletedAt>", time.Time{})
+}
+
+// Returns the items in the trash that were in the list with ID listID,
+// most recently deleted first. u has to be able to see the list.
+func listTrash(ctx context.Context, u *user.User, listID int64) *MaybeError {
+	if !canView(listRole(ctx, u.Email, listID)) {
+		var result = new(MaybeError)
+		*result = E("you can't see that list")
+		return result
+	}
+	q := trashQuery().Filter("ListID=", listID).Order("-DeletedAt").KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		var result = new(MaybeError)
+		*result = E(err.Error())
+		return result
+	}
+	return readTodoItemsWithTrash(ctx, keys)
+}
+
+// Deletes everything that went in the trash before cutoff, for everybody,
+// maxBulkItems at a time. Returns how many items it deleted.
+func purgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	q := trashQuery().Filter("DeletedAt<", cutoff).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(keys); start += maxBulkItems {
+		end := start + maxBulkItems
+		if end > len(keys) {
+			end = len(keys)
+		}
+		deleted := deleteTodoItems(ctx, keys[start:end])
+		switch (*deleted).(type) {
+		case Ok:
+		default:
+			return start, fmt.Errorf("%v", *deleted)
+		}
+	}
+	return len(keys), nil
+}
+
+// Run by cron; see cron.yaml
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	n, err := purgeTrash(ctx, time.Now().Add(-trashRetention))
+	log(fmt.Sprintf("purged %d items from the trash", n))
+	if handleError(w, err) {
+		return
+	}
+	// the CalDAV tombstones, while we're at it
+	t, err := purgeDAVTombstones(ctx, time.Now().Add(-davTombstoneRetention))
+	log(fmt.Sprintf("purged %d CalDAV tombstones", t))
+	if handleError(w, err) {
+		return
+	}
+	fmt.Fprintf(w, "Purged %d items", n)
+}
+
+// writes the items in the trash, with checkboxes and a form to restore them
+// or delete them for good if canEdit
+func writeTrash(w http.ResponseWriter, items *MaybeError, listID int64, canEdit bool) {
+	const trash = `<h2>Trash</h2>
+<p>Things stay here for {{.Days}} days, then they're gone for good.</p>
+<ol>
+{{range .Items}}<li>{{if $.CanEdit}}<input type="checkbox" name="id" value="{{.Key.IntID}}" form="trash"> {{end}}{{.Value.Description}}, deleted {{FmtTime .Value.DeletedAt}}</li>
+{{end}}</ol>
+{{if .CanEdit}} <form id="trash" action="/bulk" method="post">
+   <input hidden=true name="list" value="{{.ListID}}">
+   <input hidden=true name="view" value="trash">
+   <button type="submit" name="action" value="restore">Restore</button>
+   <button type="submit" name="action" value="purge">Delete forever</button>
+ </form>
+{{end}}<a href="/?list={{.ListID}}">Back to the list</a>
+`
+	switch (*items).(type) {
+	case Matches:
+		t, err := template.New("trash").Funcs(template.FuncMap{
+			"FmtTime": func(d time.Time) string { return d.Format("2006-01-02 15:04") },
+		}).Parse(trash)
+		if handleError(w, err) {
+			return
+		}
+		handleError(w, t.Execute(w, struct {
+			Items   Matches
+			ListID  int64
+			CanEdit bool
+			Days    int
+		}{(*items).(Matches), listID, canEdit, int(trashRetention.Hours() / 24)}))
+	default:
+		respondWith(w, *items)
+	}
+}
+
+// writes a banner saying how many items just went in the trash, with a
+// button that puts them back
+func writeUndoBanner(w http.ResponseWriter, ids []int64, listID int64) {
+	fmt.Fprintf(w, `<form action="/bulk" method="post" style="background-color:lightyellow">
+   Moved %d items to the trash.
+   <input hidden=true name="action" value="%s">
+   <input hidden=true name="list" value="%d">
+`, len(ids), bulkRestore, listID)
+	for _, id := range ids {
+		fmt.Fprintf(w, `   <input hidden=true name="id" value="%d">
+`, id)
+	}
+	fmt.Fprint(w, `   <input type="submit" value="Undo">
+ </form>
+`)
+}
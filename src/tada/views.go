@@ -0,0 +1,218 @@
+// +build !appengine
+package tada
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// Other ways of looking at the items on the root page: as a Markdown
+// checklist for pasting into docs, and as a page that prints nicely.
+// Both take the same "list", "view" and filter parameters as the root page.
+
+func init() {
+	http.HandleFunc("/list.md", markdownHandler)
+	http.HandleFunc("/print", printHandler)
+}
+
+// Returns what the root page would show for listID, view and f, all of it
+// rather than a page at a time, along with what to call it
+func viewItems(ctx context.Context, u *user.User, listID int64, view string, f ItemFilter) (string, *MaybeError) {
+	var items *MaybeError
+	var title string
+	switch {
+	case view == "trash":
+		// like the root page's trash: most recently deleted first, and
+		// n.b. not filtered
+		if listID == 0 {
+			items = new(MaybeError)
+			*items = E("say which list's trash you want")
+			return "", items
+		}
+		items = listTrash(ctx, u, listID)
+		switch (*items).(type) {
+		case Matches:
+		default:
+			return "", items
+		}
+		list := readTodoList(ctx, listID)
+		switch (*list).(type) {
+		case TodoList:
+			return (*list).(TodoList).Name + " trash", items
+		default:
+			return "", list
+		}
+	case view == "assigned":
+		title = "Assigned to me"
+		items = listTodoItemsForQuery(ctx, u, applyFilter(assignedQuery(u), f))
+	case listID != 0:
+		if !canView(listRole(ctx, u.Email, listID)) {
+			items = new(MaybeError)
+			*items = E("you can't see that list")
+			return "", items
+		}
+		list := readTodoList(ctx, listID)
+		switch (*list).(type) {
+		case TodoList:
+			title = (*list).(TodoList).Name
+		default:
+			return "", list
+		}
+		items = listTodoItemsForQuery(ctx, u, applyFilter(inListQuery(listID), f))
+	default:
+		return "Everything", listTodoItemsFiltered(ctx, u, f)
+	}
+	switch (*items).(type) {
+	case Matches:
+		sortMatches((*items).(Matches), f)
+	}
+	return title, items
+}
+
+// Gets viewItems' parameters from the request
+func viewFromRequest(r *http.Request) (int64, string, ItemFilter, error) {
+	var listID int64
+	if list := r.FormValue("list"); list != "" {
+		var err error
+		listID, err = strconv.ParseInt(list, 10, 64)
+		if err != nil {
+			return 0, "", ItemFilter{}, fmt.Errorf("%s doesn't look like a list ID to me!", list)
+		}
+	}
+	f, err := filterFromRequest(r, time.Now())
+	return listID, r.FormValue("view"), f, err
+}
+
+// Escapes the characters that mean something in Markdown, so descriptions
+// come out the way they were typed
+func markdownText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`, "#", `\#`).Replace(s)
+}
+
+// Items due at a particular time say what time
+func formatDue(item TodoItem) string {
+	if isTimed(item) {
+		return item.DueDate.Format("2006-01-02 15:04")
+	}
+	return item.DueDate.Format("2006-01-02")
+}
+
+// Writes items as a Markdown checklist under a heading:
+//   - [ ] buy milk (due 2026-10-20)
+//   - [x] call mum (due 2026-10-19)
+func writeMarkdown(w io.Writer, title string, items Matches) {
+	fmt.Fprintf(w, "# %s\n\n", markdownText(title))
+	for _, m := range items {
+		check := " "
+		if m.Value.State == "completed" {
+			check = "x"
+		}
+		fmt.Fprintf(w, "- [%s] %s (due %s)\n", check, markdownText(m.Value.Description), formatDue(m.Value))
+	}
+}
+
+func markdownHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	listID, view, f, err := viewFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	title, items := viewItems(ctx, user.Current(ctx), listID, view, f)
+	switch (*items).(type) {
+	case Matches:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		writeMarkdown(w, title, (*items).(Matches))
+	default:
+		respondWith(w, *items)
+	}
+}
+
+const printTemplate = `<html><head><title>{{.Title}}</title>
+<style>
+body { font-family: serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #999; padding: 0.3em; text-align: left; vertical-align: top; }
+.done { text-decoration: line-through; color: #666; }
+.notes { font-size: smaller; white-space: pre-wrap; }
+@media print { a { display: none; } body { margin: 0; } }
+</style></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{len .Items}} items, as of {{FmtDate .Now}}</p>
+<table>
+<tr><th></th><th>What</th><th>Due</th><th>Who</th></tr>
+{{range .Items}}<tr{{if Equal .Value.State "completed"}} class="done"{{end}}>
+<td>{{if Equal .Value.State "completed"}}&#9745;{{else}}&#9744;{{end}}</td>
+<td>{{if .Value.Priority}}({{.Value.Priority}}) {{end}}{{.Value.Description}}{{range .Value.Tags}} #{{.}}{{end}}
+{{if .Value.Notes}}<div class="notes">{{.Value.Notes}}</div>{{end}}</td>
+<td>{{FmtDue .Value}}</td>
+<td>{{Recipient .Value}}</td>
+</tr>
+{{end}}</table>
+<a href="/?{{.Query}}">Back to the list</a>
+</body></html>
+`
+
+var printT = template.Must(template.New("print").Funcs(template.FuncMap{
+	"Equal":     func(a, b string) bool { return a == b },
+	"FmtDate":   func(d time.Time) string { return d.Format("2006-01-02 15:04") },
+	"FmtDue":    formatDue,
+	"Recipient": reminderRecipient,
+}).Parse(printTemplate))
+
+func printHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	listID, view, f, err := viewFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	title, items := viewItems(ctx, user.Current(ctx), listID, view, f)
+	switch (*items).(type) {
+	case Matches:
+	default:
+		respondWith(w, *items)
+		return
+	}
+	handleError(w, printT.Execute(w, struct {
+		Title string
+		Items Matches
+		Now   time.Time
+		Query template.URL // already escaped
+	}{title, (*items).(Matches), time.Now(), template.URL(viewQuery(r, listID))}))
+}
+
+// The parameters that say what the root page is showing, for links to the
+// other views of it. n.b. the root page shows a list even when r doesn't say
+// which, so listID is the one it's showing.
+func viewQuery(r *http.Request, listID int64) string {
+	v := url.Values{}
+	for _, p := range append([]string{"view"}, filterParams...) {
+		if s := r.FormValue(p); s != "" {
+			v.Set(p, s)
+		}
+	}
+	if listID != 0 {
+		v.Set("list", strconv.FormatInt(listID, 10))
+	}
+	return v.Encode()
+}
+
+// writes links to the Markdown and print views of what the root page is
+// showing for r
+func writeViewLinks(w http.ResponseWriter, r *http.Request, listID int64) {
+	q := template.HTMLEscapeString(viewQuery(r, listID))
+	fmt.Fprintf(w, ` <a href="/list.md?%s">Markdown</a> <a href="/print?%s">Print</a>
+`, q, q)
+}